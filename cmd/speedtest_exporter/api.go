@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
+
+// traceHandler serves the last path traces as JSON, keyed by module. The
+// module query parameter limits the response to one module.
+func traceHandler(exporters map[string]*exporter.Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		selected, ok := selectModules(w, r, exporters)
+		if !ok {
+			return
+		}
+		traces := make(map[string][]exporter.PathTrace)
+		for name, e := range selected {
+			traces[name] = e.LastTraces()
+		}
+		writeJSON(w, traces)
+	}
+}
+
+// latestResultHandler serves the result of the last run of each module that
+// has run, keyed by module. The module query parameter limits the response
+// to one module.
+func latestResultHandler(exporters map[string]*exporter.Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		selected, ok := selectModules(w, r, exporters)
+		if !ok {
+			return
+		}
+		results := make(map[string]exporter.Result)
+		for name, e := range selected {
+			if res, ok := e.LatestResult(); ok {
+				results[name] = res
+			}
+		}
+		writeJSON(w, results)
+	}
+}
+
+// resultsHandler serves the kept run results of all modules, oldest first.
+// The since query parameter, an RFC 3339 timestamp, leaves out runs that
+// started earlier; module limits the response to one module.
+func resultsHandler(exporters map[string]*exporter.Exporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var since time.Time
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+			if since, err = time.Parse(time.RFC3339, s); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid since %q, use an RFC 3339 timestamp", s), http.StatusBadRequest)
+				return
+			}
+		}
+		selected, ok := selectModules(w, r, exporters)
+		if !ok {
+			return
+		}
+		results := []exporter.Result{}
+		for _, e := range selected {
+			results = append(results, e.Results(since)...)
+		}
+		slices.SortStableFunc(results, func(a, b exporter.Result) int {
+			return a.Start.Compare(b.Start)
+		})
+		writeJSON(w, results)
+	}
+}
+
+// runHandler queues a run of the module named by the module query
+// parameter, or the default module, and answers with the job right away.
+// The phases query parameter overrides the module's phases.
+func runHandler(exporters map[string]*exporter.Exporter, q *jobQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Use POST to start a run", http.StatusMethodNotAllowed)
+			return
+		}
+		module := r.URL.Query().Get("module")
+		if module == "" {
+			module = defaultModule
+		}
+		e, ok := exporters[module]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %q", module), http.StatusBadRequest)
+			return
+		}
+		phases, ok := requestPhases(w, r, e)
+		if !ok {
+			return
+		}
+
+		// The run outlives the request; it is only cancelled on shutdown.
+		j, err := q.submit(context.WithoutCancel(r.Context()), e, module, phases, triggerAPI, false)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Could not queue run: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+		info := j.snapshot()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/api/v1/jobs/"+info.ID)
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, info)
+	}
+}
+
+// jobHandler serves the status, progress and, once finished, the result of
+// a job.
+func jobHandler(q *jobQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info, ok := q.get(r.PathValue("id"))
+		if !ok {
+			http.Error(w, "Unknown job", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, info)
+	}
+}
+
+// selectModules returns the exporter named by the module query parameter,
+// or all of them when it is not set. It reports an unknown module to the
+// client and returns false.
+func selectModules(w http.ResponseWriter, r *http.Request, exporters map[string]*exporter.Exporter) (map[string]*exporter.Exporter, bool) {
+	module := r.URL.Query().Get("module")
+	if module == "" {
+		return exporters, true
+	}
+	e, ok := exporters[module]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", module), http.StatusBadRequest)
+		return nil, false
+	}
+	return map[string]*exporter.Exporter{module: e}, true
+}
+
+// writeJSON writes v as the JSON response body.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
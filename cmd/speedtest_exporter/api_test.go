@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
+
+func TestTraceHandler(t *testing.T) {
+	exporters := map[string]*exporter.Exporter{
+		defaultModule: exporter.New(exporter.Config{ServerIDs: []int{-1}}),
+		"lte":         exporter.New(exporter.Config{ServerIDs: []int{-1}}),
+	}
+	handler := traceHandler(exporters)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/trace", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
+	}
+	var got map[string][]exporter.PathTrace
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(got) != 2 {
+		t.Errorf("expected traces of 2 modules, got %v", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/trace?module=lte", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if body := w.Body.String(); body != "{\"lte\":[]}\n" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/trace?module=missing", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown module, got %d", w.Code)
+	}
+}
+
+func TestLatestResultHandler(t *testing.T) {
+	exporters := map[string]*exporter.Exporter{
+		defaultModule: newFakeExporter(defaultModule, fakeRunner{}),
+		"idle":        exporter.New(exporter.Config{ServerIDs: []int{-1}}),
+	}
+	runOnce(exporters[defaultModule])
+	handler := latestResultHandler(exporters)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/results/latest", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	var got map[string]exporter.Result
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected only the module that ran, got %v", got)
+	}
+	res := got[defaultModule]
+	if !res.Success || res.Module != defaultModule || len(res.Servers) != 1 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	s := res.Servers[0]
+	if s.Server.ID != "100" || s.User.ISP != "Example ISP" || s.LatencySeconds == nil || *s.LatencySeconds != 0.01 || s.DownloadBytesPerSecond == nil || *s.DownloadBytesPerSecond != 1000 {
+		t.Errorf("unexpected server result %+v", s)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/results/latest?module=idle", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if body := w.Body.String(); body != "{}\n" {
+		t.Errorf("expected no result for a module that never ran, got %q", body)
+	}
+}
+
+func TestResultsHandler(t *testing.T) {
+	e := newFakeExporter(defaultModule, fakeRunner{})
+	runOnce(e)
+	between := time.Now()
+	runOnce(e)
+	handler := resultsHandler(map[string]*exporter.Exporter{defaultModule: e})
+
+	for _, tt := range []struct {
+		target string
+		want   int
+	}{
+		{"/api/v1/results", 2},
+		{"/api/v1/results?since=" + between.Format(time.RFC3339Nano), 1},
+		{"/api/v1/results?since=" + time.Now().Add(time.Hour).Format(time.RFC3339), 0},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var got []exporter.Result
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", tt.target, err)
+		}
+		if len(got) != tt.want {
+			t.Errorf("%s: expected %d results, got %d", tt.target, tt.want, len(got))
+		}
+	}
+
+	for _, target := range []string{"/api/v1/results?since=yesterday", "/api/v1/results?module=missing"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, w.Code)
+		}
+	}
+}
+
+func TestRunHandler(t *testing.T) {
+	q := startQueue(t)
+	exporters := map[string]*exporter.Exporter{
+		defaultModule: newFakeExporter(defaultModule, fakeRunner{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/run", runHandler(exporters, q))
+	mux.HandleFunc("/api/v1/jobs/{id}", jobHandler(q))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/run?module=default&phases=ping", nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", w.Code, w.Body)
+	}
+	var queued jobInfo
+	if err := json.NewDecoder(w.Body).Decode(&queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued.ID == "" || queued.Module != defaultModule || queued.Trigger != triggerAPI || len(queued.Phases) != 1 {
+		t.Errorf("unexpected job %+v", queued)
+	}
+	if loc := w.Header().Get("Location"); loc != "/api/v1/jobs/"+queued.ID {
+		t.Errorf("unexpected Location %q", loc)
+	}
+
+	var info jobInfo
+	deadline := time.Now().Add(5 * time.Second)
+	for info.Status != jobSucceeded && time.Now().Before(deadline) {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/jobs/"+queued.ID, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", w.Code)
+		}
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info.Status != jobSucceeded || info.Result == nil || info.Progress.PhasesDone != 1 {
+		t.Errorf("unexpected finished job %+v", info)
+	}
+}
+
+func TestRunHandler_BadRequests(t *testing.T) {
+	exporters := map[string]*exporter.Exporter{defaultModule: exporter.New(exporter.Config{ServerIDs: []int{-1}})}
+	handler := runHandler(exporters, newJobQueue())
+
+	for _, tt := range []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodGet, "/api/v1/run", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/v1/run?module=missing", http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/run?phases=jitter", http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected status %d, got %d", tt.method, tt.target, tt.want, w.Code)
+		}
+	}
+}
+
+func TestJobHandler_Unknown(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/jobs/{id}", jobHandler(newJobQueue()))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/jobs/nope", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", w.Code)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+	"go.yaml.in/yaml/v2"
+)
+
+// defaultModule is used when a scrape does not name a module, and is the only
+// module when no config file is given.
+const defaultModule = "default"
+
+// fileConfig is the layout of the file passed with -config_file.
+type fileConfig struct {
+	Modules map[string]exporter.Config `yaml:"modules"`
+}
+
+// loadConfig reads and validates the modules in the config file at path.
+func loadConfig(path string) (map[string]exporter.Config, error) {
+	data, err := os.ReadFile(path) // #nosec G304 -- path is an operator-supplied flag.
+	if err != nil {
+		return nil, err
+	}
+
+	var fc fileConfig
+	if err := yaml.UnmarshalStrict(data, &fc); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(fc.Modules) == 0 {
+		return nil, fmt.Errorf("%s defines no modules", path)
+	}
+
+	for name, cfg := range fc.Modules {
+		if err := validateModule(&cfg); err != nil {
+			return nil, fmt.Errorf("module %q: %w", name, err)
+		}
+		fc.Modules[name] = cfg
+	}
+	return fc.Modules, nil
+}
+
+// validateModule fills in defaults for unset fields and checks the rest.
+func validateModule(cfg *exporter.Config) error {
+	if len(cfg.ServerIDs) == 0 {
+		cfg.ServerIDs = []int{-1}
+	}
+
+	if cfg.FallbackPolicy == "" {
+		cfg.FallbackPolicy = exporter.FallbackFail
+	}
+	if _, err := exporter.ParseFallbackPolicy(string(cfg.FallbackPolicy)); err != nil {
+		return err
+	}
+
+	if len(cfg.Phases) == 0 {
+		cfg.Phases = exporter.AllPhases
+	}
+	if err := exporter.ValidatePhases(cfg.Phases); err != nil {
+		return err
+	}
+
+	if cfg.Budget.OnExhausted == "" {
+		cfg.Budget.OnExhausted = exporter.BudgetLatencyOnly
+	}
+	if err := cfg.Budget.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.Transfer.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.PathProbe.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.PathMTU.Validate(); err != nil {
+		return err
+	}
+
+	if err := cfg.ValidateTCPInfo(); err != nil {
+		return err
+	}
+
+	if err := cfg.ValidateLinks(); err != nil {
+		return err
+	}
+
+	if err := cfg.ValidateIPFamily(); err != nil {
+		return err
+	}
+
+	if err := cfg.ValidateDNS(); err != nil {
+		return err
+	}
+
+	if err := cfg.ValidateProxy(); err != nil {
+		return err
+	}
+
+	return cfg.ValidateHeaders()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("writing config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+modules:
+  default: {}
+  lte:
+    server_ids: [100, 200]
+    server_fallback_policy: skip_missing
+    phases: [ping]
+    budget:
+      monthly_bytes: 5000000000
+    transfer:
+      duration: 10s
+      payload_size: 1000000
+      warmup: 2s
+  multiwan:
+    ip_family: 4
+    links:
+      - name: fiber
+        source_address: 192.0.2.10
+        contract_download_bytes_per_second: 125000000
+      - name: lte
+        source_address: 198.51.100.7
+`)
+
+	modules, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(modules) != 3 {
+		t.Fatalf("expected 3 modules, got %d", len(modules))
+	}
+
+	def := modules["default"]
+	if !slices.Equal(def.ServerIDs, []int{-1}) {
+		t.Errorf("expected default server_ids [-1], got %v", def.ServerIDs)
+	}
+	if def.FallbackPolicy != exporter.FallbackFail {
+		t.Errorf("expected default fallback policy fail, got %q", def.FallbackPolicy)
+	}
+	if !slices.Equal(def.Phases, exporter.AllPhases) {
+		t.Errorf("expected all phases by default, got %v", def.Phases)
+	}
+
+	lte := modules["lte"]
+	if !slices.Equal(lte.ServerIDs, []int{100, 200}) {
+		t.Errorf("expected server_ids [100 200], got %v", lte.ServerIDs)
+	}
+	if lte.FallbackPolicy != exporter.FallbackSkipMissing {
+		t.Errorf("expected fallback policy skip_missing, got %q", lte.FallbackPolicy)
+	}
+	if !slices.Equal(lte.Phases, []exporter.Phase{exporter.PhasePing}) {
+		t.Errorf("expected phases [ping], got %v", lte.Phases)
+	}
+	if lte.Transfer.Duration != 10*time.Second || lte.Transfer.Warmup != 2*time.Second || lte.Transfer.PayloadSize != 1000000 {
+		t.Errorf("unexpected transfer settings %+v", lte.Transfer)
+	}
+	if lte.Budget.MonthlyBytes != 5000000000 || lte.Budget.OnExhausted != exporter.BudgetLatencyOnly {
+		t.Errorf("unexpected budget %+v", lte.Budget)
+	}
+
+	links := modules["multiwan"].Links
+	if len(links) != 2 || links[0].Name != "fiber" || links[0].ContractDownload != 125e6 || links[1].SourceAddress != "198.51.100.7" {
+		t.Errorf("unexpected links %+v", links)
+	}
+	if modules["multiwan"].IPFamily != exporter.IPv4 {
+		t.Errorf("expected ip_family 4, got %q", modules["multiwan"].IPFamily)
+	}
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "no modules", content: "modules: {}\n"},
+		{name: "unknown field", content: "modules:\n  default:\n    server_idz: [1]\n"},
+		{name: "bad fallback policy", content: "modules:\n  default:\n    server_fallback_policy: sometimes\n"},
+		{name: "bad phase", content: "modules:\n  default:\n    phases: [jitter]\n"},
+		{name: "warmup longer than duration", content: "modules:\n  default:\n    transfer:\n      duration: 5s\n      warmup: 10s\n"},
+		{name: "bad source address", content: "modules:\n  default:\n    source_address: wan1\n"},
+		{name: "duplicate link", content: "modules:\n  default:\n    links:\n      - name: wan\n      - name: wan\n"},
+		{name: "bad dns server", content: "modules:\n  default:\n    dns_server: dns.example\n"},
+		{name: "path probe max hops", content: "modules:\n  default:\n    path_probe:\n      enabled: true\n      max_hops: 300\n"},
+		{name: "path mtu timeout", content: "modules:\n  default:\n    path_mtu:\n      enabled: true\n      probe_timeout: -1s\n"},
+		{name: "bad header", content: "modules:\n  default:\n    headers:\n      Host: speedtest.example\n"},
+		{name: "bad ip family", content: "modules:\n  default:\n    ip_family: 5\n"},
+		{name: "bad budget action", content: "modules:\n  default:\n    budget:\n      daily_bytes: 100\n      on_exhausted: panic\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadConfig(writeConfig(t, tt.content)); err == nil {
+				t.Fatal("expected error, got nil")
+			}
+		})
+	}
+
+	if _, err := loadConfig(filepath.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
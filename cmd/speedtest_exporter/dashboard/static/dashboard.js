@@ -0,0 +1,64 @@
+// The dashboard follows /api/v1/stream to show the progress of every run
+// next to its module, and reloads the page once a run is done to show its
+// result. Run now buttons queue a run of their module.
+const statuses = new Map();
+document.querySelectorAll(".run-status").forEach((status) => {
+  statuses.set(status.dataset.module, status);
+});
+
+function describePhase(ev) {
+  const server = ev.server ? ` on ${ev.server.name} (${ev.server.id})` : "";
+  return `${ev.phase}${server}`;
+}
+
+function showEvent(ev) {
+  const status = statuses.get(ev.module);
+  if (!status) {
+    return;
+  }
+  const button = status.previousElementSibling;
+  switch (ev.type) {
+    case "job":
+      if (ev.status === "queued" || ev.status === "running") {
+        button.disabled = true;
+        status.textContent = `${ev.status}…`;
+        return;
+      }
+      location.reload();
+      return;
+    case "phase_start":
+      button.disabled = true;
+      status.textContent = `${describePhase(ev)}…`;
+      return;
+    case "ping":
+      status.textContent = `${describePhase(ev)}: ${(ev.value * 1000).toFixed(1)} ms`;
+      return;
+    case "throughput":
+      status.textContent = `${describePhase(ev)}: ${((ev.value * 8) / 1e6).toFixed(1)} Mbit/s`;
+      return;
+  }
+}
+
+const stream = new EventSource("/api/v1/stream");
+for (const type of ["job", "phase_start", "ping", "throughput"]) {
+  stream.addEventListener(type, (msg) => {
+    showEvent({ type, ...JSON.parse(msg.data) });
+  });
+}
+
+document.querySelectorAll("button.run").forEach((button) => {
+  button.addEventListener("click", async () => {
+    const status = button.nextElementSibling;
+    button.disabled = true;
+    status.textContent = "queued…";
+    try {
+      const resp = await fetch(button.dataset.url, { method: "POST" });
+      if (!resp.ok) {
+        throw new Error((await resp.text()).trim());
+      }
+    } catch (err) {
+      status.textContent = err.message;
+      button.disabled = false;
+    }
+  });
+});
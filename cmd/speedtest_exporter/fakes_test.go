@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// fakeClient returns a single server. With userErr set it can't reach
+// speedtest.net.
+type fakeClient struct {
+	userErr error
+}
+
+func (c fakeClient) FetchUserInfo(context.Context) (*speedtest.User, error) {
+	if c.userErr != nil {
+		return nil, c.userErr
+	}
+	return &speedtest.User{IP: "203.0.113.1", Isp: "Example ISP"}, nil
+}
+
+func (fakeClient) FetchServers(context.Context) (speedtest.Servers, error) {
+	return speedtest.Servers{{ID: "100", Name: "Test", URL: "http://speedtest.example:8080/speedtest/upload.php"}}, nil
+}
+
+// fakeRunner measures fixed values. With transferErr set its downloads and
+// uploads fail. With release set, each ping reports on started and waits
+// until release is closed.
+type fakeRunner struct {
+	transferErr error
+	started     chan struct{}
+	release     chan struct{}
+}
+
+// newBlockingRunner returns a fakeRunner whose pings wait to be released.
+func newBlockingRunner() fakeRunner {
+	return fakeRunner{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (r fakeRunner) PingTest(ctx context.Context, s *speedtest.Server) error {
+	if r.release != nil {
+		r.started <- struct{}{}
+		select {
+		case <-r.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.Latency = 10 * time.Millisecond
+	return nil
+}
+
+func (r fakeRunner) DownloadTest(_ context.Context, s *speedtest.Server) error {
+	if r.transferErr != nil {
+		return r.transferErr
+	}
+	s.DLSpeed = 1000
+	return nil
+}
+
+func (r fakeRunner) UploadTest(_ context.Context, s *speedtest.Server) error {
+	if r.transferErr != nil {
+		return r.transferErr
+	}
+	s.ULSpeed = 500
+	return nil
+}
+
+// newFakeExporter returns an exporter of the module name that tests the
+// fakeClient's server with runner.
+func newFakeExporter(name string, runner fakeRunner) *exporter.Exporter {
+	return exporter.NewWithDeps(exporter.Config{Name: name, ServerIDs: []int{-1}}, fakeClient{}, runner)
+}
+
+// runOnce runs e and discards the metrics.
+func runOnce(e *exporter.Exporter) {
+	ch := make(chan prometheus.Metric, 100)
+	e.Collect(ch)
+}
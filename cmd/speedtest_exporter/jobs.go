@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxQueuedJobs is how many jobs may wait for the one running.
+	maxQueuedJobs = 10
+	// maxFinishedJobs is how many finished jobs are kept for /api/v1/jobs.
+	maxFinishedJobs = 100
+)
+
+var (
+	errQueueBusy = errors.New("a run is already in progress")
+	errQueueFull = errors.New("too many runs are queued")
+)
+
+// scrapeMode is what a scrape does while another run is in progress or
+// queued.
+type scrapeMode string
+
+const (
+	// scrapeReject answers the scrape with 503.
+	scrapeReject scrapeMode = "reject"
+	// scrapeWait joins a scrape of the same module and phases that is in
+	// progress or queued, or else queues a run, and waits for its result.
+	scrapeWait scrapeMode = "wait"
+)
+
+// jobStatus is the state of a job.
+type jobStatus string
+
+const (
+	jobQueued    jobStatus = "queued"
+	jobRunning   jobStatus = "running"
+	jobSucceeded jobStatus = "succeeded"
+	jobFailed    jobStatus = "failed"
+	jobCancelled jobStatus = "cancelled"
+)
+
+// What started a job.
+const (
+	triggerScrape   = "scrape"
+	triggerAPI      = "api"
+	triggerSchedule = "schedule"
+)
+
+// jobProgress counts the phases run against servers so far. The total grows
+// as the servers of each link and IP family are selected.
+type jobProgress struct {
+	PhasesDone  int    `json:"phases_done"`
+	PhasesTotal int    `json:"phases_total"`
+	Current     string `json:"current,omitempty"`
+}
+
+// jobInfo is what /api/v1/jobs/{id} reports about a job.
+type jobInfo struct {
+	ID       string           `json:"id"`
+	Module   string           `json:"module"`
+	Phases   []exporter.Phase `json:"phases"`
+	Trigger  string           `json:"trigger"`
+	Status   jobStatus        `json:"status"`
+	Created  time.Time        `json:"created"`
+	Started  *time.Time       `json:"started,omitempty"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	Progress jobProgress      `json:"progress"`
+	Result   *exporter.Result `json:"result,omitempty"`
+	Error    string           `json:"error,omitempty"`
+}
+
+// job is one run of a module. done is closed once the job finished, after
+// which metrics holds what the run exported.
+type job struct {
+	ctx    context.Context
+	e      *exporter.Exporter
+	done   chan struct{}
+	events *streamHub
+
+	// waiters counts the scrapes sharing the job; the last one to leave
+	// cancels it. Guarded by the queue's mu.
+	waiters int
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	info    jobInfo
+	metrics []prometheus.Metric
+}
+
+// snapshot returns the current state of the job.
+func (j *job) snapshot() jobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.info
+}
+
+func (j *job) update(f func(*jobInfo)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f(&j.info)
+}
+
+// publish tells stream clients about the status of the job.
+func (j *job) publish() {
+	info := j.snapshot()
+	j.events.publish(streamEvent{
+		Type:   eventJob,
+		Job:    info.ID,
+		Module: info.Module,
+		Time:   time.Now(),
+		Status: info.Status,
+		Error:  info.Error,
+	})
+}
+
+// finish records the end of the job and wakes up its waiters.
+func (j *job) finish(status jobStatus, res *exporter.Result, err error) {
+	j.update(func(info *jobInfo) {
+		now := time.Now()
+		info.Status = status
+		info.Finished = &now
+		info.Result = res
+		info.Progress.Current = ""
+		if err != nil {
+			info.Error = err.Error()
+		}
+	})
+	j.publish()
+	close(j.done)
+}
+
+// jobQueue runs the jobs of all modules one at a time, in the order they
+// were submitted, so tests never compete for the link. Their progress is
+// published to events.
+type jobQueue struct {
+	wake   chan struct{}
+	events *streamHub
+	// afterRun, if set, is called with every job that was not cancelled,
+	// once it finished. It is set before run is called.
+	afterRun func(module string, j *job)
+
+	mu       sync.Mutex
+	pending  []*job
+	running  *job
+	jobs     map[string]*job
+	finished []string
+	closed   bool
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{
+		wake:   make(chan struct{}, 1),
+		events: newStreamHub(),
+		jobs:   make(map[string]*job),
+	}
+}
+
+// submit queues a run of e with the given phases. The run is cancelled when
+// ctx is. With idleOnly the job is refused with errQueueBusy unless nothing
+// is running or queued.
+func (q *jobQueue) submit(ctx context.Context, e *exporter.Exporter, module string, phases []exporter.Phase, trigger string, idleOnly bool) (*job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if idleOnly && (q.running != nil || len(q.pending) > 0) {
+		return nil, errQueueBusy
+	}
+	return q.enqueue(ctx, e, module, phases, trigger)
+}
+
+// join returns a scrape job of module with the given phases that is running
+// or queued, or else queues a new one, singleflight style. The job is
+// cancelled once every caller that joined it called leave, so it is bound
+// to the contexts of all of them rather than only to ctx of the first.
+func (q *jobQueue) join(ctx context.Context, e *exporter.Exporter, module string, phases []exporter.Phase) (j *job, leave func(), err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, c := range append([]*job{q.running}, q.pending...) {
+		if c != nil && c.waiters > 0 && c.info.Module == module && slices.Equal(c.info.Phases, phases) {
+			j = c
+			break
+		}
+	}
+	if j == nil {
+		runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		if j, err = q.enqueue(runCtx, e, module, phases, triggerScrape); err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		j.cancel = cancel
+	}
+	j.waiters++
+	return j, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if j.waiters--; j.waiters == 0 {
+			j.cancel()
+		}
+	}, nil
+}
+
+// enqueue adds a job to the queue. Callers hold q.mu.
+func (q *jobQueue) enqueue(ctx context.Context, e *exporter.Exporter, module string, phases []exporter.Phase, trigger string) (*job, error) {
+	switch {
+	case q.closed:
+		return nil, errors.New("shutting down")
+	case len(q.pending) >= maxQueuedJobs:
+		return nil, errQueueFull
+	}
+
+	j := &job{
+		ctx:    ctx,
+		e:      e,
+		done:   make(chan struct{}),
+		events: q.events,
+		info: jobInfo{
+			ID:      rand.Text(),
+			Module:  module,
+			Phases:  phases,
+			Trigger: trigger,
+			Status:  jobQueued,
+			Created: time.Now(),
+		},
+	}
+	q.jobs[j.info.ID] = j
+	q.pending = append(q.pending, j)
+	j.publish()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return j, nil
+}
+
+// get returns the state of the job with the given ID.
+func (q *jobQueue) get(id string) (jobInfo, bool) {
+	q.mu.Lock()
+	j, ok := q.jobs[id]
+	q.mu.Unlock()
+	if !ok {
+		return jobInfo{}, false
+	}
+	return j.snapshot(), true
+}
+
+// run executes queued jobs until ctx is cancelled, which also cancels the
+// job running then. Jobs still queued are cancelled.
+func (q *jobQueue) run(ctx context.Context) {
+	for {
+		j := q.next()
+		if j == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-ctx.Done():
+				q.close(ctx.Err())
+				return
+			}
+		}
+		q.execute(ctx, j)
+		if info := j.snapshot(); info.Status != jobCancelled && q.afterRun != nil {
+			q.afterRun(info.Module, j)
+		}
+		q.mu.Lock()
+		q.running = nil
+		q.retire(j)
+		q.mu.Unlock()
+	}
+}
+
+// next takes the oldest queued job and marks it running.
+func (q *jobQueue) next() *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return nil
+	}
+	j := q.pending[0]
+	q.pending = q.pending[1:]
+	q.running = j
+	return j
+}
+
+// retire keeps the job for lookups, forgetting the oldest finished jobs.
+// Callers hold q.mu.
+func (q *jobQueue) retire(j *job) {
+	q.finished = append(q.finished, j.info.ID)
+	for len(q.finished) > maxFinishedJobs {
+		delete(q.jobs, q.finished[0])
+		q.finished = q.finished[1:]
+	}
+}
+
+// close cancels the queued jobs, refuses new ones and ends the streams.
+func (q *jobQueue) close(err error) {
+	q.mu.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.closed = true
+	for _, j := range pending {
+		q.retire(j)
+	}
+	q.mu.Unlock()
+	for _, j := range pending {
+		j.finish(jobCancelled, nil, err)
+	}
+	q.events.close()
+}
+
+// execute runs j, collecting its metrics and reporting its progress.
+func (q *jobQueue) execute(ctx context.Context, j *job) {
+	if err := j.ctx.Err(); err != nil {
+		j.finish(jobCancelled, nil, err)
+		return
+	}
+	runCtx, cancel := context.WithCancel(j.ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	info := j.snapshot()
+	j.update(func(info *jobInfo) {
+		now := time.Now()
+		info.Status = jobRunning
+		info.Started = &now
+	})
+	j.publish()
+	slog.Info("job started", "job", info.ID, "module", info.Module, "trigger", info.Trigger)
+	runCtx = exporter.WithProgress(runCtx, &exporter.Progress{
+		ServersSelected: func(_ string, _ exporter.IPFamily, servers []exporter.ServerInfo) {
+			j.update(func(info *jobInfo) { info.Progress.PhasesTotal += len(servers) * len(info.Phases) })
+		},
+		PhaseStart: func(ev exporter.PhaseEvent) {
+			j.update(func(info *jobInfo) {
+				info.Progress.Current = fmt.Sprintf("%s on %s (%s)", ev.Phase, ev.Server.Name, ev.Server.ID)
+			})
+			j.events.publish(phaseEvent(eventPhaseStart, info, ev))
+		},
+		PhaseDone: func(ev exporter.PhaseEvent) {
+			j.update(func(info *jobInfo) { info.Progress.PhasesDone++ })
+			j.events.publish(phaseEvent(eventPhaseEnd, info, ev))
+		},
+		Sample: func(ev exporter.PhaseEvent) {
+			typ := eventThroughput
+			if ev.Phase == exporter.PhasePing {
+				typ = eventPing
+			}
+			j.events.publish(phaseEvent(typ, info, ev))
+		},
+	})
+
+	ch := make(chan prometheus.Metric)
+	var metrics []prometheus.Metric
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+	}()
+	res := j.e.Run(runCtx, info.Phases, ch)
+	close(ch)
+	<-collected
+
+	j.mu.Lock()
+	j.metrics = metrics
+	j.mu.Unlock()
+
+	status, err := jobSucceeded, runCtx.Err()
+	switch {
+	case err != nil:
+		status = jobCancelled
+	case !res.Success:
+		status = jobFailed
+	}
+	slog.Info("job finished", "job", info.ID, "module", info.Module, "status", status)
+	j.finish(status, &res, err)
+}
+
+// replayCollector exports the metrics a job collected.
+type replayCollector struct {
+	e *exporter.Exporter
+	j *job
+}
+
+func (c *replayCollector) Describe(ch chan<- *prometheus.Desc) { c.e.Describe(ch) }
+func (c *replayCollector) Collect(ch chan<- prometheus.Metric) {
+	c.j.mu.Lock()
+	defer c.j.mu.Unlock()
+	for _, m := range c.j.metrics {
+		ch <- m
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
+
+// startQueue runs a job queue until the test ends.
+func startQueue(t *testing.T) *jobQueue {
+	t.Helper()
+	q := newJobQueue()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		q.run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return q
+}
+
+func waitJob(t *testing.T, j *job) jobInfo {
+	t.Helper()
+	select {
+	case <-j.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job did not finish")
+	}
+	return j.snapshot()
+}
+
+func TestJobQueue_Run(t *testing.T) {
+	q := startQueue(t)
+	e := newFakeExporter(defaultModule, fakeRunner{})
+
+	j, err := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerAPI, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := waitJob(t, j)
+
+	if info.Status != jobSucceeded || info.Started == nil || info.Finished == nil {
+		t.Errorf("unexpected job %+v", info)
+	}
+	if info.Progress != (jobProgress{PhasesDone: 3, PhasesTotal: 3}) {
+		t.Errorf("unexpected progress %+v", info.Progress)
+	}
+	if info.Result == nil || !info.Result.Success || len(info.Result.Servers) != 1 {
+		t.Errorf("unexpected result %+v", info.Result)
+	}
+	if len(j.metrics) == 0 {
+		t.Error("expected the run's metrics to be kept")
+	}
+	if got, ok := q.get(info.ID); !ok || got.Status != jobSucceeded {
+		t.Errorf("expected to look up the finished job, got %+v", got)
+	}
+}
+
+func TestJobQueue_OneAtATime(t *testing.T) {
+	q := startQueue(t)
+	runner := newBlockingRunner()
+	e := newFakeExporter(defaultModule, runner)
+	ping := []exporter.Phase{exporter.PhasePing}
+
+	first, err := q.submit(context.Background(), e, defaultModule, ping, triggerAPI, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-runner.started
+	if info := first.snapshot(); info.Status != jobRunning || info.Progress.Current != "ping on Test (100)" {
+		t.Errorf("unexpected running job %+v", info)
+	}
+
+	second, err := q.submit(context.Background(), e, defaultModule, ping, triggerAPI, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.submit(context.Background(), e, defaultModule, ping, triggerScrape, true); !errors.Is(err, errQueueBusy) {
+		t.Errorf("expected a scrape to be refused while busy, got %v", err)
+	}
+	if info := second.snapshot(); info.Status != jobQueued {
+		t.Errorf("expected the second job to wait, got %s", info.Status)
+	}
+
+	close(runner.release)
+	waitJob(t, first)
+	if info := waitJob(t, second); info.Status != jobSucceeded {
+		t.Errorf("unexpected second job %+v", info)
+	}
+}
+
+func TestJobQueue_Full(t *testing.T) {
+	q := newJobQueue()
+	e := exporter.New(exporter.Config{ServerIDs: []int{-1}})
+	for range maxQueuedJobs {
+		if _, err := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerAPI, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerAPI, false); !errors.Is(err, errQueueFull) {
+		t.Errorf("expected errQueueFull, got %v", err)
+	}
+}
+
+func TestJobQueue_Cancelled(t *testing.T) {
+	q := newJobQueue()
+	e := exporter.NewWithDeps(exporter.Config{ServerIDs: []int{-1}}, fakeClient{}, fakeRunner{})
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned, _ := q.submit(ctx, e, defaultModule, exporter.AllPhases, triggerScrape, false)
+	cancel()
+	queued, _ := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerAPI, false)
+
+	// The first job's context is gone before it starts, and the queue is
+	// shut down while the second one waits.
+	q.execute(context.Background(), q.next())
+	q.close(context.Canceled)
+
+	for _, j := range []*job{abandoned, queued} {
+		if info := waitJob(t, j); info.Status != jobCancelled || info.Error == "" || info.Result != nil {
+			t.Errorf("expected a cancelled job, got %+v", info)
+		}
+	}
+	if _, err := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerAPI, false); err == nil {
+		t.Error("expected the closed queue to refuse jobs")
+	}
+}
+
+func TestJobQueue_ForgetsOldJobs(t *testing.T) {
+	q := newJobQueue()
+	e := exporter.New(exporter.Config{ServerIDs: []int{-1}})
+	var first string
+	for i := range maxFinishedJobs + 1 {
+		j, err := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerAPI, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = j.info.ID
+		}
+		q.next()
+		q.retire(j)
+	}
+	if _, ok := q.get(first); ok {
+		t.Error("expected the oldest finished job to be forgotten")
+	}
+	if len(q.jobs) != maxFinishedJobs {
+		t.Errorf("expected %d jobs, got %d", maxFinishedJobs, len(q.jobs))
+	}
+}
+
+func TestMetricsHandler_RunsThroughQueue(t *testing.T) {
+	q := startQueue(t)
+	exporters := map[string]*exporter.Exporter{
+		defaultModule: newFakeExporter(defaultModule, fakeRunner{}),
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(exporters, q, scrapeReject).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, "speedtest_up 1") || !strings.Contains(body, "speedtest_latency_seconds{") {
+		t.Errorf("unexpected metrics:\n%s", body)
+	}
+}
+
+func TestMetricsHandler_Busy(t *testing.T) {
+	q := startQueue(t)
+	runner := newBlockingRunner()
+	e := newFakeExporter(defaultModule, runner)
+	running, _ := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerAPI, false)
+	<-runner.started
+
+	w := httptest.NewRecorder()
+	metricsHandler(map[string]*exporter.Exporter{defaultModule: e}, q, scrapeReject).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", w.Code)
+	}
+	close(runner.release)
+	waitJob(t, running)
+}
+
+func TestMetricsHandler_WaitSharesRun(t *testing.T) {
+	q := startQueue(t)
+	runner := newBlockingRunner()
+	e := newFakeExporter(defaultModule, runner)
+	handler := metricsHandler(map[string]*exporter.Exporter{defaultModule: e}, q, scrapeWait)
+
+	recs := make([]*httptest.ResponseRecorder, 3)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Go(func() {
+			handler.ServeHTTP(recs[i], httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		})
+		if i == 0 {
+			<-runner.started
+		}
+	}
+	// Wait for the later scrapes to join the run.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		q.mu.Lock()
+		waiters := q.running.waiters
+		q.mu.Unlock()
+		if waiters == len(recs) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d scrapes to share the run, got %d", len(recs), waiters)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(runner.release)
+	wg.Wait()
+
+	if n := len(runner.started); n != 0 {
+		t.Errorf("expected one run, got %d more", n)
+	}
+	for i, w := range recs {
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "speedtest_up 1") {
+			t.Errorf("scrape %d: unexpected response %d:\n%s", i, w.Code, w.Body.String())
+		}
+	}
+	if body := recs[1].Body.String(); body != recs[0].Body.String() {
+		t.Errorf("expected the scrapes to share the result, got\n%s\nand\n%s", recs[0].Body.String(), body)
+	}
+}
+
+func TestMetricsHandler_WaitQueuesBehindOtherRun(t *testing.T) {
+	q := startQueue(t)
+	runner := newBlockingRunner()
+	e := newFakeExporter(defaultModule, runner)
+	running, _ := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerAPI, false)
+	<-runner.started
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		metricsHandler(map[string]*exporter.Exporter{defaultModule: e}, q, scrapeWait).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	}()
+	close(runner.release)
+	<-done
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	waitJob(t, running)
+	if n := len(runner.started); n != 1 {
+		t.Errorf("expected the scrape to get a run of its own, got %d more runs", n)
+	}
+}
+
+func TestMetricsHandler_WaitBoundedByRequest(t *testing.T) {
+	q := startQueue(t)
+	runner := newBlockingRunner()
+	e := newFakeExporter(defaultModule, runner)
+	running, _ := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerAPI, false)
+	<-runner.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	w := httptest.NewRecorder()
+	metricsHandler(map[string]*exporter.Exporter{defaultModule: e}, q, scrapeWait).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil).WithContext(ctx))
+
+	if w.Body.Len() != 0 {
+		t.Errorf("expected no metrics for a scrape that gave up, got:\n%s", w.Body.String())
+	}
+	close(runner.release)
+	if info := waitJob(t, running); info.Status != jobSucceeded {
+		t.Errorf("expected the running job to be unaffected, got %s", info.Status)
+	}
+}
+
+func TestMetricsHandler_WaitOutlastsWriteTimeout(t *testing.T) {
+	q := startQueue(t)
+	runner := newBlockingRunner()
+	e := newFakeExporter(defaultModule, runner)
+	running, _ := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerAPI, false)
+	<-runner.started
+
+	srv := httptest.NewUnstartedServer(metricsHandler(map[string]*exporter.Exporter{defaultModule: e}, q, scrapeWait))
+	srv.Config.WriteTimeout = 100 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	// Hold the scrape in the queue past the write timeout.
+	time.AfterFunc(300*time.Millisecond, func() { close(runner.release) })
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading metrics: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "speedtest_up 1") {
+		t.Errorf("unexpected response %d:\n%s", resp.StatusCode, body)
+	}
+	waitJob(t, running)
+}
+
+func TestMetricsHandler_QueueClosed(t *testing.T) {
+	for _, mode := range []scrapeMode{scrapeReject, scrapeWait} {
+		t.Run(string(mode), func(t *testing.T) {
+			// The queue is not run, so the scrape's job stays queued.
+			q := newJobQueue()
+			e := newFakeExporter(defaultModule, fakeRunner{})
+			w := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				metricsHandler(map[string]*exporter.Exporter{defaultModule: e}, q, mode).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			}()
+			for deadline := time.Now().Add(5 * time.Second); ; {
+				q.mu.Lock()
+				queued := len(q.pending)
+				q.mu.Unlock()
+				if queued == 1 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("expected the scrape to be queued")
+				}
+				time.Sleep(time.Millisecond)
+			}
+			q.close(context.Canceled)
+			<-done
+
+			if w.Code != http.StatusServiceUnavailable || strings.Contains(w.Body.String(), "speedtest_up") {
+				t.Errorf("expected status 503 without metrics, got %d:\n%s", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestJobQueue_Join(t *testing.T) {
+	q := startQueue(t)
+	runner := newBlockingRunner()
+	e := newFakeExporter(defaultModule, runner)
+	ping := []exporter.Phase{exporter.PhasePing}
+
+	first, leaveFirst, err := q.join(context.Background(), e, defaultModule, ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-runner.started
+	second, leaveSecond, err := q.join(context.Background(), e, defaultModule, ping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first {
+		t.Error("expected the second scrape to join the first")
+	}
+	other, leaveOther, err := q.join(context.Background(), e, defaultModule, exporter.AllPhases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == first {
+		t.Error("expected a scrape of other phases to get a job of its own")
+	}
+
+	// The job keeps running while one of its scrapes waits.
+	leaveFirst()
+	select {
+	case <-first.done:
+		t.Fatal("expected the job to keep running")
+	case <-time.After(20 * time.Millisecond):
+	}
+	leaveSecond()
+	if info := waitJob(t, first); info.Status != jobCancelled {
+		t.Errorf("expected the job to be cancelled once all scrapes left, got %s", info.Status)
+	}
+
+	close(runner.release)
+	defer leaveOther()
+	if info := waitJob(t, other); info.Status != jobSucceeded {
+		t.Errorf("unexpected other job %+v", info)
+	}
+}
+
+func TestJobQueue_AfterRun(t *testing.T) {
+	q := newJobQueue()
+	var modules []string
+	q.afterRun = func(module string, _ *job) { modules = append(modules, module) }
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		q.run(ctx)
+	}()
+	j := finishedJobOn(t, q)
+	cancel()
+	<-stopped
+
+	if len(modules) != 1 || modules[0] != j.snapshot().Module {
+		t.Errorf("unexpected runs %v", modules)
+	}
+}
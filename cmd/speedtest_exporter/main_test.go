@@ -4,29 +4,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
-)
-
-func TestRootHandler(t *testing.T) {
-	req := httptest.NewRequest(http.MethodGet, "/", nil)
-	w := httptest.NewRecorder()
-
-	rootHandler().ServeHTTP(w, req)
+	"time"
 
-	if w.Code != http.StatusOK {
-		t.Errorf("expected status 200, got %d", w.Code)
-	}
-
-	body := w.Body.String()
-	if !containsString(body, "Speedtest Exporter") {
-		t.Error("response body missing title")
-	}
-	if !containsString(body, metricsPath) {
-		t.Error("response body missing metrics link")
-	}
-	if !containsString(body, "/health") {
-		t.Error("response body missing health link")
-	}
-}
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
 
 func TestHealthHandler(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/health", nil)
@@ -83,6 +64,92 @@ func TestParseServerIDs(t *testing.T) {
 	}
 }
 
+func TestHeaderFlag(t *testing.T) {
+	h := headerFlag{}
+	for _, v := range []string{"Accept-Language: en-US", "X-Empty:", "X-Colon: a:b"} {
+		if err := h.Set(v); err != nil {
+			t.Fatalf("%q: unexpected error: %v", v, err)
+		}
+	}
+	want := map[string]string{"Accept-Language": "en-US", "X-Empty": "", "X-Colon": "a:b"}
+	if len(h) != len(want) {
+		t.Fatalf("expected %v, got %v", want, h)
+	}
+	for k, v := range want {
+		if h[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, h[k])
+		}
+	}
+	for _, v := range []string{"no-colon", ": value"} {
+		if err := h.Set(v); err == nil {
+			t.Errorf("%q: expected error", v)
+		}
+	}
+}
+
+func TestScrapeTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  exporter.Config
+		want time.Duration
+	}{
+		{name: "single server", cfg: exporter.Config{ServerIDs: []int{-1}}, want: 70 * time.Second},
+		{name: "sequential", cfg: exporter.Config{ServerIDs: []int{1, 2, 3}}, want: 190 * time.Second},
+		{name: "parallel isolated bandwidth", cfg: exporter.Config{ServerIDs: []int{1, 2, 3}, Parallel: true, BandwidthConcurrency: 1}, want: 190 * time.Second},
+		{name: "parallel batches", cfg: exporter.Config{ServerIDs: []int{1, 2, 3, 4, 5}, Parallel: true, BandwidthConcurrency: 2}, want: 190 * time.Second},
+		{name: "parallel all at once", cfg: exporter.Config{ServerIDs: []int{1, 2, 3, 4}, Parallel: true, BandwidthConcurrency: 10}, want: 70 * time.Second},
+		{name: "links and families", cfg: exporter.Config{ServerIDs: []int{-1}, IPFamily: exporter.IPFamilyBoth, Links: []exporter.Link{{Name: "a"}, {Name: "b"}}}, want: 250 * time.Second},
+		{name: "path probe", cfg: exporter.Config{ServerIDs: []int{1, 2}, PathProbe: exporter.PathProbeConfig{Enabled: true, MaxHops: 10, HopTimeout: time.Second}}, want: 150 * time.Second},
+		{name: "path mtu", cfg: exporter.Config{ServerIDs: []int{-1}, PathMTU: exporter.PathMTUConfig{Enabled: true, ProbeTimeout: 500 * time.Millisecond}}, want: 94 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := scrapeTimeout(tt.cfg); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMetricsHandler_BadRequests(t *testing.T) {
+	exporters := map[string]*exporter.Exporter{
+		defaultModule: exporter.New(exporter.Config{ServerIDs: []int{-1}}),
+	}
+	handler := metricsHandler(exporters, newJobQueue(), scrapeReject)
+
+	for _, target := range []string{"/metrics?module=missing", "/metrics?phases=jitter"} {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", target, w.Code)
+		}
+	}
+}
+
+func TestFlagModule(t *testing.T) {
+	cfg, err := flagModule("100,200", true, "fail", "ping")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.FallbackPolicy != exporter.FallbackClosest {
+		t.Errorf("expected deprecated server_fallback to map to closest, got %q", cfg.FallbackPolicy)
+	}
+	if len(cfg.Phases) != 1 || cfg.Phases[0] != exporter.PhasePing {
+		t.Errorf("expected phases [ping], got %v", cfg.Phases)
+	}
+
+	if _, err := flagModule("100", false, "fail", "jitter"); err == nil {
+		t.Error("expected error for unknown phase")
+	}
+	if _, err := flagModule("100", false, "sometimes", "ping"); err == nil {
+		t.Error("expected error for unknown fallback policy")
+	}
+}
+
 func containsString(s, substr string) bool {
 	return len(s) >= len(substr) && searchStr(s, substr)
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// pushTimeout bounds a push to the Pushgateway.
+const pushTimeout = 30 * time.Second
+
+// pushConfig configures pushing the metrics of scheduled runs to a
+// Prometheus Pushgateway.
+type pushConfig struct {
+	URL string
+	Job string
+	// Grouping holds extra grouping labels. Each module's metrics are
+	// grouped by a module label too.
+	Grouping map[string]string
+	Username string
+	Password string
+	TLS      tlsFiles
+}
+
+// tlsFiles are PEM files to verify a server with and to authenticate to it.
+type tlsFiles struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	InsecureSkipVerify bool
+}
+
+// newTLSClient returns an HTTP client that uses t for HTTPS.
+func newTLSClient(t tlsFiles) (*http.Client, error) {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, errors.New("client certificate and key must be set together")
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		pem, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: transport}, nil
+}
+
+// pushgateway pushes the metrics of jobs to a Pushgateway.
+type pushgateway struct {
+	cfg    pushConfig
+	client *http.Client
+}
+
+func newPushgateway(cfg pushConfig) (*pushgateway, error) {
+	if cfg.Job == "" {
+		return nil, errors.New("push job must not be empty")
+	}
+	client, err := newTLSClient(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("push: %w", err)
+	}
+	return &pushgateway{cfg: cfg, client: client}, nil
+}
+
+// push replaces the metrics of module on the Pushgateway with those of j.
+func (p *pushgateway) push(ctx context.Context, module string, j *job) error {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(&replayCollector{e: j.e, j: j}); err != nil {
+		return err
+	}
+	pusher := push.New(p.cfg.URL, p.cfg.Job).Gatherer(reg).Client(p.client).Grouping("module", module)
+	for _, name := range slices.Sorted(maps.Keys(p.cfg.Grouping)) {
+		pusher.Grouping(name, p.cfg.Grouping[name])
+	}
+	if p.cfg.Username != "" {
+		pusher.BasicAuth(p.cfg.Username, p.cfg.Password)
+	}
+	ctx, cancel := context.WithTimeout(ctx, pushTimeout)
+	defer cancel()
+	return pusher.PushContext(ctx)
+}
+
+// readPasswordFile returns the password in path, without a trailing
+// newline.
+func readPasswordFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// labelFlag collects repeated "name=value" label flags.
+type labelFlag map[string]string
+
+func (l labelFlag) String() string {
+	return fmt.Sprint(map[string]string(l))
+}
+
+func (l labelFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return fmt.Errorf("label %q is not in the form \"name=value\"", s)
+	}
+	l[name] = strings.TrimSpace(value)
+	return nil
+}
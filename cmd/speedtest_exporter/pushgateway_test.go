@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// fakePushgateway stands in for a Pushgateway and records the pushes it
+// gets.
+type fakePushgateway struct {
+	mu     sync.Mutex
+	pushes []pushRequest
+}
+
+type pushRequest struct {
+	method   string
+	path     string
+	user     string
+	password string
+	families []string
+}
+
+func (f *fakePushgateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := pushRequest{method: r.Method, path: r.URL.Path}
+	req.user, req.password, _ = r.BasicAuth()
+	dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+	for {
+		mf := &dto.MetricFamily{}
+		if err := dec.Decode(mf); err != nil {
+			if err != io.EOF {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			break
+		}
+		req.families = append(req.families, mf.GetName())
+	}
+	f.mu.Lock()
+	f.pushes = append(f.pushes, req)
+	f.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakePushgateway) requests() []pushRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]pushRequest(nil), f.pushes...)
+}
+
+// finishedJob runs a job of the default module through a queue.
+func finishedJob(t *testing.T) *job {
+	t.Helper()
+	return finishedJobOn(t, startQueue(t))
+}
+
+// finishedJobOn runs a job of the default module through q.
+func finishedJobOn(t *testing.T, q *jobQueue) *job {
+	t.Helper()
+	e := newFakeExporter(defaultModule, fakeRunner{})
+	j, err := q.submit(context.Background(), e, defaultModule, exporter.AllPhases, triggerSchedule, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, j)
+	return j
+}
+
+func TestPushgateway_Push(t *testing.T) {
+	fake := &fakePushgateway{}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	p, err := newPushgateway(pushConfig{
+		URL:      srv.URL,
+		Job:      "speedtest_exporter",
+		Grouping: map[string]string{"site": "home"},
+		Username: "edge",
+		Password: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.push(context.Background(), defaultModule, finishedJob(t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pushes := fake.requests()
+	if len(pushes) != 1 {
+		t.Fatalf("expected 1 push, got %d", len(pushes))
+	}
+	got := pushes[0]
+	if got.method != http.MethodPut {
+		t.Errorf("expected a PUT replacing the group, got %s", got.method)
+	}
+	if !strings.HasPrefix(got.path, "/metrics/job/speedtest_exporter/") || !strings.Contains(got.path, "/module/default") || !strings.Contains(got.path, "/site/home") {
+		t.Errorf("unexpected path %q", got.path)
+	}
+	if got.user != "edge" || got.password != "secret" {
+		t.Errorf("unexpected basic auth %q:%q", got.user, got.password)
+	}
+	if !strings.Contains(strings.Join(got.families, ","), "speedtest_latency_seconds") {
+		t.Errorf("expected the run's metrics to be pushed, got %v", got.families)
+	}
+}
+
+func TestPushgateway_PushError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	p, err := newPushgateway(pushConfig{URL: srv.URL, Job: "speedtest_exporter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.push(context.Background(), defaultModule, finishedJob(t)); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected the status to be reported, got %v", err)
+	}
+}
+
+func TestPushgateway_TLS(t *testing.T) {
+	fake := &fakePushgateway{}
+	srv := httptest.NewTLSServer(fake)
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	j := finishedJob(t)
+
+	untrusted, err := newPushgateway(pushConfig{URL: srv.URL, Job: "speedtest_exporter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := untrusted.push(context.Background(), defaultModule, j); err == nil {
+		t.Error("expected an unknown certificate to be refused")
+	}
+
+	trusted, err := newPushgateway(pushConfig{URL: srv.URL, Job: "speedtest_exporter", TLS: tlsFiles{CAFile: caFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := trusted.push(context.Background(), defaultModule, j); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if n := len(fake.requests()); n != 1 {
+		t.Errorf("expected 1 push, got %d", n)
+	}
+}
+
+func TestNewPushgateway_Invalid(t *testing.T) {
+	for name, cfg := range map[string]pushConfig{
+		"job":         {URL: "http://pushgateway:9091"},
+		"key missing": {URL: "http://pushgateway:9091", Job: "j", TLS: tlsFiles{CertFile: "client.pem"}},
+		"ca missing":  {URL: "http://pushgateway:9091", Job: "j", TLS: tlsFiles{CAFile: filepath.Join(t.TempDir(), "missing.pem")}},
+	} {
+		if _, err := newPushgateway(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestReadPasswordFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(path, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := readPasswordFile(path); err != nil || got != "s3cret" {
+		t.Errorf("unexpected password %q, %v", got, err)
+	}
+}
+
+func TestLabelFlag(t *testing.T) {
+	l := labelFlag{}
+	if err := l.Set(" site = home "); err != nil || l["site"] != "home" {
+		t.Errorf("unexpected labels %v, %v", l, err)
+	}
+	if err := l.Set("site"); err == nil {
+		t.Error("expected an error for a label without a value")
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// remoteWriteBatchSize is how many series are sent per request.
+	remoteWriteBatchSize = 500
+	// remoteWriteTimeout bounds a request to the remote-write endpoint.
+	remoteWriteTimeout = 30 * time.Second
+	// remoteWriteMaxBackoff is the longest wait between retries.
+	remoteWriteMaxBackoff = time.Minute
+	// defaultRemoteWriteQueueSize is how many series are kept for sending
+	// by default.
+	defaultRemoteWriteQueueSize = 10000
+)
+
+// remoteWriteConfig configures sending the metrics of every run to a
+// Prometheus remote-write endpoint.
+type remoteWriteConfig struct {
+	URL string
+	Job string
+	// Labels are added to every series, besides job and a module label
+	// with the module's name.
+	Labels   map[string]string
+	Username string
+	Password string
+	TLS      tlsFiles
+	// QueueSize is how many series are kept while the endpoint cannot be
+	// reached. The oldest are dropped beyond it.
+	QueueSize int
+}
+
+// remoteLabel is a label of a remote-write series.
+type remoteLabel struct {
+	Name, Value string
+}
+
+// remoteSeries is a sample of a series, timestamped in milliseconds since
+// the epoch.
+type remoteSeries struct {
+	Labels      []remoteLabel
+	Value       float64
+	TimestampMs int64
+}
+
+// remoteWriter sends series to a remote-write endpoint in the background.
+// Series wait in an in-memory queue until they are accepted, so a run's
+// results survive outages of the endpoint, but not a restart.
+type remoteWriter struct {
+	cfg    remoteWriteConfig
+	client *http.Client
+	wake   chan struct{}
+	// minBackoff is the first wait after a failed request; it doubles with
+	// every failure up to remoteWriteMaxBackoff.
+	minBackoff time.Duration
+
+	mu    sync.Mutex
+	queue []remoteSeries
+	// head counts the series ever taken off the queue, so a batch can be
+	// removed after the queue dropped series to make room.
+	head int
+}
+
+func newRemoteWriter(cfg remoteWriteConfig) (*remoteWriter, error) {
+	if cfg.Job == "" {
+		return nil, errors.New("remote write job must not be empty")
+	}
+	if cfg.QueueSize < 1 {
+		return nil, errors.New("remote write queue size must be at least 1")
+	}
+	client, err := newTLSClient(cfg.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("remote write: %w", err)
+	}
+	return &remoteWriter{
+		cfg:        cfg,
+		client:     client,
+		wake:       make(chan struct{}, 1),
+		minBackoff: time.Second,
+	}, nil
+}
+
+// enqueue queues the metrics j collected, timestamped with the end of the
+// run.
+func (w *remoteWriter) enqueue(module string, j *job) error {
+	series, err := w.jobSeries(module, j)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	w.queue = append(w.queue, series...)
+	if dropped := len(w.queue) - w.cfg.QueueSize; dropped > 0 {
+		w.queue = slices.Delete(w.queue, 0, dropped)
+		w.head += dropped
+		slog.Warn("remote write queue is full, dropping the oldest series", "dropped", dropped)
+	}
+	w.mu.Unlock()
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// jobSeries turns the metrics of j into series. Counters, gauges and untyped
+// metrics are sent; the exporter has no others.
+func (w *remoteWriter) jobSeries(module string, j *job) ([]remoteSeries, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(&replayCollector{e: j.e, j: j}); err != nil {
+		return nil, err
+	}
+	families, err := reg.Gather()
+	if err != nil {
+		return nil, err
+	}
+	ts := time.Now()
+	if info := j.snapshot(); info.Result != nil && !info.Result.End.IsZero() {
+		ts = info.Result.End
+	}
+
+	extra := maps.Clone(w.cfg.Labels)
+	if extra == nil {
+		extra = make(map[string]string)
+	}
+	extra["job"] = w.cfg.Job
+	extra["module"] = module
+
+	var series []remoteSeries
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+			labels := []remoteLabel{{Name: "__name__", Value: mf.GetName()}}
+			for _, l := range m.GetLabel() {
+				labels = append(labels, remoteLabel{Name: l.GetName(), Value: l.GetValue()})
+			}
+			// Labels of the metric win over the added ones.
+			for name, v := range extra {
+				if !slices.ContainsFunc(labels, func(l remoteLabel) bool { return l.Name == name }) {
+					labels = append(labels, remoteLabel{Name: name, Value: v})
+				}
+			}
+			slices.SortFunc(labels, func(a, b remoteLabel) int { return cmp.Compare(a.Name, b.Name) })
+			s := remoteSeries{Labels: labels, Value: value, TimestampMs: ts.UnixMilli()}
+			if m.TimestampMs != nil {
+				s.TimestampMs = m.GetTimestampMs()
+			}
+			series = append(series, s)
+		}
+	}
+	return series, nil
+}
+
+// run sends queued series until ctx is cancelled. A batch the endpoint
+// could not take for a reason that may pass is retried with backoff; one it
+// refused is dropped.
+func (w *remoteWriter) run(ctx context.Context) {
+	backoff := w.minBackoff
+	for {
+		start, batch := w.peek()
+		if len(batch) == 0 {
+			select {
+			case <-w.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		err := w.send(ctx, batch)
+		var retry retryableError
+		switch {
+		case err == nil:
+			w.remove(start + len(batch))
+			backoff = w.minBackoff
+			continue
+		case ctx.Err() != nil:
+			return
+		case errors.As(err, &retry):
+			slog.Warn("could not send to remote write endpoint, retrying", "series", len(batch), "backoff", backoff, "error", err)
+		default:
+			slog.Error("remote write endpoint refused series, dropping them", "series", len(batch), "error", err)
+			w.remove(start + len(batch))
+			continue
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, remoteWriteMaxBackoff)
+	}
+}
+
+// peek returns the oldest queued series, up to a batch, and the position
+// of the first of them.
+func (w *remoteWriter) peek() (int, []remoteSeries) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.head, slices.Clone(w.queue[:min(len(w.queue), remoteWriteBatchSize)])
+}
+
+// remove takes the series before position end off the queue, unless it
+// dropped them already.
+func (w *remoteWriter) remove(end int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := min(max(end-w.head, 0), len(w.queue))
+	w.queue = w.queue[n:]
+	w.head += n
+}
+
+// retryableError is a failure that may pass: the endpoint was unreachable,
+// overloaded or failed on its side.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+// send posts series to the endpoint as a remote-write 1.0 request.
+func (w *remoteWriter) send(ctx context.Context, series []remoteSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+	ctx, cancel := context.WithTimeout(ctx, remoteWriteTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "speedtest_exporter")
+	if w.cfg.Username != "" {
+		req.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return retryableError{err}
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return retryableError{err}
+	}
+	return err
+}
+
+// encodeWriteRequest encodes series as a prometheus.WriteRequest protobuf
+// message, each with a single sample:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []remoteSeries) []byte {
+	var req, ts, msg []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, l := range s.Labels {
+			msg = protowire.AppendTag(msg[:0], 1, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.Name)
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendString(msg, l.Value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, msg)
+		}
+		msg = protowire.AppendTag(msg[:0], 1, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.Value))
+		msg = protowire.AppendTag(msg, 2, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.TimestampMs))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, msg)
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest decodes a remote-write request as encodeWriteRequest
+// writes it.
+func decodeWriteRequest(t *testing.T, b []byte) []remoteSeries {
+	t.Helper()
+	// fields calls f with the number and raw value of each field in b.
+	fields := func(b []byte, f func(protowire.Number, protowire.Type, []byte)) {
+		for len(b) > 0 {
+			num, typ, n := protowire.ConsumeTag(b)
+			if n < 0 {
+				t.Fatalf("invalid tag: %v", protowire.ParseError(n))
+			}
+			b = b[n:]
+			m := protowire.ConsumeFieldValue(num, typ, b)
+			if m < 0 {
+				t.Fatalf("invalid field %d: %v", num, protowire.ParseError(m))
+			}
+			f(num, typ, b[:m])
+			b = b[m:]
+		}
+	}
+	var series []remoteSeries
+	fields(b, func(_ protowire.Number, _ protowire.Type, v []byte) {
+		ts, _ := protowire.ConsumeBytes(v)
+		var s remoteSeries
+		fields(ts, func(num protowire.Number, _ protowire.Type, v []byte) {
+			msg, _ := protowire.ConsumeBytes(v)
+			switch num {
+			case 1:
+				var l remoteLabel
+				fields(msg, func(num protowire.Number, _ protowire.Type, v []byte) {
+					str, _ := protowire.ConsumeString(v)
+					if num == 1 {
+						l.Name = str
+					} else {
+						l.Value = str
+					}
+				})
+				s.Labels = append(s.Labels, l)
+			case 2:
+				fields(msg, func(num protowire.Number, _ protowire.Type, v []byte) {
+					if num == 1 {
+						bits, _ := protowire.ConsumeFixed64(v)
+						s.Value = math.Float64frombits(bits)
+					} else {
+						ms, _ := protowire.ConsumeVarint(v)
+						s.TimestampMs = int64(ms)
+					}
+				})
+			}
+		})
+		series = append(series, s)
+	})
+	return series
+}
+
+// fakeReceiver stands in for a remote-write endpoint. It answers with the
+// statuses in fail before accepting requests.
+type fakeReceiver struct {
+	t  *testing.T
+	mu sync.Mutex
+	// fail holds the statuses of the next requests.
+	fail     []int
+	requests int
+	headers  http.Header
+	series   []remoteSeries
+	received chan struct{}
+}
+
+func newFakeReceiver(t *testing.T, fail ...int) *fakeReceiver {
+	return &fakeReceiver{t: t, fail: fail, received: make(chan struct{}, 10)}
+}
+
+func (f *fakeReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if len(f.fail) > 0 {
+		status := f.fail[0]
+		f.fail = f.fail[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	compressed, _ := io.ReadAll(r.Body)
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.headers = r.Header.Clone()
+	f.series = append(f.series, decodeWriteRequest(f.t, body)...)
+	w.WriteHeader(http.StatusNoContent)
+	f.received <- struct{}{}
+}
+
+func (f *fakeReceiver) wait(t *testing.T) {
+	t.Helper()
+	select {
+	case <-f.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected series to be received")
+	}
+}
+
+// startRemoteWriter runs a remote writer sending to url until the test
+// ends.
+func startRemoteWriter(t *testing.T, cfg remoteWriteConfig) *remoteWriter {
+	t.Helper()
+	w, err := newRemoteWriter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.minBackoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		w.run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return w
+}
+
+func labelValue(s remoteSeries, name string) string {
+	for _, l := range s.Labels {
+		if l.Name == name {
+			return l.Value
+		}
+	}
+	return ""
+}
+
+func TestRemoteWriter_Send(t *testing.T) {
+	fake := newFakeReceiver(t)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	w := startRemoteWriter(t, remoteWriteConfig{
+		URL:       srv.URL,
+		Job:       "speedtest",
+		Labels:    map[string]string{"site": "branch-42"},
+		Username:  "edge",
+		Password:  "secret",
+		QueueSize: 100,
+	})
+
+	j := finishedJob(t)
+	if err := w.enqueue(defaultModule, j); err != nil {
+		t.Fatal(err)
+	}
+	fake.wait(t)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for name, want := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"Authorization":                     "Basic ZWRnZTpzZWNyZXQ=",
+	} {
+		if got := fake.headers.Get(name); got != want {
+			t.Errorf("%s: expected %q, got %q", name, want, got)
+		}
+	}
+
+	end := j.snapshot().Result.End.UnixMilli()
+	var up *remoteSeries
+	for i, s := range fake.series {
+		if !slices.IsSortedFunc(s.Labels, func(a, b remoteLabel) int { return cmp.Compare(a.Name, b.Name) }) {
+			t.Errorf("labels not sorted: %v", s.Labels)
+		}
+		if s.TimestampMs != end {
+			t.Errorf("expected the end of the run as timestamp, got %d", s.TimestampMs)
+		}
+		if labelValue(s, "__name__") == "speedtest_up" {
+			up = &fake.series[i]
+		}
+	}
+	if up == nil {
+		t.Fatalf("expected speedtest_up to be sent, got %v", fake.series)
+	}
+	if up.Value != 1 || labelValue(*up, "job") != "speedtest" || labelValue(*up, "module") != defaultModule || labelValue(*up, "site") != "branch-42" {
+		t.Errorf("unexpected series %+v", *up)
+	}
+}
+
+func TestRemoteWriter_Retries(t *testing.T) {
+	fake := newFakeReceiver(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	w := startRemoteWriter(t, remoteWriteConfig{URL: srv.URL, Job: "speedtest", QueueSize: 100})
+
+	if err := w.enqueue(defaultModule, finishedJob(t)); err != nil {
+		t.Fatal(err)
+	}
+	fake.wait(t)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if fake.requests != 3 || len(fake.series) == 0 {
+		t.Errorf("expected the series to arrive on the third request, got %d requests and %d series", fake.requests, len(fake.series))
+	}
+}
+
+func TestRemoteWriter_DropsRefusedSeries(t *testing.T) {
+	fake := newFakeReceiver(t, http.StatusBadRequest)
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	w := startRemoteWriter(t, remoteWriteConfig{URL: srv.URL, Job: "speedtest", QueueSize: 100})
+
+	j := finishedJob(t)
+	if err := w.enqueue(defaultModule, j); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.enqueue("lte", j); err != nil {
+		t.Fatal(err)
+	}
+	fake.wait(t)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, s := range fake.series {
+		if labelValue(s, "module") != "lte" {
+			t.Fatalf("expected only the second run to be sent after the first was refused, got %+v", s)
+		}
+	}
+}
+
+func TestRemoteWriter_QueueSize(t *testing.T) {
+	w, err := newRemoteWriter(remoteWriteConfig{URL: "http://localhost:1", Job: "speedtest", QueueSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := finishedJob(t)
+	if err := w.enqueue(defaultModule, j); err != nil {
+		t.Fatal(err)
+	}
+	start, batch := w.peek()
+	if err := w.enqueue("lte", j); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.queue) != 5 || labelValue(w.queue[0], "module") != "lte" {
+		t.Errorf("expected the 5 newest series to be kept, got %d", len(w.queue))
+	}
+	// Sending the batch peeked before must not take the newer series off.
+	w.remove(start + len(batch))
+	if len(w.queue) != 5 {
+		t.Errorf("expected the newer series to stay queued, got %d", len(w.queue))
+	}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	want := []remoteSeries{
+		{Labels: []remoteLabel{{"__name__", "speedtest_up"}, {"job", "speedtest"}}, Value: 1, TimestampMs: 1767366245000},
+		{Labels: []remoteLabel{{"__name__", "speedtest_latency_seconds"}}, Value: 0.0081, TimestampMs: 1767366245000},
+	}
+	got := decodeWriteRequest(t, encodeWriteRequest(want))
+	if len(got) != len(want) {
+		t.Fatalf("expected %d series, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if !slices.Equal(got[i].Labels, want[i].Labels) || got[i].Value != want[i].Value || got[i].TimestampMs != want[i].TimestampMs {
+			t.Errorf("series %d: expected %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestNewRemoteWriter_Invalid(t *testing.T) {
+	for name, cfg := range map[string]remoteWriteConfig{
+		"job":        {URL: "http://mimir/api/v1/push", QueueSize: 10},
+		"queue size": {URL: "http://mimir/api/v1/push", Job: "speedtest"},
+		"tls":        {URL: "http://mimir/api/v1/push", Job: "speedtest", QueueSize: 10, TLS: tlsFiles{KeyFile: "client.key"}},
+	} {
+		if _, err := newRemoteWriter(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
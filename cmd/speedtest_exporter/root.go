@@ -0,0 +1,343 @@
+package main
+
+import (
+	"cmp"
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
+
+// dashboardFiles holds the root page template and its static assets.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// staticFiles are the dashboard assets served under /static/.
+var staticFiles = mustSub(dashboardFiles, "dashboard/static")
+
+func mustSub(fsys fs.FS, dir string) fs.FS {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+var rootTemplate = template.Must(template.New("index.html").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+	"duration": func(start, end time.Time) string {
+		return end.Sub(start).Round(time.Second).String()
+	},
+	"ms":   formatMS,
+	"mbps": formatMbps,
+	"join": strings.Join,
+}).ParseFS(dashboardFiles, "dashboard/index.html"))
+
+// formatMS shows seconds as milliseconds, or a dash for no value.
+func formatMS(v *float64) string {
+	if v == nil {
+		return "–"
+	}
+	return strconv.FormatFloat(*v*1000, 'f', 1, 64)
+}
+
+// formatMbps shows bytes per second as Mbit/s, or a dash for no value.
+func formatMbps(v *float64) string {
+	if v == nil {
+		return "–"
+	}
+	return strconv.FormatFloat(*v*8/1e6, 'f', 1, 64)
+}
+
+// sparklineRuns is how many of a module's latest runs its sparklines show.
+const sparklineRuns = 30
+
+// historyRow is one line of a runs table: a server tested in a run, or a run
+// without any server results.
+type historyRow struct {
+	Start    time.Time
+	Module   string
+	Link     string
+	IPFamily exporter.IPFamily
+	Server   string
+	ServerID string
+	Latency  *float64
+	Download *float64
+	Upload   *float64
+	Status   string
+	Errors   []string
+}
+
+// resultStatus sums up a run in one word.
+func resultStatus(res exporter.Result) string {
+	switch {
+	case res.Skipped:
+		return "skipped"
+	case res.Success:
+		return "ok"
+	}
+	return "failed"
+}
+
+// resultRows returns the table rows of one run.
+func resultRows(res exporter.Result) []historyRow {
+	if len(res.Servers) == 0 {
+		return []historyRow{{Start: res.Start, Module: res.Module, Status: resultStatus(res), Errors: res.Errors}}
+	}
+	rows := make([]historyRow, 0, len(res.Servers))
+	for i, s := range res.Servers {
+		row := historyRow{
+			Start:    res.Start,
+			Module:   res.Module,
+			Link:     s.Link,
+			IPFamily: s.IPFamily,
+			Server:   s.Server.Name,
+			ServerID: s.Server.ID,
+			Latency:  s.LatencySeconds,
+			Download: s.DownloadBytesPerSecond,
+			Upload:   s.UploadBytesPerSecond,
+			Errors:   s.Errors,
+		}
+		// Run errors are shown once, on the run's first row.
+		if i == 0 && len(res.Errors) > 0 {
+			row.Errors = append(slices.Clone(res.Errors), row.Errors...)
+		}
+		row.Status = "ok"
+		if len(row.Errors) > 0 {
+			row.Status = "failed"
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// recentResults returns the in-memory results of all modules, newest run
+// first.
+func recentResults(exporters map[string]*exporter.Exporter) []exporter.Result {
+	var results []exporter.Result
+	for _, e := range exporters {
+		results = append(results, e.RecentResults()...)
+	}
+	slices.SortStableFunc(results, func(a, b exporter.Result) int {
+		return cmp.Or(b.Start.Compare(a.Start), cmp.Compare(a.Module, b.Module))
+	})
+	return results
+}
+
+// historyRows flattens the results of all modules into table rows, newest
+// run first.
+func historyRows(exporters map[string]*exporter.Exporter) []historyRow {
+	var rows []historyRow
+	for _, res := range recentResults(exporters) {
+		rows = append(rows, resultRows(res)...)
+	}
+	return rows
+}
+
+// lastRun is the newest run of any module.
+type lastRun struct {
+	Result exporter.Result
+	Status string
+	Rows   []historyRow
+}
+
+// moduleView describes a module on the dashboard.
+type moduleView struct {
+	Name       string
+	Servers    string
+	Phases     string
+	Links      []string
+	IPFamily   exporter.IPFamily
+	Running    bool
+	Since      time.Time
+	LastRun    time.Time
+	LastStatus string
+	Trends     []trend
+}
+
+// trend is a sparkline of one measurement over a module's latest runs.
+type trend struct {
+	Label  string
+	Width  int
+	Height int
+	Points string
+	Last   string
+}
+
+const (
+	sparklineWidth  = 120
+	sparklineHeight = 24
+)
+
+// newTrend draws values, oldest first, as a sparkline. Runs without a value
+// are skipped but keep their place on the x axis. last formats the newest
+// value.
+func newTrend(label string, values []*float64, last func(*float64) string) trend {
+	t := trend{Label: label, Width: sparklineWidth, Height: sparklineHeight, Last: "–"}
+	lo, hi, n := 0.0, 0.0, 0
+	for _, v := range values {
+		if v == nil {
+			continue
+		}
+		if n == 0 || *v < lo {
+			lo = *v
+		}
+		if n == 0 || *v > hi {
+			hi = *v
+		}
+		n++
+	}
+	if n == 0 {
+		return t
+	}
+	var points []string
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		x := 0.0
+		if len(values) > 1 {
+			x = float64(i) * sparklineWidth / float64(len(values)-1)
+		}
+		y := sparklineHeight / 2.0
+		if hi > lo {
+			// Leave a pixel at the top and bottom for the stroke.
+			y = 1 + (hi-*v)/(hi-lo)*(sparklineHeight-2)
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	// A single value is drawn as a short flat line.
+	if len(points) == 1 {
+		y := sparklineHeight / 2.0
+		points = []string{fmt.Sprintf("0.0,%.1f", y), fmt.Sprintf("%.1f,%.1f", float64(sparklineWidth), y)}
+	}
+	t.Points = strings.Join(points, " ")
+	if v := values[len(values)-1]; v != nil {
+		t.Last = last(v)
+	}
+	return t
+}
+
+// bestOf returns the best value of the servers in a run: the highest for
+// speeds, the lowest for latency.
+func bestOf(res exporter.Result, value func(exporter.ServerResult) *float64, better func(a, b float64) bool) *float64 {
+	var best *float64
+	for _, s := range res.Servers {
+		if v := value(s); v != nil && (best == nil || better(*v, *best)) {
+			best = v
+		}
+	}
+	return best
+}
+
+// moduleTrends draws the best latency, download and upload of the latest
+// runs, oldest first.
+func moduleTrends(results []exporter.Result) []trend {
+	if len(results) > sparklineRuns {
+		results = results[len(results)-sparklineRuns:]
+	}
+	higher := func(a, b float64) bool { return a > b }
+	lower := func(a, b float64) bool { return a < b }
+	var latency, download, upload []*float64
+	for _, res := range results {
+		latency = append(latency, bestOf(res, func(s exporter.ServerResult) *float64 { return s.LatencySeconds }, lower))
+		download = append(download, bestOf(res, func(s exporter.ServerResult) *float64 { return s.DownloadBytesPerSecond }, higher))
+		upload = append(upload, bestOf(res, func(s exporter.ServerResult) *float64 { return s.UploadBytesPerSecond }, higher))
+	}
+	return []trend{
+		newTrend("Latency (ms)", latency, formatMS),
+		newTrend("Download (Mbit/s)", download, formatMbps),
+		newTrend("Upload (Mbit/s)", upload, formatMbps),
+	}
+}
+
+// describeServers lists the requested server IDs, -1 being the closest one.
+func describeServers(cfg exporter.Config) string {
+	ids := make([]string, len(cfg.ServerIDs))
+	for i, id := range cfg.ServerIDs {
+		ids[i] = strconv.Itoa(id)
+		if id == -1 {
+			ids[i] = "closest"
+		}
+	}
+	s := strings.Join(ids, ", ")
+	if cfg.FallbackPolicy != "" && cfg.FallbackPolicy != exporter.FallbackFail {
+		s += fmt.Sprintf(" (fallback: %s)", cfg.FallbackPolicy)
+	}
+	return s
+}
+
+// moduleViews describes every module, sorted by name.
+func moduleViews(exporters map[string]*exporter.Exporter) []moduleView {
+	var views []moduleView
+	for name, e := range exporters {
+		cfg := e.Config()
+		phases := make([]string, 0, len(e.Phases()))
+		for _, p := range e.Phases() {
+			phases = append(phases, string(p))
+		}
+		v := moduleView{
+			Name:     name,
+			Servers:  describeServers(cfg),
+			Phases:   strings.Join(phases, ", "),
+			IPFamily: cfg.IPFamily,
+		}
+		for _, link := range cfg.Links {
+			v.Links = append(v.Links, link.Name)
+		}
+		v.Since, v.Running = e.Running()
+		results := e.RecentResults()
+		if len(results) > 0 {
+			last := results[len(results)-1]
+			v.LastRun, v.LastStatus = last.Start, resultStatus(last)
+		}
+		v.Trends = moduleTrends(results)
+		views = append(views, v)
+	}
+	slices.SortFunc(views, func(a, b moduleView) int { return cmp.Compare(a.Name, b.Name) })
+	return views
+}
+
+// describeSchedule explains what starts runs.
+func describeSchedule(interval time.Duration) string {
+	if interval <= 0 {
+		return "No schedule is configured: runs are started by scrapes of the metrics page and the Run now buttons."
+	}
+	return fmt.Sprintf("Every module runs every %s. Scrapes of the metrics page and the Run now buttons start further runs.", interval)
+}
+
+// rootHandler serves the dashboard: the last run, the modules with their
+// recent trends and state, and the recent runs of every module. schedule is
+// the interval of scheduled runs, or 0 if there are none.
+func rootHandler(exporters map[string]*exporter.Exporter, schedule time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		data := struct {
+			MetricsPath string
+			Schedule    string
+			Last        *lastRun
+			Modules     []moduleView
+			Rows        []historyRow
+		}{
+			MetricsPath: metricsPath,
+			Schedule:    describeSchedule(schedule),
+			Modules:     moduleViews(exporters),
+			Rows:        historyRows(exporters),
+		}
+		if results := recentResults(exporters); len(results) > 0 {
+			data.Last = &lastRun{Result: results[0], Status: resultStatus(results[0]), Rows: resultRows(results[0])}
+		}
+		if err := rootTemplate.Execute(w, data); err != nil {
+			slog.Error("could not render root page", "error", err)
+		}
+	}
+}
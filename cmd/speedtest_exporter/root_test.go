@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
+
+func TestRootHandler(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+
+	rootHandler(map[string]*exporter.Exporter{defaultModule: exporter.New(exporter.Config{})}, 0).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+
+	body := w.Body.String()
+	if !containsString(body, "Speedtest Exporter") {
+		t.Error("response body missing title")
+	}
+	if !containsString(body, metricsPath) {
+		t.Error("response body missing metrics link")
+	}
+	if !containsString(body, "/health") {
+		t.Error("response body missing health link")
+	}
+	if !containsString(body, "No runs yet") {
+		t.Error("response body missing empty history note")
+	}
+}
+
+func TestRootHandler_History(t *testing.T) {
+	e := newFakeExporter(defaultModule, fakeRunner{})
+	runOnce(e)
+	failing := exporter.NewWithDeps(exporter.Config{Name: "lte", ServerIDs: []int{-1}}, fakeClient{userErr: errors.New("no route to host")}, fakeRunner{})
+	runOnce(failing)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	rootHandler(map[string]*exporter.Exporter{defaultModule: e, "lte": failing}, 0).ServeHTTP(w, req)
+
+	body := w.Body.String()
+	for _, want := range []string{
+		"<td>Test (100)</td><td>10.0</td><td>0.0</td><td>0.0</td><td>ok</td>",
+		"<td>lte</td>",
+		"failed: could not fetch user information: no route to host",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response body missing %q:\n%s", want, body)
+		}
+	}
+	// The newest run comes first.
+	if strings.Index(body, "<td>lte</td>") > strings.Index(body, "<td>default</td>") {
+		t.Error("expected the newest run first")
+	}
+}
+
+func TestHistoryRows(t *testing.T) {
+	e := exporter.NewWithDeps(exporter.Config{ServerIDs: []int{-1}, Links: []exporter.Link{{Name: "fiber"}}, IPFamily: exporter.IPv6}, fakeClient{}, fakeRunner{transferErr: errors.New("timeout")})
+	runOnce(e)
+
+	rows := historyRows(map[string]*exporter.Exporter{"multi": e})
+	if len(rows) != 1 {
+		t.Fatalf("expected 1 row, got %+v", rows)
+	}
+	row := rows[0]
+	if row.Link != "fiber" || row.IPFamily != exporter.IPv6 || row.Status != "failed" || row.Latency == nil || row.Download != nil {
+		t.Errorf("unexpected row %+v", row)
+	}
+	if len(row.Errors) != 2 || row.Errors[0] != "download: timeout" {
+		t.Errorf("unexpected errors %q", row.Errors)
+	}
+	if time.Since(row.Start) > time.Minute {
+		t.Errorf("unexpected start %v", row.Start)
+	}
+}
+
+func TestRootHandler_Dashboard(t *testing.T) {
+	cfg := exporter.Config{Name: defaultModule, ServerIDs: []int{-1, 100}, FallbackPolicy: exporter.FallbackSkipMissing}
+	e := exporter.NewWithDeps(cfg, fakeClient{}, fakeRunner{})
+	runOnce(e)
+	runOnce(e)
+	idle := exporter.New(exporter.Config{Name: "lte", ServerIDs: []int{-1}, Phases: []exporter.Phase{exporter.PhasePing}})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	rootHandler(map[string]*exporter.Exporter{defaultModule: e, "lte": idle}, 0).ServeHTTP(w, req)
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`<h2>Last run</h2>`,
+		`<span class="status ok">ok</span> default at`,
+		`<dd>closest, 100 (fallback: skip_missing)</dd>`,
+		`<dd>ping</dd>`,
+		`<dt>State</dt><dd>idle</dd>`,
+		`<dt>Last run</dt><dd>never</dd>`,
+		`<polyline points="0.0,12.0 120.0,12.0"/>`,
+		`<td class="value">10.0</td>`,
+		`data-url="/api/v1/run?module=lte"`,
+		`No schedule is configured`,
+		`<script src="/static/dashboard.js" defer></script>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("response body missing %q:\n%s", want, body)
+		}
+	}
+	// Modules are listed by name.
+	if strings.Index(body, "<h3>default</h3>") > strings.Index(body, "<h3>lte</h3>") {
+		t.Error("expected modules sorted by name")
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	for _, name := range []string{"dashboard.css", "dashboard.js"} {
+		if _, err := fs.Stat(staticFiles, name); err != nil {
+			t.Errorf("%s not embedded: %v", name, err)
+		}
+	}
+}
+
+func TestNewTrend(t *testing.T) {
+	v := func(f float64) *float64 { return &f }
+	format := func(v *float64) string { return strconv.FormatFloat(*v, 'f', 0, 64) }
+
+	tr := newTrend("x", []*float64{v(10), nil, v(30), v(20)}, format)
+	if want := "0.0,23.0 80.0,1.0 120.0,12.0"; tr.Points != want {
+		t.Errorf("expected points %q, got %q", want, tr.Points)
+	}
+	if tr.Last != "20" {
+		t.Errorf("expected the last value 20, got %q", tr.Last)
+	}
+
+	tr = newTrend("x", []*float64{v(10), nil}, format)
+	if tr.Points != "0.0,12.0 120.0,12.0" || tr.Last != "–" {
+		t.Errorf("unexpected trend %+v", tr)
+	}
+
+	if tr := newTrend("x", []*float64{nil, nil}, format); tr.Points != "" {
+		t.Errorf("expected no points, got %q", tr.Points)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
+
+// scheduler queues a run of every module at a fixed interval, starting
+// right away.
+type scheduler struct {
+	q         *jobQueue
+	exporters map[string]*exporter.Exporter
+	interval  time.Duration
+	// afterRun, if set, is called with every scheduled job that was not
+	// cancelled, once it finished.
+	afterRun func(ctx context.Context, module string, j *job)
+}
+
+// run schedules runs until ctx is cancelled. A round that takes longer than
+// the interval delays the next one rather than piling up runs.
+func (s *scheduler) run(ctx context.Context) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		s.round(ctx)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// round queues a run of every module, by name, and waits for them.
+func (s *scheduler) round(ctx context.Context) {
+	names := make([]string, 0, len(s.exporters))
+	for name := range s.exporters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var jobs []*job
+	for _, name := range names {
+		e := s.exporters[name]
+		j, err := s.q.submit(ctx, e, name, e.Phases(), triggerSchedule, false)
+		if err != nil {
+			slog.Warn("could not queue scheduled run", "module", name, "error", err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	for _, j := range jobs {
+		select {
+		case <-j.done:
+		case <-ctx.Done():
+			return
+		}
+		if info := j.snapshot(); info.Status != jobCancelled && s.afterRun != nil {
+			s.afterRun(ctx, info.Module, j)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
+
+func TestScheduler_Run(t *testing.T) {
+	q := startQueue(t)
+	exporters := map[string]*exporter.Exporter{
+		defaultModule: newFakeExporter(defaultModule, fakeRunner{}),
+		"lte":         newFakeExporter("lte", fakeRunner{}),
+	}
+
+	var mu sync.Mutex
+	var runs []string
+	enough := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scheduler{q: q, exporters: exporters, interval: 10 * time.Millisecond}
+	s.afterRun = func(_ context.Context, module string, j *job) {
+		info := j.snapshot()
+		mu.Lock()
+		defer mu.Unlock()
+		runs = append(runs, module+":"+info.Trigger+":"+string(info.Status))
+		if len(runs) == 4 {
+			close(enough)
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.run(ctx)
+	}()
+
+	select {
+	case <-enough:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected two rounds of scheduled runs")
+	}
+	cancel()
+	<-stopped
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := "default:schedule:succeeded,lte:schedule:succeeded,default:schedule:succeeded,lte:schedule:succeeded"
+	if got := strings.Join(runs[:4], ","); got != want {
+		t.Errorf("expected runs %s, got %s", want, got)
+	}
+}
+
+func TestScheduler_SkipsCancelledRuns(t *testing.T) {
+	q := startQueue(t)
+	runner := newBlockingRunner()
+	e := newFakeExporter(defaultModule, runner)
+
+	called := false
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scheduler{q: q, exporters: map[string]*exporter.Exporter{defaultModule: e}, interval: time.Hour}
+	s.afterRun = func(context.Context, string, *job) { called = true }
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.round(ctx)
+	}()
+
+	<-runner.started
+	cancel()
+	<-stopped
+	if called {
+		t.Error("expected no call for a cancelled run")
+	}
+}
+
+func TestDescribeSchedule(t *testing.T) {
+	if got := describeSchedule(0); !strings.HasPrefix(got, "No schedule is configured") {
+		t.Errorf("unexpected description %q", got)
+	}
+	if got := describeSchedule(15 * time.Minute); !strings.HasPrefix(got, "Every module runs every 15m0s.") {
+		t.Errorf("unexpected description %q", got)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
+
+const (
+	// streamBuffer is how many events a stream client may lag behind before
+	// further events are dropped for it.
+	streamBuffer = 64
+	// streamKeepalive is how often an idle stream sends a comment, so
+	// proxies do not close it.
+	streamKeepalive = 15 * time.Second
+)
+
+// Types of stream events.
+const (
+	eventJob        = "job"
+	eventPhaseStart = "phase_start"
+	eventPhaseEnd   = "phase_end"
+	eventPing       = "ping"
+	eventThroughput = "throughput"
+)
+
+// streamEvent is an event sent to /api/v1/stream clients. Type is the SSE
+// event name; the other fields that apply to it are the event data.
+type streamEvent struct {
+	Type     string               `json:"-"`
+	Job      string               `json:"job"`
+	Module   string               `json:"module"`
+	Time     time.Time            `json:"time"`
+	Status   jobStatus            `json:"status,omitempty"`
+	Link     string               `json:"link,omitempty"`
+	IPFamily exporter.IPFamily    `json:"ip_family,omitempty"`
+	Server   *exporter.ServerInfo `json:"server,omitempty"`
+	Phase    exporter.Phase       `json:"phase,omitempty"`
+	// Value is a latency in seconds for ping phases and a speed in bytes
+	// per second for download and upload phases.
+	Value           *float64 `json:"value,omitempty"`
+	DurationSeconds *float64 `json:"duration_seconds,omitempty"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// phaseEvent turns a progress event of a job's run into a stream event.
+func phaseEvent(typ string, info jobInfo, ev exporter.PhaseEvent) streamEvent {
+	server := ev.Server
+	s := streamEvent{
+		Type:     typ,
+		Job:      info.ID,
+		Module:   info.Module,
+		Time:     time.Now(),
+		Link:     ev.Link,
+		IPFamily: ev.IPFamily,
+		Server:   &server,
+		Phase:    ev.Phase,
+	}
+	if typ == eventPhaseEnd {
+		d := ev.Duration.Seconds()
+		s.DurationSeconds = &d
+		if ev.Err != nil {
+			s.Error = ev.Err.Error()
+			return s
+		}
+	}
+	if typ != eventPhaseStart {
+		v := ev.Value
+		s.Value = &v
+	}
+	return s
+}
+
+// streamHub fans job events out to the stream clients. Clients that do not
+// keep up miss events rather than holding up the run.
+type streamHub struct {
+	mu     sync.Mutex
+	subs   map[chan streamEvent]string
+	closed bool
+}
+
+func newStreamHub() *streamHub {
+	return &streamHub{subs: make(map[chan streamEvent]string)}
+}
+
+// subscribe returns a channel with the events of module, or of all modules
+// if it is empty, and the function that ends the subscription. The channel
+// is closed when the hub is.
+func (h *streamHub) subscribe(module string) (<-chan streamEvent, func()) {
+	ch := make(chan streamEvent, streamBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subs[ch] = module
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// publish sends ev to the clients that follow its module.
+func (h *streamHub) publish(ev streamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, module := range h.subs {
+		if module != "" && module != ev.Module {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// close ends all subscriptions, which ends the streams.
+func (h *streamHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// streamHandler streams the status changes of jobs and the progress of
+// their runs as Server-Sent Events. The module query parameter limits the
+// stream to one module.
+func streamHandler(exporters map[string]*exporter.Exporter, q *jobQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		module := r.URL.Query().Get("module")
+		if _, ok := exporters[module]; module != "" && !ok {
+			http.Error(w, fmt.Sprintf("Unknown module %q", module), http.StatusBadRequest)
+			return
+		}
+		events, cancel := q.events.subscribe(module)
+		defer cancel()
+
+		// The stream outlives the server's write timeout.
+		rc := http.NewResponseController(w)
+		_ = rc.SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			slog.Error("could not start event stream", "error", err)
+			return
+		}
+
+		keepalive := time.NewTicker(streamKeepalive)
+		defer keepalive.Stop()
+		for {
+			select {
+			case ev, ok := <-events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(ev)
+				if err != nil {
+					slog.Error("could not encode stream event", "error", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data); err != nil {
+					return
+				}
+			case <-keepalive.C:
+				if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
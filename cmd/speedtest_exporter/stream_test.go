@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/exporter"
+)
+
+// readEvents reads SSE events from body until it has n of them.
+func readEvents(t *testing.T, body *bufio.Scanner, n int) []streamEvent {
+	t.Helper()
+	var events []streamEvent
+	var typ string
+	for len(events) < n && body.Scan() {
+		line := body.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			typ = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			var ev streamEvent
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+				t.Fatalf("invalid event data %q: %v", line, err)
+			}
+			ev.Type = typ
+			events = append(events, ev)
+		}
+	}
+	if len(events) < n {
+		t.Fatalf("expected %d events, got %d: %v", n, len(events), body.Err())
+	}
+	return events
+}
+
+func TestStreamHandler(t *testing.T) {
+	q := startQueue(t)
+	e := newFakeExporter(defaultModule, fakeRunner{})
+	other := newFakeExporter("lte", fakeRunner{})
+	exporters := map[string]*exporter.Exporter{defaultModule: e, "lte": other}
+	srv := httptest.NewServer(streamHandler(exporters, q))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?module="+defaultModule, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	// The job of the other module is left out of the stream.
+	if _, err := q.submit(context.Background(), other, "lte", exporter.AllPhases, triggerAPI, false); err != nil {
+		t.Fatal(err)
+	}
+	j, err := q.submit(context.Background(), e, defaultModule, []exporter.Phase{exporter.PhasePing, exporter.PhaseDownload}, triggerAPI, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := waitJob(t, j)
+
+	events := readEvents(t, bufio.NewScanner(resp.Body), 7)
+	var types []string
+	for _, ev := range events {
+		types = append(types, ev.Type)
+		if ev.Job != info.ID || ev.Module != defaultModule {
+			t.Errorf("unexpected event %+v", ev)
+		}
+	}
+	want := "job,job,phase_start,phase_end,phase_start,phase_end,job"
+	if got := strings.Join(types, ","); got != want {
+		t.Errorf("expected events %s, got %s", want, got)
+	}
+	if events[0].Status != jobQueued || events[1].Status != jobRunning || events[6].Status != jobSucceeded {
+		t.Errorf("unexpected job events %+v, %+v, %+v", events[0], events[1], events[6])
+	}
+	if ev := events[3]; ev.Phase != exporter.PhasePing || ev.Value == nil || *ev.Value != 0.01 || ev.DurationSeconds == nil || ev.Server.ID != "100" {
+		t.Errorf("unexpected phase end %+v", ev)
+	}
+	if ev := events[2]; ev.Value != nil || ev.DurationSeconds != nil {
+		t.Errorf("expected a phase start without a value, got %+v", ev)
+	}
+}
+
+func TestStreamHandler_UnknownModule(t *testing.T) {
+	q := newJobQueue()
+	rec := httptest.NewRecorder()
+	streamHandler(map[string]*exporter.Exporter{}, q).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stream?module=lte", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestStreamHandler_EndsOnClose(t *testing.T) {
+	q := newJobQueue()
+	q.close(context.Canceled)
+
+	rec := httptest.NewRecorder()
+	streamHandler(map[string]*exporter.Exporter{}, q).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/stream", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("expected an empty stream, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStreamHub_DropsForSlowClients(t *testing.T) {
+	h := newStreamHub()
+	events, cancel := h.subscribe("")
+	defer cancel()
+
+	for range streamBuffer + 10 {
+		h.publish(streamEvent{Type: eventJob, Module: defaultModule})
+	}
+	if len(events) != streamBuffer {
+		t.Errorf("expected %d buffered events, got %d", streamBuffer, len(events))
+	}
+}
@@ -0,0 +1,20 @@
+package exporter
+
+import "syscall"
+
+const bindToDeviceSupported = true
+
+// bindToDevice returns a dialer control function that binds sockets to iface
+// with SO_BINDTODEVICE, so traffic leaves through it regardless of routing.
+func bindToDevice(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, c syscall.RawConn) error {
+		var bindErr error
+		err := c.Control(func(fd uintptr) {
+			bindErr = syscall.BindToDevice(int(fd), iface)
+		})
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}
+}
@@ -0,0 +1,29 @@
+package exporter
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+)
+
+func TestNewHTTPClient_Interface(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	meters := newTrafficMeters(net.DefaultResolver, IPFamilyAny)
+	resp, err := newHTTPClient(Config{}, Link{Interface: "lo"}, IPFamilyAny, meters).Get(srv.URL)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("SO_BINDTODEVICE not permitted")
+	}
+	if err != nil {
+		t.Fatalf("unexpected error binding to lo: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if _, err := newHTTPClient(Config{}, Link{Interface: "does-not-exist0"}, IPFamilyAny, newTrafficMeters(net.DefaultResolver, IPFamilyAny)).Get(srv.URL); err == nil {
+		t.Error("expected error binding to a missing interface")
+	}
+}
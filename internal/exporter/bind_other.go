@@ -0,0 +1,18 @@
+//go:build !linux
+
+package exporter
+
+import (
+	"errors"
+	"syscall"
+)
+
+const bindToDeviceSupported = false
+
+// bindToDevice is only supported on Linux; ValidateLinks rejects interface
+// settings elsewhere.
+func bindToDevice(string) func(network, address string, c syscall.RawConn) error {
+	return func(_, _ string, _ syscall.RawConn) error {
+		return errors.New("binding to an interface is not supported on this platform")
+	}
+}
@@ -0,0 +1,231 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BudgetAction decides what a run does once a data budget is exhausted.
+type BudgetAction string
+
+const (
+	// BudgetLatencyOnly keeps running the ping phase only.
+	BudgetLatencyOnly BudgetAction = "latency_only"
+	// BudgetSkip skips the run entirely.
+	BudgetSkip BudgetAction = "skip"
+)
+
+// BudgetConfig limits how much data a module may transfer. Zero limits are
+// not enforced.
+type BudgetConfig struct {
+	DailyBytes   int64        `yaml:"daily_bytes"`
+	MonthlyBytes int64        `yaml:"monthly_bytes"`
+	OnExhausted  BudgetAction `yaml:"on_exhausted"`
+}
+
+// Enabled reports whether any limit is set.
+func (b BudgetConfig) Enabled() bool {
+	return b.DailyBytes > 0 || b.MonthlyBytes > 0
+}
+
+// Validate checks the limits and the exhausted action.
+func (b BudgetConfig) Validate() error {
+	if b.DailyBytes < 0 || b.MonthlyBytes < 0 {
+		return fmt.Errorf("budget limits must not be negative")
+	}
+	switch b.OnExhausted {
+	case "", BudgetLatencyOnly, BudgetSkip:
+		return nil
+	}
+	return fmt.Errorf("unknown budget action %q", b.OnExhausted)
+}
+
+// budgetCheckInterval is how often the traffic of a run is compared to the
+// budget that was left when it started.
+const budgetCheckInterval = 100 * time.Millisecond
+
+// errBudgetExhausted stops a run whose traffic used up the data budget.
+var errBudgetExhausted = errors.New("data budget exhausted")
+
+// budgetUsage is the data used over one link in the current day and month.
+type budgetUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// rollover resets the counters when the day or month has changed.
+func (u *budgetUsage) rollover(now time.Time) {
+	if day := now.Format(time.DateOnly); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+// BudgetLedger tracks the bytes transferred over each link of each module
+// across runs. Days and months follow the local time zone. With a path, usage
+// is persisted so it survives restarts.
+type BudgetLedger struct {
+	path string
+	now  func() time.Time
+
+	mu    sync.Mutex
+	usage map[string]*budgetUsage
+}
+
+// OpenBudgetLedger loads the ledger stored at path. An empty path keeps the
+// ledger in memory only; a missing or empty file starts an empty ledger.
+func OpenBudgetLedger(path string) (*BudgetLedger, error) {
+	l := newBudgetLedger()
+	l.path = path
+	if path == "" {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(path) // #nosec G304 -- path is an operator-supplied flag.
+	if errors.Is(err, os.ErrNotExist) || err == nil && len(data) == 0 {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.usage); err != nil {
+		return nil, fmt.Errorf("parsing budget file %s: %w", path, err)
+	}
+	// A file holding null leaves no map to record usage in.
+	if l.usage == nil {
+		l.usage = make(map[string]*budgetUsage)
+	}
+	return l, nil
+}
+
+// newBudgetLedger returns an empty ledger kept in memory only.
+func newBudgetLedger() *BudgetLedger {
+	return &BudgetLedger{
+		now:   time.Now,
+		usage: make(map[string]*budgetUsage),
+	}
+}
+
+// budgetKey is the ledger entry of a module's link. The unnamed link of a
+// module without links uses the module's name.
+func budgetKey(module, link string) string {
+	if link == "" {
+		return module
+	}
+	return module + "/" + link
+}
+
+// Used returns the bytes module has transferred over link today and this
+// month.
+func (l *BudgetLedger) Used(module, link string) (day, month int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.get(budgetKey(module, link))
+	return u.DayBytes, u.MonthBytes
+}
+
+// Add records n bytes transferred by module over link and persists the
+// ledger.
+func (l *BudgetLedger) Add(module, link string, n int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	u := l.get(budgetKey(module, link))
+	u.DayBytes += n
+	u.MonthBytes += n
+	return l.save()
+}
+
+// get returns the usage under key for the current period. Callers hold l.mu.
+func (l *BudgetLedger) get(key string) *budgetUsage {
+	u, ok := l.usage[key]
+	if !ok {
+		u = &budgetUsage{}
+		l.usage[key] = u
+	}
+	u.rollover(l.now())
+	return u
+}
+
+// save writes the ledger atomically. Callers hold l.mu.
+func (l *BudgetLedger) save() error {
+	if l.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(l.usage)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.path)
+}
+
+// budgetRemaining returns the bytes left in the daily and monthly budget. A
+// limit that is not set reports -1.
+func budgetRemaining(cfg BudgetConfig, usedDay, usedMonth int64) (day, month int64) {
+	day, month = -1, -1
+	if cfg.DailyBytes > 0 {
+		day = max(cfg.DailyBytes-usedDay, 0)
+	}
+	if cfg.MonthlyBytes > 0 {
+		month = max(cfg.MonthlyBytes-usedMonth, 0)
+	}
+	return day, month
+}
+
+// budgetLeft returns the bytes left in the tighter of the daily and monthly
+// budget, or -1 when neither is set.
+func budgetLeft(cfg BudgetConfig, usedDay, usedMonth int64) int64 {
+	day, month := budgetRemaining(cfg, usedDay, usedMonth)
+	switch {
+	case day < 0:
+		return month
+	case month < 0:
+		return day
+	}
+	return min(day, month)
+}
+
+// limitTraffic returns a context that is cancelled with errBudgetExhausted
+// once counter has transferred limit bytes. Traffic is checked every
+// budgetCheckInterval, so a run may go over by what it moves in that time.
+// The returned function releases the context.
+func limitTraffic(ctx context.Context, counter byteCounter, limit int64) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		t := time.NewTicker(budgetCheckInterval)
+		defer t.Stop()
+		for {
+			if counter.BytesTransferred() >= limit {
+				cancel(errBudgetExhausted)
+				return
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ctx, func() { cancel(context.Canceled) }
+}
@@ -0,0 +1,344 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// countingMockClient is a mockClient that reports a fixed traffic volume.
+type countingMockClient struct {
+	mockClient
+	bytes int64
+}
+
+func (c *countingMockClient) BytesTransferred() int64 { return c.bytes }
+
+func TestBudgetLedger_PersistsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budget.json")
+
+	l, err := OpenBudgetLedger(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.Add("lte", "", 1000); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.Add("lte", "", 500); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	reopened, err := OpenBudgetLedger(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	day, month := reopened.Used("lte", "")
+	if day != 1500 || month != 1500 {
+		t.Errorf("expected 1500/1500 bytes used, got %d/%d", day, month)
+	}
+	if day, month := reopened.Used("other", ""); day != 0 || month != 0 {
+		t.Errorf("expected no usage for other module, got %d/%d", day, month)
+	}
+}
+
+func TestOpenBudgetLedger_EmptyFile(t *testing.T) {
+	for name, content := range map[string]string{"empty": "", "null": "null"} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "budget.json")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := OpenBudgetLedger(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := l.Add("lte", "", 100); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if day, _ := l.Used("lte", ""); day != 100 {
+				t.Errorf("expected 100 bytes used, got %d", day)
+			}
+		})
+	}
+}
+
+func TestBudgetLedger_PerLink(t *testing.T) {
+	l := newBudgetLedger()
+	_ = l.Add("home", "lte", 700)
+	_ = l.Add("home", "fiber", 50)
+
+	if day, _ := l.Used("home", "lte"); day != 700 {
+		t.Errorf("expected 700 bytes used over lte, got %d", day)
+	}
+	if day, _ := l.Used("home", "fiber"); day != 50 {
+		t.Errorf("expected 50 bytes used over fiber, got %d", day)
+	}
+	if day, _ := l.Used("home", ""); day != 0 {
+		t.Errorf("expected the links not to count for the module, got %d", day)
+	}
+}
+
+func TestBudgetLedger_Rollover(t *testing.T) {
+	l, _ := OpenBudgetLedger("")
+	now := time.Date(2026, 1, 31, 23, 0, 0, 0, time.Local)
+	l.now = func() time.Time { return now }
+
+	_ = l.Add("lte", "", 100)
+
+	now = now.Add(2 * time.Hour) // February 1st.
+	_ = l.Add("lte", "", 10)
+	if day, month := l.Used("lte", ""); day != 10 || month != 10 {
+		t.Errorf("expected 10/10 after month rollover, got %d/%d", day, month)
+	}
+
+	now = now.Add(24 * time.Hour) // February 2nd.
+	_ = l.Add("lte", "", 5)
+	if day, month := l.Used("lte", ""); day != 5 || month != 15 {
+		t.Errorf("expected 5/15 after day rollover, got %d/%d", day, month)
+	}
+}
+
+func TestBudgetRemaining(t *testing.T) {
+	day, month := budgetRemaining(BudgetConfig{DailyBytes: 100}, 40, 1000)
+	if day != 60 || month != -1 {
+		t.Errorf("expected 60/-1, got %d/%d", day, month)
+	}
+	day, month = budgetRemaining(BudgetConfig{DailyBytes: 100, MonthlyBytes: 500}, 150, 600)
+	if day != 0 || month != 0 {
+		t.Errorf("expected 0/0 once exceeded, got %d/%d", day, month)
+	}
+}
+
+func TestBudgetLeft(t *testing.T) {
+	if got := budgetLeft(BudgetConfig{}, 10, 10); got != -1 {
+		t.Errorf("expected -1 without limits, got %d", got)
+	}
+	if got := budgetLeft(BudgetConfig{DailyBytes: 100, MonthlyBytes: 500}, 40, 460); got != 40 {
+		t.Errorf("expected the tighter monthly budget of 40, got %d", got)
+	}
+	if got := budgetLeft(BudgetConfig{MonthlyBytes: 500}, 0, 100); got != 400 {
+		t.Errorf("expected 400, got %d", got)
+	}
+}
+
+// byteCount is a byteCounter whose count is set by the test.
+type byteCount struct {
+	atomic.Int64
+}
+
+func (c *byteCount) BytesTransferred() int64 { return c.Load() }
+
+func TestLimitTraffic(t *testing.T) {
+	var counter byteCount
+	ctx, stop := limitTraffic(context.Background(), &counter, 1000)
+	defer stop()
+
+	counter.Store(999)
+	time.Sleep(2 * budgetCheckInterval)
+	if ctx.Err() != nil {
+		t.Fatal("expected the context to run while budget is left")
+	}
+	counter.Store(1000)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the context to be cancelled once the budget is used up")
+	}
+	if !errors.Is(context.Cause(ctx), errBudgetExhausted) {
+		t.Errorf("expected errBudgetExhausted as the cause, got %v", context.Cause(ctx))
+	}
+}
+
+// budgetBlockingRunner transfers until its context is cancelled.
+type budgetBlockingRunner struct {
+	mockRunner
+}
+
+func (m *budgetBlockingRunner) DownloadTest(ctx context.Context, _ *speedtest.Server) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRun_BudgetStopsTransfer(t *testing.T) {
+	client := &countingMockClient{
+		mockClient: mockClient{user: newTestUser(), servers: speedtest.Servers{newTestServer("100")}},
+		bytes:      1500,
+	}
+	cfg := Config{Name: "lte", ServerIDs: []int{-1}, Budget: BudgetConfig{DailyBytes: 2000}}
+	e := NewWithDeps(cfg, client, &budgetBlockingRunner{mockRunner: *newTestRunner()})
+	_ = e.ledger.Add("lte", "", 1000)
+
+	ch := make(chan prometheus.Metric, 100)
+	done := make(chan Result)
+	go func() { done <- e.Run(context.Background(), []Phase{PhaseDownload}, ch) }()
+
+	var result Result
+	select {
+	case result = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the run to stop once the budget was used up")
+	}
+	if result.Success {
+		t.Error("expected the stopped run to fail")
+	}
+	if !slices.ContainsFunc(result.Errors, func(msg string) bool { return strings.Contains(msg, errBudgetExhausted.Error()) }) {
+		t.Errorf("expected the budget in the run errors, got %v", result.Errors)
+	}
+	if day, _ := e.ledger.Used("lte", ""); day != 2500 {
+		t.Errorf("expected the stopped run to be recorded, got %d bytes used", day)
+	}
+}
+
+func TestCollect_BudgetPerLink(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     BudgetAction
+		wantPings  int
+		wantLinkUp int
+	}{
+		{name: "latency only", action: BudgetLatencyOnly, wantPings: 2, wantLinkUp: 2},
+		{name: "skip", action: BudgetSkip, wantPings: 1, wantLinkUp: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newClient := func() SpeedtestClient {
+				return newTestClient(newTestServer("100"))
+			}
+			cfg := Config{
+				Name:      "home",
+				ServerIDs: []int{-1},
+				Links:     []Link{{Name: "fiber", Interface: "eth0"}, {Name: "lte", Interface: "wwan0"}},
+				Budget:    BudgetConfig{MonthlyBytes: 1000, OnExhausted: tt.action},
+			}
+			e := newLinkExporter(cfg,
+				map[string]SpeedtestClient{"fiber": newClient(), "lte": newClient()},
+				map[string]ServerRunner{"fiber": newTestRunner(), "lte": newTestRunner()},
+			)
+			_ = e.ledger.Add("home", "lte", 1000)
+
+			metrics := collectMetrics(e)
+
+			downloads := findAllMetricsByName(metrics, "speedtest_download_speed_bytes_per_second")
+			if len(downloads) != 1 || labelValue(downloads[0], "link") != "fiber" {
+				t.Errorf("expected a download over fiber only, got %d downloads", len(downloads))
+			}
+			if got := len(findAllMetricsByName(metrics, "speedtest_latency_seconds")); got != tt.wantPings {
+				t.Errorf("expected %d latencies, got %d", tt.wantPings, got)
+			}
+			// A link the budget skipped did not fail.
+			if got := metricToDTO(findMetricByName(metrics, "speedtest_up")).GetGauge().GetValue(); got != 1 {
+				t.Errorf("expected up=1, got %v", got)
+			}
+			linkUps := findAllMetricsByName(metrics, "speedtest_link_up")
+			if len(linkUps) != tt.wantLinkUp {
+				t.Errorf("expected link_up for %d links, got %d", tt.wantLinkUp, len(linkUps))
+			}
+			for _, m := range linkUps {
+				if got := metricToDTO(m).GetGauge().GetValue(); got != 1 {
+					t.Errorf("link %s: expected link_up=1, got %v", labelValue(m, "link"), got)
+				}
+			}
+			for _, m := range findAllMetricsByName(metrics, "speedtest_budget_exhausted") {
+				want := 0.0
+				if labelValue(m, "link") == "lte" {
+					want = 1
+				}
+				if got := metricToDTO(m).GetGauge().GetValue(); got != want {
+					t.Errorf("link %s: expected budget_exhausted=%v, got %v", labelValue(m, "link"), want, got)
+				}
+			}
+
+			res, _ := e.LatestResult()
+			wantSkipped := []string(nil)
+			if tt.action == BudgetSkip {
+				wantSkipped = []string{"lte"}
+			}
+			if !res.Success || len(res.Errors) != 0 || !slices.Equal(res.SkippedLinks, wantSkipped) {
+				t.Errorf("unexpected result %+v", res)
+			}
+		})
+	}
+}
+
+func TestBudgetConfig_Validate(t *testing.T) {
+	if err := (BudgetConfig{DailyBytes: 1, OnExhausted: BudgetSkip}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (BudgetConfig{DailyBytes: -1}).Validate(); err == nil {
+		t.Error("expected error for negative limit")
+	}
+	if err := (BudgetConfig{OnExhausted: "panic"}).Validate(); err == nil {
+		t.Error("expected error for unknown action")
+	}
+}
+
+func TestCollect_BudgetRecordsUsage(t *testing.T) {
+	client := &countingMockClient{
+		mockClient: mockClient{user: newTestUser(), servers: speedtest.Servers{newTestServer("100")}},
+		bytes:      400,
+	}
+	cfg := Config{Name: "lte", ServerIDs: []int{-1}, Budget: BudgetConfig{DailyBytes: 1000}}
+	e := NewWithDeps(cfg, client, newTestRunner())
+
+	metrics := collectMetrics(e)
+
+	remaining := findMetricByName(metrics, "speedtest_budget_remaining_bytes")
+	if remaining == nil {
+		t.Fatal("speedtest_budget_remaining_bytes metric not found")
+	}
+	if got := metricToDTO(remaining).GetGauge().GetValue(); got != 600 {
+		t.Errorf("expected 600 bytes remaining, got %f", got)
+	}
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_budget_exhausted")).GetGauge().GetValue(); got != 0 {
+		t.Errorf("expected budget_exhausted=0, got %f", got)
+	}
+}
+
+func TestCollect_BudgetExhausted(t *testing.T) {
+	tests := []struct {
+		name        string
+		action      BudgetAction
+		wantLatency bool
+		wantUp      float64
+	}{
+		{name: "latency only", action: BudgetLatencyOnly, wantLatency: true, wantUp: 1},
+		{name: "skip", action: BudgetSkip, wantLatency: false, wantUp: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &countingMockClient{
+				mockClient: mockClient{user: newTestUser(), servers: speedtest.Servers{newTestServer("100")}},
+			}
+			cfg := Config{Name: "lte", ServerIDs: []int{-1}, Budget: BudgetConfig{MonthlyBytes: 1000, OnExhausted: tt.action}}
+			e := NewWithDeps(cfg, client, newTestRunner())
+			_ = e.ledger.Add("lte", "", 1000)
+
+			metrics := collectMetrics(e)
+
+			if got := findMetricByName(metrics, "speedtest_latency_seconds") != nil; got != tt.wantLatency {
+				t.Errorf("expected latency metric present=%v, got %v", tt.wantLatency, got)
+			}
+			if findMetricByName(metrics, "speedtest_download_speed_bytes_per_second") != nil {
+				t.Error("download metric emitted although the budget is exhausted")
+			}
+			if got := metricToDTO(findMetricByName(metrics, "speedtest_up")).GetGauge().GetValue(); got != tt.wantUp {
+				t.Errorf("expected up=%f, got %f", tt.wantUp, got)
+			}
+			if got := metricToDTO(findMetricByName(metrics, "speedtest_budget_exhausted")).GetGauge().GetValue(); got != 1 {
+				t.Errorf("expected budget_exhausted=1, got %f", got)
+			}
+		})
+	}
+}
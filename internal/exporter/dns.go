@@ -0,0 +1,266 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// hostResolver looks up the addresses of a host. *net.Resolver implements it.
+type hostResolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// ValidateDNS checks that DNSServer is an IP address, an address and port,
+// or an https:// DNS-over-HTTPS URL.
+func (c Config) ValidateDNS() error {
+	if c.DNSServer == "" {
+		return nil
+	}
+	if strings.HasPrefix(c.DNSServer, "https://") {
+		if _, err := url.Parse(c.DNSServer); err != nil {
+			return fmt.Errorf("invalid dns_server URL: %w", err)
+		}
+		return nil
+	}
+	if _, err := dnsServerAddr(c.DNSServer); err != nil {
+		return fmt.Errorf("invalid dns_server: %w", err)
+	}
+	return nil
+}
+
+// dnsServerAddr returns server as an address and port, defaulting to port 53.
+func dnsServerAddr(server string) (string, error) {
+	if ap, err := netip.ParseAddrPort(server); err == nil {
+		return ap.String(), nil
+	}
+	addr, err := netip.ParseAddr(server)
+	if err != nil {
+		return "", err
+	}
+	return netip.AddrPortFrom(addr, 53).String(), nil
+}
+
+// newResolver returns the resolver for the module's DNS settings. Queries to
+// a configured DNS server leave from the link's source like the test traffic.
+func newResolver(cfg Config, link Link) hostResolver {
+	if cfg.DNSServer == "" {
+		return net.DefaultResolver
+	}
+	dialer := newDialer(link)
+	if strings.HasPrefix(cfg.DNSServer, "https://") {
+		return &dohResolver{
+			url: cfg.DNSServer,
+			client: &http.Client{
+				Transport: &http.Transport{DialContext: dialer.DialContext, ForceAttemptHTTP2: true},
+				Timeout:   10 * time.Second,
+			},
+		}
+	}
+	server, _ := dnsServerAddr(cfg.DNSServer) // validated by ValidateDNS
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// dohResolver resolves names with DNS-over-HTTPS (RFC 8484).
+type dohResolver struct {
+	url    string
+	client *http.Client
+}
+
+func (r *dohResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	switch network {
+	case "ip4":
+		types = types[:1]
+	case "ip6":
+		types = types[1:]
+	}
+
+	var addrs []netip.Addr
+	var firstErr error
+	for _, t := range types {
+		found, err := r.query(ctx, host, t)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		addrs = append(addrs, found...)
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, Server: r.url, IsNotFound: true}
+}
+
+// query sends a single question for host and returns the addresses answered.
+func (r *dohResolver) query(ctx context.Context, host string, qtype dnsmessage.Type) ([]netip.Addr, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+	// RFC 8484 recommends ID 0 so responses can be cached.
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS query for %s: unexpected status %s", host, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+
+	var reply dnsmessage.Message
+	if err := reply.Unpack(body); err != nil {
+		return nil, fmt.Errorf("DNS-over-HTTPS query for %s: %w", host, err)
+	}
+	if reply.RCode != dnsmessage.RCodeSuccess {
+		return nil, &net.DNSError{Err: reply.RCode.String(), Name: host, Server: r.url, IsNotFound: reply.RCode == dnsmessage.RCodeNameError}
+	}
+	var addrs []netip.Addr
+	for _, ans := range reply.Answers {
+		switch b := ans.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(b.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(b.AAAA))
+		}
+	}
+	return addrs, nil
+}
+
+// dnsLookups resolves host names for one session. Each host is looked up
+// once, so every connection of a run goes to the same addresses and the
+// lookup time is measured without caching effects inside the run.
+type dnsLookups struct {
+	resolver hostResolver
+	network  string
+
+	mu      sync.Mutex
+	entries map[string]*dnsLookup
+}
+
+// dnsLookup is the result of resolving one host. done is closed once the
+// other fields are set.
+type dnsLookup struct {
+	done     chan struct{}
+	addrs    []netip.Addr
+	err      error
+	duration time.Duration
+}
+
+func newDNSLookups(resolver hostResolver, family IPFamily) *dnsLookups {
+	return &dnsLookups{resolver: resolver, network: family.network("ip"), entries: make(map[string]*dnsLookup)}
+}
+
+// lookup returns the addresses of host. Failed lookups are retried by the
+// next caller.
+func (l *dnsLookups) lookup(ctx context.Context, host string) ([]netip.Addr, error) {
+	l.mu.Lock()
+	entry, ok := l.entries[host]
+	if !ok {
+		entry = &dnsLookup{done: make(chan struct{})}
+		l.entries[host] = entry
+	}
+	l.mu.Unlock()
+
+	if ok {
+		select {
+		case <-entry.done:
+			return entry.addrs, entry.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	start := time.Now()
+	entry.addrs, entry.err = l.resolver.LookupNetIP(ctx, l.network, host)
+	entry.duration = time.Since(start)
+	if entry.err == nil && len(entry.addrs) == 0 {
+		entry.err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	if entry.err != nil {
+		l.mu.Lock()
+		delete(l.entries, host)
+		l.mu.Unlock()
+	}
+	close(entry.done)
+	return entry.addrs, entry.err
+}
+
+// durations returns how long each successful lookup took.
+func (l *dnsLookups) durations() map[string]time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := make(map[string]time.Duration, len(l.entries))
+	for host, entry := range l.entries {
+		select {
+		case <-entry.done:
+			d[host] = entry.duration
+		default:
+		}
+	}
+	return d
+}
+
+// dial connects to addr, resolving its host with l and trying each address
+// in turn.
+func (l *dnsLookups) dial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err == nil {
+		return dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := l.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, ip := range addrs {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
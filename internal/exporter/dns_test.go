@@ -0,0 +1,199 @@
+package exporter
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsReply answers a packed DNS query with the addresses of the asked type.
+func dnsReply(t *testing.T, query []byte, addrs []netip.Addr) []byte {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		t.Errorf("unpacking query: %v", err)
+		return nil
+	}
+	msg.Header.Response = true
+	q := msg.Questions[0]
+	for _, a := range addrs {
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+		switch {
+		case q.Type == dnsmessage.TypeA && a.Is4():
+			hdr.Type = dnsmessage.TypeA
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AResource{A: a.As4()}})
+		case q.Type == dnsmessage.TypeAAAA && a.Is6():
+			hdr.Type = dnsmessage.TypeAAAA
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: a.As16()}})
+		}
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Errorf("packing reply: %v", err)
+	}
+	return packed
+}
+
+var testAddrs = []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+
+func TestDoHResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			t.Errorf("unexpected content type %q", r.Header.Get("Content-Type"))
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(dnsReply(t, query, testAddrs))
+	}))
+	defer srv.Close()
+
+	r := &dohResolver{url: srv.URL, client: srv.Client()}
+
+	got, err := r.LookupNetIP(context.Background(), "ip", "speedtest.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(got, testAddrs) {
+		t.Errorf("expected %v, got %v", testAddrs, got)
+	}
+
+	got, err = r.LookupNetIP(context.Background(), "ip4", "speedtest.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(got, testAddrs[:1]) {
+		t.Errorf("expected only the IPv4 address, got %v", got)
+	}
+}
+
+func TestNewResolver_DNSServer(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer func() { _ = pc.Close() }()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(dnsReply(t, buf[:n], testAddrs), addr)
+		}
+	}()
+
+	r := newResolver(Config{DNSServer: pc.LocalAddr().String()}, Link{})
+
+	got, err := r.LookupNetIP(context.Background(), "ip4", "speedtest.example")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(got, testAddrs[:1]) {
+		t.Errorf("expected %v, got %v", testAddrs[:1], got)
+	}
+}
+
+// fakeResolver resolves every host to addrs and counts its lookups.
+type fakeResolver struct {
+	addrs []netip.Addr
+	calls atomic.Int64
+}
+
+func (f *fakeResolver) LookupNetIP(context.Context, string, string) ([]netip.Addr, error) {
+	f.calls.Add(1)
+	return f.addrs, nil
+}
+
+func TestDNSLookups_ResolvesEachHostOnce(t *testing.T) {
+	res := &fakeResolver{addrs: testAddrs}
+	l := newDNSLookups(res, IPFamilyAny)
+
+	for range 3 {
+		if _, err := l.lookup(context.Background(), "speedtest.example"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if _, err := l.lookup(context.Background(), "www.speedtest.net"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := res.calls.Load(); got != 2 {
+		t.Errorf("expected 2 lookups, got %d", got)
+	}
+	if d := l.durations(); len(d) != 2 {
+		t.Errorf("expected durations for 2 hosts, got %v", d)
+	}
+}
+
+func TestNewHTTPClient_UsesResolver(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	res := &fakeResolver{addrs: []netip.Addr{netip.MustParseAddr("127.0.0.1")}}
+	meters := newTrafficMeters(res, IPFamilyAny)
+	client := newHTTPClient(Config{}, Link{}, IPFamilyAny, meters)
+
+	resp, err := client.Get("http://speedtest.example:" + port + "/")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if _, ok := meters.lookups.durations()["speedtest.example"]; !ok {
+		t.Error("expected the lookup of speedtest.example to be timed")
+	}
+}
+
+func TestConfig_ValidateDNS(t *testing.T) {
+	for _, valid := range []string{"", "1.1.1.1", "1.1.1.1:5353", "[2606:4700:4700::1111]:53", "https://cloudflare-dns.com/dns-query"} {
+		if err := (Config{DNSServer: valid}).ValidateDNS(); err != nil {
+			t.Errorf("%q: unexpected error: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"dns.example", "1.1.1.1:dns", "http://dns.example/dns-query"} {
+		if err := (Config{DNSServer: invalid}).ValidateDNS(); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+// timingMockClient is a mockClient that reports fixed DNS lookup times.
+type timingMockClient struct {
+	mockClient
+	lookups map[string]time.Duration
+}
+
+func (c *timingMockClient) LookupDurations() map[string]time.Duration { return c.lookups }
+
+func TestCollect_DNSLookupDuration(t *testing.T) {
+	client := &timingMockClient{
+		mockClient: mockClient{user: newTestUser(), servers: speedtest.Servers{newTestServer("100")}},
+		lookups:    map[string]time.Duration{"speedtest.example": 25 * time.Millisecond},
+	}
+	e := NewWithDeps(Config{ServerIDs: []int{-1}}, client, newTestRunner())
+
+	metrics := collectMetrics(e)
+
+	m := findMetricByName(metrics, "speedtest_dns_lookup_duration_seconds")
+	if m == nil {
+		t.Fatal("speedtest_dns_lookup_duration_seconds metric not found")
+	}
+	if got := labelValue(m, "host"); got != "speedtest.example" {
+		t.Errorf("expected host label speedtest.example, got %q", got)
+	}
+	if got := metricToDTO(m).GetGauge().GetValue(); got != 0.025 {
+		t.Errorf("expected 0.025, got %v", got)
+	}
+}
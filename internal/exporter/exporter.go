@@ -2,10 +2,20 @@ package exporter
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cacack/speedtest_exporter/internal/probe"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/showwin/speedtest-go/speedtest"
 )
@@ -14,6 +24,12 @@ const (
 	namespace = "speedtest"
 )
 
+// serverLabels are the labels of the per-server speedtest metrics.
+var serverLabels = []string{"user_lat", "user_lon", "user_ip", "user_isp", "server_lat", "server_lon", "server_id", "server_name", "server_country", "distance", "source", "link", "ip_family"}
+
+// tcpLabels are the labels of the TCP_INFO metrics of a bandwidth phase.
+var tcpLabels = append(slices.Clone(serverLabels), "direction")
+
 var (
 	up = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "up"),
@@ -28,23 +44,208 @@ var (
 	latency = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "latency_seconds"),
 		"Measured latency in seconds from the last speedtest",
-		[]string{"user_lat", "user_lon", "user_ip", "user_isp", "server_lat", "server_lon", "server_id", "server_name", "server_country", "distance"},
+		serverLabels,
 		nil,
 	)
 	upload = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "upload_speed_bytes_per_second"),
 		"Upload speed in bytes per second from the last speedtest",
-		[]string{"user_lat", "user_lon", "user_ip", "user_isp", "server_lat", "server_lon", "server_id", "server_name", "server_country", "distance"},
+		serverLabels,
 		nil,
 	)
 	download = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "download_speed_bytes_per_second"),
 		"Download speed in bytes per second from the last speedtest",
-		[]string{"user_lat", "user_lon", "user_ip", "user_isp", "server_lat", "server_lon", "server_id", "server_name", "server_country", "distance"},
+		serverLabels,
+		nil,
+	)
+	serverSubstituted = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "server_substituted"),
+		"Set to 1 when a requested server was unavailable and another server was tested in its place",
+		[]string{"requested_id", "actual_id", "link", "ip_family"},
+		nil,
+	)
+	budgetRemainingBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "budget_remaining_bytes"),
+		"Bytes left in the data budget of the link for the current period",
+		[]string{"period", "link"},
+		nil,
+	)
+	budgetExhausted = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "budget_exhausted"),
+		"Set to 1 when the daily or monthly data budget of the link is used up and its runs are skipped or reduced to latency only",
+		[]string{"link"}, nil,
+	)
+	concurrentMeasurement = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "concurrent_measurement"),
+		"Set to 1 when bandwidth results of several servers were measured at the same time and may have competed for the link",
+		[]string{"link", "ip_family"},
+		nil,
+	)
+	linkUp = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "link_up"),
+		"Whether the last speedtest over the link was successful",
+		[]string{"link"},
+		nil,
+	)
+	linkContractBytesPerSecond = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "link_contract_bytes_per_second"),
+		"Contracted speed of the link in bytes per second",
+		[]string{"link", "direction"},
+		nil,
+	)
+	dnsLookupDurationSeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "dns_lookup_duration_seconds"),
+		"Time taken to resolve a speedtest host name in the last speedtest",
+		[]string{"host", "link", "ip_family"},
+		nil,
+	)
+	httpPhaseSeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "http_phase_seconds"),
+		"Average duration of an HTTP connection phase in the last speedtest, by kind of request",
+		[]string{"phase", "target", "link", "ip_family"},
+		nil,
+	)
+	pathHops = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "path_hops"),
+		"Number of hops probed on the path to the server in the last path trace",
+		serverLabels,
+		nil,
+	)
+	pathReached = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "path_reached"),
+		"Whether the server answered the last path trace",
+		serverLabels,
+		nil,
+	)
+	pathHopRTTSeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "path_hop_rtt_seconds"),
+		"Round-trip time to each hop on the path to the server in the last path trace",
+		append(slices.Clone(serverLabels), "hop", "hop_addr"),
+		nil,
+	)
+	tcpRTTSeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tcp_rtt_seconds"),
+		"Smoothed TCP round-trip time averaged over the connections of the last bandwidth phase",
+		tcpLabels,
+		nil,
+	)
+	tcpRTTVarianceSeconds = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tcp_rtt_variance_seconds"),
+		"TCP round-trip time variance averaged over the connections of the last bandwidth phase",
+		tcpLabels,
+		nil,
+	)
+	tcpCongestionWindowSegments = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tcp_congestion_window_segments"),
+		"Sending congestion window averaged over the connections of the last bandwidth phase",
+		tcpLabels,
+		nil,
+	)
+	tcpDeliveryRateBytesPerSecond = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tcp_delivery_rate_bytes_per_second"),
+		"Sum of the TCP delivery rates of the connections of the last upload phase",
+		tcpLabels,
 		nil,
 	)
+	tcpRetransmittedSegments = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tcp_retransmitted_segments"),
+		"TCP segments retransmitted during the last upload phase",
+		tcpLabels,
+		nil,
+	)
+	tcpRetransmitRatio = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tcp_retransmit_ratio"),
+		"Share of the TCP segments sent during the last upload phase that were retransmissions",
+		tcpLabels,
+		nil,
+	)
+	pathMTUBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "path_mtu_bytes"),
+		"Largest packet that reached the server unfragmented in the last path MTU discovery",
+		serverLabels,
+		nil,
+	)
+	ipv6Available = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "ipv6_available"),
+		"Whether the last speedtest over IPv6 was successful",
+		[]string{"link"},
+		nil,
+	)
+	linkBest = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "link_best"),
+		"Set to 1 for the link with the highest download speed in the last run, or the lowest latency when no download was measured",
+		[]string{"link"},
+		nil,
+	)
+)
+
+// FallbackPolicy controls what happens when a requested server ID is not
+// present in the server list returned by speedtest.net.
+type FallbackPolicy string
+
+const (
+	// FallbackFail fails the whole run.
+	FallbackFail FallbackPolicy = "fail"
+	// FallbackSkipMissing tests the servers that were found and ignores the rest.
+	FallbackSkipMissing FallbackPolicy = "skip_missing"
+	// FallbackClosest tests the closest available server instead.
+	FallbackClosest FallbackPolicy = "closest"
+	// FallbackClosestInSameCountry tests the closest available server located
+	// in the same country as the requested one.
+	FallbackClosestInSameCountry FallbackPolicy = "closest_in_same_country"
 )
 
+// ParseFallbackPolicy validates s and returns the matching FallbackPolicy.
+func ParseFallbackPolicy(s string) (FallbackPolicy, error) {
+	switch p := FallbackPolicy(s); p {
+	case FallbackFail, FallbackSkipMissing, FallbackClosest, FallbackClosestInSameCountry:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown fallback policy %q", s)
+}
+
+// Phase is one step of a speedtest run.
+type Phase string
+
+const (
+	PhasePing     Phase = "ping"
+	PhaseDownload Phase = "download"
+	PhaseUpload   Phase = "upload"
+)
+
+// AllPhases lists every phase in the order they run.
+var AllPhases = []Phase{PhasePing, PhaseDownload, PhaseUpload}
+
+// ParsePhases splits a comma-separated list of phase names.
+func ParsePhases(s string) ([]Phase, error) {
+	var phases []Phase
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		phases = append(phases, Phase(p))
+	}
+	if err := ValidatePhases(phases); err != nil {
+		return nil, err
+	}
+	return phases, nil
+}
+
+// ValidatePhases checks that phases is non-empty and only holds known phases.
+func ValidatePhases(phases []Phase) error {
+	if len(phases) == 0 {
+		return fmt.Errorf("at least one phase is required")
+	}
+	for _, p := range phases {
+		if !slices.Contains(AllPhases, p) {
+			return fmt.Errorf("unknown phase %q", p)
+		}
+	}
+	return nil
+}
+
 // SpeedtestClient abstracts the speedtest-go client.
 type SpeedtestClient interface {
 	FetchUserInfo(ctx context.Context) (*speedtest.User, error)
@@ -59,23 +260,95 @@ type ServerRunner interface {
 }
 
 // defaultRunner calls the real speedtest server methods.
-type defaultRunner struct{}
+type defaultRunner struct {
+	doer     *http.Client
+	transfer TransferConfig
+	// tcp tracks the session's connections when TCPInfo is enabled.
+	tcp      *tcpConns
+	tcpStats tcpStatsRecorder
+	// proxy is the doer's proxy selection. Connections through a proxy go
+	// to the proxy, so their TCP_INFO is not read.
+	proxy     func(*http.Request) (*url.URL, error)
+	proxyWarn sync.Once
+}
 
 func (d *defaultRunner) PingTest(ctx context.Context, server *speedtest.Server) error {
-	return server.PingTestContext(ctx, nil)
+	return server.PingTestContext(ctx, func(latency time.Duration) {
+		reportSample(ctx, latency.Seconds())
+	})
 }
 
 func (d *defaultRunner) DownloadTest(ctx context.Context, server *speedtest.Server) error {
+	defer d.measureTCP(server, PhaseDownload)()
+	if d.transfer.Duration > 0 {
+		server.Context.SetCaptureTime(d.transfer.Duration)
+	}
+	if d.transfer.custom() {
+		return d.downloadTest(ctx, server)
+	}
+	server.Context.SetCallbackDownload(throughputSampler(ctx))
 	return server.DownloadTestContext(ctx)
 }
 
 func (d *defaultRunner) UploadTest(ctx context.Context, server *speedtest.Server) error {
+	defer d.measureTCP(server, PhaseUpload)()
+	if d.transfer.Duration > 0 {
+		server.Context.SetCaptureTime(d.transfer.Duration)
+	}
+	if d.transfer.custom() {
+		return d.uploadTest(ctx, server)
+	}
+	server.Context.SetCallbackUpload(throughputSampler(ctx))
 	return server.UploadTestContext(ctx)
 }
 
+// measureTCP starts reading TCP_INFO for a bandwidth phase to server and
+// returns the function that ends it.
+func (d *defaultRunner) measureTCP(server *speedtest.Server, phase Phase) func() {
+	if d.tcp == nil {
+		return func() {}
+	}
+	if d.proxied(server) {
+		d.proxyWarn.Do(func() {
+			slog.Warn("TCP_INFO is not available through a proxy, skipping TCP stats", "server", server.Host)
+		})
+		return func() {}
+	}
+	addr, err := serverAddr(server)
+	if err != nil {
+		return func() {}
+	}
+	p := d.tcp.begin(addr)
+	return func() {
+		if stats, ok := d.tcp.end(p); ok {
+			d.tcpStats.set(server, phase, stats)
+		}
+	}
+}
+
+// proxied reports whether the traffic to server goes through a proxy.
+func (d *defaultRunner) proxied(server *speedtest.Server) bool {
+	if d.proxy == nil {
+		return false
+	}
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		return false
+	}
+	u, err := d.proxy(req)
+	return err == nil && u != nil
+}
+
+// TCPStats returns the TCP_INFO summary of the last phase run on server.
+func (d *defaultRunner) TCPStats(server *speedtest.Server, phase Phase) (tcpStats, bool) {
+	return d.tcpStats.get(server, phase)
+}
+
 // defaultClient wraps speedtest.Speedtest to satisfy SpeedtestClient.
 type defaultClient struct {
-	inner *speedtest.Speedtest
+	inner  *speedtest.Speedtest
+	opts   []speedtest.Option
+	meters *trafficMeters
 }
 
 func (d *defaultClient) FetchUserInfo(ctx context.Context) (*speedtest.User, error) {
@@ -86,39 +359,244 @@ func (d *defaultClient) FetchServers(ctx context.Context) (speedtest.Servers, er
 	return d.inner.FetchServerListContext(ctx)
 }
 
+// isolate returns a copy of server bound to its own speedtest client. The
+// speedtest-go data manager is shared by every server fetched from one client,
+// so servers must not share it while their transfers run concurrently.
+func (d *defaultClient) isolate(server *speedtest.Server) *speedtest.Server {
+	s := *server
+	s.Context = speedtest.New(d.opts...)
+	return &s
+}
+
+// BytesTransferred returns the bytes sent and received by the client so far.
+func (d *defaultClient) BytesTransferred() int64 {
+	return d.meters.bytes.Load()
+}
+
+// LookupDurations returns how long resolving each host took so far.
+func (d *defaultClient) LookupDurations() map[string]time.Duration {
+	return d.meters.lookups.durations()
+}
+
+// HTTPTimings returns the average duration of each HTTP phase so far.
+func (d *defaultClient) HTTPTimings() map[httpTimingKey]time.Duration {
+	return d.meters.timings.averages()
+}
+
+// byteCounter is implemented by clients that count their network traffic.
+type byteCounter interface {
+	BytesTransferred() int64
+}
+
+// lookupTimer is implemented by clients that time their DNS lookups.
+type lookupTimer interface {
+	LookupDurations() map[string]time.Duration
+}
+
+// httpTimer is implemented by clients that time their HTTP connections.
+type httpTimer interface {
+	HTTPTimings() map[httpTimingKey]time.Duration
+}
+
+// serverIsolator is implemented by clients that can give each server its own
+// transfer state for parallel testing.
+type serverIsolator interface {
+	isolate(server *speedtest.Server) *speedtest.Server
+}
+
+// Config holds the settings of an Exporter.
+type Config struct {
+	// Name identifies the module, e.g. in the data budget ledger.
+	Name string `yaml:"-"`
+	// ServerIDs are the Speedtest.net servers to test against, -1 picks the closest one.
+	ServerIDs []int `yaml:"server_ids"`
+	// FallbackPolicy decides what happens when a requested server is unavailable.
+	FallbackPolicy FallbackPolicy `yaml:"server_fallback_policy"`
+	// MaxConnections limits concurrent connections per transfer, 0 means auto-detect.
+	MaxConnections int `yaml:"max_connections"`
+	// Parallel pings every server at the same time and then runs the download
+	// and upload phases with at most BandwidthConcurrency servers at a time.
+	Parallel bool `yaml:"parallel"`
+	// BandwidthConcurrency limits concurrent bandwidth phases in parallel mode.
+	// Values below 1 keep the bandwidth phases sequential.
+	BandwidthConcurrency int `yaml:"bandwidth_concurrency"`
+	// Phases are run by default; a scrape may ask for a different set.
+	// Empty means all phases.
+	Phases []Phase `yaml:"phases"`
+	// Budget limits the data transferred per day and month.
+	Budget BudgetConfig `yaml:"budget"`
+	// SourceAddress is the local IP address test traffic is sent from.
+	SourceAddress string `yaml:"source_address"`
+	// Interface is the network interface test traffic is bound to (Linux only).
+	Interface string `yaml:"interface"`
+	// Links turns the module into a multi-WAN module: every run tests each
+	// link in turn, using the link's source instead of SourceAddress and
+	// Interface.
+	Links []Link `yaml:"links"`
+	// IPFamily restricts test traffic to IPv4 or IPv6, or tests both.
+	IPFamily IPFamily `yaml:"ip_family"`
+	// DNSServer resolves the speedtest hosts instead of the system resolver.
+	// It is an IP address with an optional port, or a DNS-over-HTTPS URL.
+	DNSServer string `yaml:"dns_server"`
+	// ProxyURL sends test traffic through an HTTP, HTTPS or SOCKS5 proxy,
+	// with any credentials in the URL. Empty uses the proxy environment
+	// variables.
+	ProxyURL string `yaml:"proxy_url"`
+	// NoProxy lists hosts that bypass ProxyURL, in the NO_PROXY format.
+	NoProxy string `yaml:"no_proxy"`
+	// UserAgent replaces speedtest-go's User-Agent on all test traffic.
+	UserAgent string `yaml:"user_agent"`
+	// Headers are added to every request of the test traffic.
+	Headers map[string]string `yaml:"headers"`
+	// PathProbe traces the route to each selected server before testing it.
+	PathProbe PathProbeConfig `yaml:"path_probe"`
+	// PathMTU finds the path MTU to each selected server before testing it.
+	PathMTU PathMTUConfig `yaml:"path_mtu"`
+	// TCPInfo reads TCP_INFO from the download and upload connections and
+	// exports it per server (Linux only).
+	TCPInfo bool `yaml:"tcp_info"`
+	// Transfer controls how long the bandwidth phases run and how much data
+	// each request moves.
+	Transfer TransferConfig `yaml:"transfer"`
+}
+
+// links returns the links tested by each run. Without configured links the
+// module's own source forms a single unnamed link.
+func (c Config) links() []Link {
+	if len(c.Links) > 0 {
+		return c.Links
+	}
+	return []Link{{SourceAddress: c.SourceAddress, Interface: c.Interface}}
+}
+
+// Routes returns how many times each run tests the servers: once per link
+// and IP family.
+func (c Config) Routes() int {
+	return len(c.links()) * len(c.IPFamily.families())
+}
+
+// Sources describes where test traffic leaves the host, one entry per link.
+func (c Config) Sources() []string {
+	var sources []string
+	for _, link := range c.links() {
+		sources = append(sources, link.Source())
+	}
+	return sources
+}
+
+// ValidateLinks checks the source settings of the module and its links.
+func (c Config) ValidateLinks() error {
+	if len(c.Links) > 0 && (c.SourceAddress != "" || c.Interface != "") {
+		return fmt.Errorf("source_address and interface must be set per link when links are configured")
+	}
+	seen := make(map[string]bool)
+	for _, link := range c.Links {
+		if link.Name == "" {
+			return fmt.Errorf("every link needs a name")
+		}
+		if seen[link.Name] {
+			return fmt.Errorf("duplicate link name %q", link.Name)
+		}
+		seen[link.Name] = true
+	}
+	for _, link := range c.links() {
+		if err := link.validate(); err != nil {
+			if link.Name != "" {
+				return fmt.Errorf("link %q: %w", link.Name, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
 // Exporter runs speedtest and exports them using
 // the prometheus metrics package.
 type Exporter struct {
-	serverIDs      []int
-	serverFallback bool
-	clientFactory  func() SpeedtestClient
-	runner         ServerRunner
+	cfg Config
+	// newSession returns the client and runner used to test a link over one
+	// IP family once.
+	newSession func(link Link, family IPFamily) (SpeedtestClient, ServerRunner)
+	ledger     *BudgetLedger
+
+	// traceroute traces the path to a server when PathProbe is enabled.
+	traceroute func(ctx context.Context, dst netip.Addr, opts probe.Options) (*probe.Path, error)
+	// pathMTU finds the path MTU to a server when PathMTU is enabled.
+	pathMTU func(ctx context.Context, dst netip.Addr, opts probe.Options) (int, error)
+
+	// countries remembers the country of every requested server seen so far,
+	// so closest_in_same_country still works once a server drops off the list.
+	mu        sync.Mutex
+	countries map[string]string
+	// traces holds the last path traces of each link and IP family.
+	traces map[traceKey][]PathTrace
+	// history holds the last run results.
+	history *history
+	// store persists every run result when set.
+	store *ResultStore
+	// resultLog appends every run result to a file when set.
+	resultLog *ResultLog
+
+	// runStart is when the run in progress started, zero when idle.
+	runMu    sync.Mutex
+	runStart time.Time
+}
+
+// substitution records a requested server that was replaced by another one.
+type substitution struct {
+	requestedID string
+	actualID    string
 }
 
 // New returns an initialized Exporter.
-func New(serverIDs []int, serverFallback bool, maxConnections int) *Exporter {
+func New(cfg Config) *Exporter {
+	ledger := newBudgetLedger()
 	return &Exporter{
-		serverIDs:      serverIDs,
-		serverFallback: serverFallback,
-		clientFactory: func() SpeedtestClient {
-			return &defaultClient{inner: speedtest.New(
-				speedtest.WithUserConfig(&speedtest.UserConfig{MaxConnections: maxConnections}),
-			)}
+		cfg:        cfg,
+		countries:  make(map[string]string),
+		traces:     make(map[traceKey][]PathTrace),
+		history:    newHistory(DefaultHistorySize),
+		traceroute: probe.Traceroute,
+		pathMTU:    probe.PathMTU,
+		newSession: func(link Link, family IPFamily) (SpeedtestClient, ServerRunner) {
+			meters := newTrafficMeters(newResolver(cfg, link), family)
+			if cfg.TCPInfo {
+				meters.conns = newTCPConns()
+			}
+			doer := newHTTPClient(cfg, link, family, meters)
+			// WithDoer must come last, WithUserConfig replaces the doer's transport.
+			opts := []speedtest.Option{
+				speedtest.WithUserConfig(&speedtest.UserConfig{MaxConnections: cfg.MaxConnections, UserAgent: cfg.userAgent()}),
+				speedtest.WithDoer(doer),
+			}
+			client := &defaultClient{inner: speedtest.New(opts...), opts: opts, meters: meters}
+			return client, &defaultRunner{doer: doer, transfer: cfg.Transfer, tcp: meters.conns, proxy: proxyFunc(cfg)}
 		},
-		runner: &defaultRunner{},
+		ledger: ledger,
 	}
 }
 
 // NewWithDeps returns an Exporter with injected dependencies for testing.
-func NewWithDeps(serverIDs []int, serverFallback bool, client SpeedtestClient, runner ServerRunner) *Exporter {
+func NewWithDeps(cfg Config, client SpeedtestClient, runner ServerRunner) *Exporter {
+	ledger := newBudgetLedger()
 	return &Exporter{
-		serverIDs:      serverIDs,
-		serverFallback: serverFallback,
-		clientFactory:  func() SpeedtestClient { return client },
-		runner:         runner,
+		cfg:        cfg,
+		countries:  make(map[string]string),
+		traces:     make(map[traceKey][]PathTrace),
+		history:    newHistory(DefaultHistorySize),
+		traceroute: probe.Traceroute,
+		pathMTU:    probe.PathMTU,
+		newSession: func(Link, IPFamily) (SpeedtestClient, ServerRunner) { return client, runner },
+		ledger:     ledger,
 	}
 }
 
+// SetBudgetLedger makes the exporter record its data usage in l, which may be
+// shared by several exporters. By default usage is only kept in memory.
+func (e *Exporter) SetBudgetLedger(l *BudgetLedger) {
+	e.ledger = l
+}
+
 // Describe describes all the metrics. It implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- up
@@ -126,6 +604,26 @@ func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- latency
 	ch <- upload
 	ch <- download
+	ch <- serverSubstituted
+	ch <- concurrentMeasurement
+	ch <- budgetRemainingBytes
+	ch <- budgetExhausted
+	ch <- linkUp
+	ch <- linkContractBytesPerSecond
+	ch <- linkBest
+	ch <- ipv6Available
+	ch <- dnsLookupDurationSeconds
+	ch <- httpPhaseSeconds
+	ch <- pathHops
+	ch <- pathReached
+	ch <- pathHopRTTSeconds
+	ch <- pathMTUBytes
+	ch <- tcpRTTSeconds
+	ch <- tcpRTTVarianceSeconds
+	ch <- tcpCongestionWindowSegments
+	ch <- tcpDeliveryRateBytesPerSecond
+	ch <- tcpRetransmittedSegments
+	ch <- tcpRetransmitRatio
 }
 
 // Collect fetches the stats from a speedtest and delivers them
@@ -136,8 +634,56 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 
 // CollectWithContext is like Collect but accepts a context for cancellation.
 func (e *Exporter) CollectWithContext(ctx context.Context, ch chan<- prometheus.Metric) {
+	e.CollectPhases(ctx, e.Phases(), ch)
+}
+
+// Phases returns the phases run when a scrape does not ask for specific ones.
+func (e *Exporter) Phases() []Phase {
+	if len(e.cfg.Phases) == 0 {
+		return AllPhases
+	}
+	return e.cfg.Phases
+}
+
+// Config returns the module configuration of the exporter.
+func (e *Exporter) Config() Config {
+	return e.cfg
+}
+
+// Running reports whether a run is in progress and when it started.
+func (e *Exporter) Running() (time.Time, bool) {
+	e.runMu.Lock()
+	defer e.runMu.Unlock()
+	return e.runStart, !e.runStart.IsZero()
+}
+
+func (e *Exporter) setRunStart(t time.Time) {
+	e.runMu.Lock()
+	defer e.runMu.Unlock()
+	e.runStart = t
+}
+
+// CollectPhases is like CollectWithContext but only runs the given phases.
+// speedtest_up only reflects the phases that were run.
+func (e *Exporter) CollectPhases(ctx context.Context, phases []Phase, ch chan<- prometheus.Metric) {
+	e.Run(ctx, phases, ch)
+}
+
+// Run is like CollectPhases and also returns the result of the run.
+func (e *Exporter) Run(ctx context.Context, phases []Phase, ch chan<- prometheus.Metric) Result {
 	start := time.Now()
-	ok := e.speedtest(ctx, ch)
+	e.setRunStart(start)
+	defer e.setRunStart(time.Time{})
+	linkPhases, phases := e.budgetPhases(phases)
+	skipped := len(phases) == 0
+	rec := newRunRecorder(e.cfg.Name, phases)
+	// A run the budget skipped did not fail, so it keeps speedtest_up at 1.
+	ok := true
+	if !skipped {
+		ok = e.speedtest(ctx, rec, linkPhases, ch)
+	}
+	result := rec.finish(ok, skipped)
+	e.recordResult(result)
 
 	upVal := 0.0
 	if ok {
@@ -149,134 +695,457 @@ func (e *Exporter) CollectWithContext(ctx context.Context, ch chan<- prometheus.
 	ch <- prometheus.MustNewConstMetric(
 		scrapeDurationSeconds, prometheus.GaugeValue, time.Since(start).Seconds(),
 	)
+	e.collectBudget(ch)
+	return result
+}
+
+// budgetPhases applies the data budget of each link to the requested phases
+// and returns them by link name, along with the phases any link still runs.
+// Once a link's budget is exhausted only its ping phase is kept, or none with
+// BudgetSkip.
+func (e *Exporter) budgetPhases(phases []Phase) (linkPhases map[string][]Phase, run []Phase) {
+	linkPhases = make(map[string][]Phase)
+	for _, link := range e.cfg.links() {
+		p := phases
+		if e.budgetLeft(link) == 0 {
+			p = nil
+			if e.cfg.Budget.OnExhausted == BudgetSkip || !slices.Contains(phases, PhasePing) {
+				slog.Warn("data budget exhausted, skipping run", "module", e.cfg.Name, "link", link.Name)
+			} else {
+				slog.Warn("data budget exhausted, running latency only", "module", e.cfg.Name, "link", link.Name)
+				p = []Phase{PhasePing}
+			}
+		}
+		linkPhases[link.Name] = p
+	}
+	for _, phase := range phases {
+		for _, p := range linkPhases {
+			if slices.Contains(p, phase) {
+				run = append(run, phase)
+				break
+			}
+		}
+	}
+	return linkPhases, run
+}
+
+// budgetLeft returns the bytes link may still transfer, or -1 when no budget
+// is configured.
+func (e *Exporter) budgetLeft(link Link) int64 {
+	if !e.cfg.Budget.Enabled() {
+		return -1
+	}
+	usedDay, usedMonth := e.ledger.Used(e.cfg.Name, link.Name)
+	return budgetLeft(e.cfg.Budget, usedDay, usedMonth)
 }
 
-func (e *Exporter) speedtest(ctx context.Context, ch chan<- prometheus.Metric) bool {
-	client := e.clientFactory()
+// collectBudget exports the remaining data budget of every link, if one is
+// configured.
+func (e *Exporter) collectBudget(ch chan<- prometheus.Metric) {
+	if !e.cfg.Budget.Enabled() {
+		return
+	}
+	for _, link := range e.cfg.links() {
+		usedDay, usedMonth := e.ledger.Used(e.cfg.Name, link.Name)
+		day, month := budgetRemaining(e.cfg.Budget, usedDay, usedMonth)
+		if day >= 0 {
+			ch <- prometheus.MustNewConstMetric(
+				budgetRemainingBytes, prometheus.GaugeValue, float64(day), "daily", link.Name,
+			)
+		}
+		if month >= 0 {
+			ch <- prometheus.MustNewConstMetric(
+				budgetRemainingBytes, prometheus.GaugeValue, float64(month), "monthly", link.Name,
+			)
+		}
+
+		exhausted := 0.0
+		if day == 0 || month == 0 {
+			exhausted = 1.0
+		}
+		ch <- prometheus.MustNewConstMetric(
+			budgetExhausted, prometheus.GaugeValue, exhausted, link.Name,
+		)
+	}
+}
+
+// collectTraffic exports the DNS lookup and HTTP connection timings of
+// client, if it measures them.
+func collectTraffic(client SpeedtestClient, link Link, family IPFamily, ch chan<- prometheus.Metric) {
+	if timer, ok := client.(lookupTimer); ok {
+		for host, d := range timer.LookupDurations() {
+			ch <- prometheus.MustNewConstMetric(
+				dnsLookupDurationSeconds, prometheus.GaugeValue, d.Seconds(),
+				host, link.Name, string(family),
+			)
+		}
+	}
+	if timer, ok := client.(httpTimer); ok {
+		for k, d := range timer.HTTPTimings() {
+			ch <- prometheus.MustNewConstMetric(
+				httpPhaseSeconds, prometheus.GaugeValue, d.Seconds(),
+				k.phase, k.target, link.Name, string(family),
+			)
+		}
+	}
+}
+
+// recordUsage adds the bytes transferred by client over link to the budget
+// ledger.
+func (e *Exporter) recordUsage(client SpeedtestClient, link Link) {
+	counter, ok := client.(byteCounter)
+	if !ok {
+		return
+	}
+	if err := e.ledger.Add(e.cfg.Name, link.Name, counter.BytesTransferred()); err != nil {
+		slog.Error("could not persist data budget usage", "error", err)
+	}
+}
+
+// speedtest tests every link of the module with its phases and reports
+// whether all of them succeeded. Links the budget left without phases are
+// skipped and do not count. Multi-WAN modules also export per-link metrics.
+func (e *Exporter) speedtest(ctx context.Context, rec *runRecorder, linkPhases map[string][]Phase, ch chan<- prometheus.Metric) bool {
+	if len(e.cfg.Links) == 0 {
+		link := e.cfg.links()[0]
+		ok, _ := e.testLink(ctx, rec, link, linkPhases[link.Name], ch)
+		return ok
+	}
+
+	allOK := true
+	scores := make(map[string]linkScore)
+	for _, link := range e.cfg.Links {
+		if len(linkPhases[link.Name]) == 0 {
+			rec.skip(link)
+			continue
+		}
+		ok, targets := e.testLink(ctx, rec, link, linkPhases[link.Name], ch)
+		if ok {
+			scores[link.Name] = scoreLink(targets)
+		}
+		collectLink(link, ok, ch)
+		allOK = allOK && ok
+	}
+	collectBestLink(e.cfg.Links, scores, ch)
+
+	return allOK
+}
+
+// testLink runs the requested phases over link, once per configured IP
+// family, and returns the servers tested. When both families are tested, a
+// failed IPv6 run only shows in speedtest_ipv6_available.
+func (e *Exporter) testLink(ctx context.Context, rec *runRecorder, link Link, phases []Phase, ch chan<- prometheus.Metric) (bool, speedtest.Servers) {
+	allOK := true
+	var tested speedtest.Servers
+	for _, family := range e.cfg.IPFamily.families() {
+		ok, targets := e.testRoute(ctx, rec, link, family, phases, ch)
+		tested = append(tested, targets...)
+		if family == IPv6 {
+			available := 0.0
+			if ok {
+				available = 1.0
+			}
+			ch <- prometheus.MustNewConstMetric(
+				ipv6Available, prometheus.GaugeValue, available, link.Name,
+			)
+			if e.cfg.IPFamily == IPFamilyBoth {
+				continue
+			}
+		}
+		allOK = allOK && ok
+	}
+	return allOK, tested
+}
+
+// testRoute runs the requested phases over link using one IP family.
+func (e *Exporter) testRoute(ctx context.Context, rec *runRecorder, link Link, family IPFamily, phases []Phase, ch chan<- prometheus.Metric) (bool, speedtest.Servers) {
+	client, runner := e.newSession(link, family)
+	defer e.recordUsage(client, link)
+	defer collectTraffic(client, link, family, ch)
+
+	// Bandwidth phases stop once they used up what was left of the budget.
+	if counter, ok := client.(byteCounter); ok && (slices.Contains(phases, PhaseDownload) || slices.Contains(phases, PhaseUpload)) {
+		if left := e.budgetLeft(link); left >= 0 {
+			var stop context.CancelFunc
+			ctx, stop = limitTraffic(ctx, counter, left)
+			defer stop()
+			defer func() {
+				if errors.Is(context.Cause(ctx), errBudgetExhausted) {
+					slog.Warn("data budget exhausted during the run, stopped it", "module", e.cfg.Name, "link", link.Name, "ip_family", family)
+					rec.fail(link, family, errBudgetExhausted)
+				}
+			}()
+		}
+	}
+
 	user, err := client.FetchUserInfo(ctx)
 	if err != nil {
-		slog.Error("could not fetch user information", "error", err)
-		return false
+		slog.Error("could not fetch user information", "link", link.Name, "ip_family", family, "error", err)
+		rec.fail(link, family, fmt.Errorf("could not fetch user information: %w", err))
+		return false, nil
 	}
 
 	servers, err := client.FetchServers(ctx)
 	if err != nil {
-		slog.Error("could not fetch server list", "error", err)
-		return false
+		slog.Error("could not fetch server list", "link", link.Name, "ip_family", family, "error", err)
+		rec.fail(link, family, fmt.Errorf("could not fetch server list: %w", err))
+		return false, nil
 	}
 
-	targets, err := e.selectServers(servers)
+	targets, subs, err := e.selectServers(servers)
 	if err != nil {
-		return false
+		rec.fail(link, family, err)
+		return false, nil
+	}
+
+	for _, sub := range subs {
+		ch <- prometheus.MustNewConstMetric(
+			serverSubstituted, prometheus.GaugeValue, 1,
+			sub.requestedID, sub.actualID, link.Name, string(family),
+		)
+	}
+
+	r := &linkRun{link: link, family: family, runner: runner, user: user, ch: ch, rec: rec}
+	r.serversSelected(ctx, targets)
+	if e.cfg.PathProbe.Enabled {
+		e.tracePaths(ctx, r, targets)
+	}
+	if e.cfg.PathMTU.Enabled {
+		e.discoverMTUs(ctx, r, targets)
+	}
+
+	if e.cfg.Parallel {
+		return e.testParallel(ctx, client, r, targets, phases), targets
 	}
 
 	allOK := true
 	for _, server := range targets {
-		ok := e.pingTest(ctx, user, server, ch)
-		ok = e.downloadTest(ctx, user, server, ch) && ok
-		ok = e.uploadTest(ctx, user, server, ch) && ok
+		ok := true
+		if slices.Contains(phases, PhasePing) {
+			ok = e.pingTest(ctx, r, server) && ok
+		}
+		ok = e.bandwidthTest(ctx, r, server, phases) && ok
 		allOK = allOK && ok
 	}
 
-	return allOK
+	return allOK, targets
 }
 
-// selectServers picks servers based on the exporter configuration.
-func (e *Exporter) selectServers(servers speedtest.Servers) (speedtest.Servers, error) {
-	if len(servers) == 0 {
-		return nil, fmt.Errorf("no servers available")
+// bandwidthTest runs whichever of the download and upload phases are requested.
+func (e *Exporter) bandwidthTest(ctx context.Context, r *linkRun, server *speedtest.Server, phases []Phase) bool {
+	ok := true
+	if slices.Contains(phases, PhaseDownload) {
+		ok = e.downloadTest(ctx, r, server) && ok
+	}
+	if slices.Contains(phases, PhaseUpload) {
+		ok = e.uploadTest(ctx, r, server) && ok
 	}
+	return ok
+}
 
-	// -1 means use the closest server.
-	if len(e.serverIDs) == 1 && e.serverIDs[0] == -1 {
-		return speedtest.Servers{servers[0]}, nil
+// testParallel pings every target at once, then runs the bandwidth phases in a
+// pool limited to BandwidthConcurrency servers.
+func (e *Exporter) testParallel(ctx context.Context, client SpeedtestClient, r *linkRun, targets speedtest.Servers, phases []Phase) bool {
+	if iso, ok := client.(serverIsolator); ok {
+		for i, server := range targets {
+			targets[i] = iso.isolate(server)
+		}
 	}
 
-	targets, err := servers.FindServer(e.serverIDs)
-	if err != nil {
-		slog.Error("could not find servers", "error", err)
-		return nil, err
+	var failed atomic.Bool
+	var wg sync.WaitGroup
+	if slices.Contains(phases, PhasePing) {
+		for _, server := range targets {
+			wg.Go(func() {
+				if !e.pingTest(ctx, r, server) {
+					failed.Store(true)
+				}
+			})
+		}
+		wg.Wait()
 	}
 
-	if len(targets) == 0 {
-		slog.Error("no matching servers returned", "server_ids", e.serverIDs)
-		return nil, fmt.Errorf("no servers returned for IDs %v", e.serverIDs)
+	if !slices.Contains(phases, PhaseDownload) && !slices.Contains(phases, PhaseUpload) {
+		return !failed.Load()
 	}
 
-	if !e.serverFallback {
-		// Verify all requested IDs appear in results.
-		found := make(map[string]bool)
-		for _, s := range targets {
-			found[s.ID] = true
-		}
-		for _, id := range e.serverIDs {
-			if !found[fmt.Sprintf("%d", id)] {
-				slog.Error("could not find requested server ID, server_fallback is not set so failing", "server_id", id)
-				return nil, fmt.Errorf("server %d not found and fallback disabled", id)
+	concurrency := max(e.cfg.BandwidthConcurrency, 1)
+	sem := make(chan struct{}, concurrency)
+	for _, server := range targets {
+		wg.Go(func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if !e.bandwidthTest(ctx, r, server, phases) {
+				failed.Store(true)
 			}
+		})
+	}
+	wg.Wait()
+
+	concurrent := 0.0
+	if concurrency > 1 && len(targets) > 1 {
+		concurrent = 1.0
+	}
+	r.ch <- prometheus.MustNewConstMetric(
+		concurrentMeasurement, prometheus.GaugeValue, concurrent,
+		r.link.Name, string(r.family),
+	)
+
+	return !failed.Load()
+}
+
+// selectServers picks servers based on the exporter configuration. Requested
+// IDs that are missing from the list are handled according to the fallback
+// policy; any replacement made is returned as a substitution.
+func (e *Exporter) selectServers(servers speedtest.Servers) (speedtest.Servers, []substitution, error) {
+	if len(servers) == 0 {
+		return nil, nil, fmt.Errorf("no servers available")
+	}
+
+	byID := make(map[string]*speedtest.Server, len(servers))
+	for _, s := range servers {
+		byID[s.ID] = s
+	}
+
+	var targets speedtest.Servers
+	var subs []substitution
+	seen := make(map[string]bool)
+	add := func(s *speedtest.Server) {
+		if !seen[s.ID] {
+			seen[s.ID] = true
+			targets = append(targets, s)
 		}
 	}
 
-	return targets, nil
+	for _, id := range e.cfg.ServerIDs {
+		// -1 means use the closest server.
+		if id == -1 {
+			add(servers[0])
+			continue
+		}
+
+		requested := strconv.Itoa(id)
+		if s, ok := byID[requested]; ok {
+			e.rememberCountry(s)
+			add(s)
+			continue
+		}
+
+		var sub *speedtest.Server
+		switch e.cfg.FallbackPolicy {
+		case FallbackSkipMissing:
+			slog.Warn("could not find requested server ID, skipping it", "server_id", id)
+			continue
+		case FallbackClosest:
+			sub = servers[0]
+		case FallbackClosestInSameCountry:
+			sub = e.closestInSameCountry(servers, requested)
+		}
+		if sub == nil {
+			slog.Error("could not find requested server ID, failing", "server_id", id, "fallback_policy", e.cfg.FallbackPolicy)
+			return nil, nil, fmt.Errorf("server %d not found and fallback policy is %q", id, e.cfg.FallbackPolicy)
+		}
+
+		slog.Warn("could not find requested server ID, substituting", "server_id", id, "substitute_id", sub.ID)
+		subs = append(subs, substitution{requestedID: requested, actualID: sub.ID})
+		add(sub)
+	}
+
+	if len(targets) == 0 {
+		slog.Error("no matching servers returned", "server_ids", e.cfg.ServerIDs)
+		return nil, nil, fmt.Errorf("no servers returned for IDs %v", e.cfg.ServerIDs)
+	}
+
+	return targets, subs, nil
 }
 
-// labelValues returns the common label values for speedtest metrics.
-func labelValues(user *speedtest.User, server *speedtest.Server) []string {
-	return []string{
-		user.Lat,
-		user.Lon,
-		user.IP,
-		user.Isp,
-		server.Lat,
-		server.Lon,
-		server.ID,
-		server.Name,
-		server.Country,
-		fmt.Sprintf("%.0f", server.Distance),
+// rememberCountry records the country of a requested server.
+func (e *Exporter) rememberCountry(s *speedtest.Server) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.countries[s.ID] = s.Country
+}
+
+// closestInSameCountry returns the closest server in the country the requested
+// server was last seen in. If it was never seen, the closest server's country
+// is used as a stand-in for the user's own. The list is sorted by distance.
+func (e *Exporter) closestInSameCountry(servers speedtest.Servers, requestedID string) *speedtest.Server {
+	e.mu.Lock()
+	country, ok := e.countries[requestedID]
+	e.mu.Unlock()
+	if !ok {
+		country = servers[0].Country
+	}
+
+	for _, s := range servers {
+		if s.Country == country {
+			return s
+		}
 	}
+	return nil
 }
 
-func (e *Exporter) pingTest(ctx context.Context, user *speedtest.User, server *speedtest.Server, ch chan<- prometheus.Metric) bool {
-	err := e.runner.PingTest(ctx, server)
+func (e *Exporter) pingTest(ctx context.Context, r *linkRun, server *speedtest.Server) bool {
+	ctx, done := r.startPhase(ctx, server, PhasePing)
+	err := r.runner.PingTest(ctx, server)
 	if err != nil {
+		done(0, err)
 		slog.Error("failed to carry out ping test", "error", err)
+		r.rec.phaseError(r, server, PhasePing, err)
 		return false
 	}
 
-	ch <- prometheus.MustNewConstMetric(
-		latency, prometheus.GaugeValue, server.Latency.Seconds(),
-		labelValues(user, server)...,
+	v := server.Latency.Seconds()
+	done(v, nil)
+	r.ch <- prometheus.MustNewConstMetric(
+		latency, prometheus.GaugeValue, v,
+		r.labelValues(server)...,
 	)
+	r.rec.server(r, server, func(s *ServerResult) { s.LatencySeconds = &v })
 
 	return true
 }
 
-func (e *Exporter) downloadTest(ctx context.Context, user *speedtest.User, server *speedtest.Server, ch chan<- prometheus.Metric) bool {
-	err := e.runner.DownloadTest(ctx, server)
+func (e *Exporter) downloadTest(ctx context.Context, r *linkRun, server *speedtest.Server) bool {
+	ctx, done := r.startPhase(ctx, server, PhaseDownload)
+	err := r.runner.DownloadTest(ctx, server)
 	if err != nil {
+		done(0, err)
 		slog.Error("failed to carry out download test", "error", err)
+		r.rec.phaseError(r, server, PhaseDownload, err)
 		return false
 	}
 
-	ch <- prometheus.MustNewConstMetric(
-		download, prometheus.GaugeValue, float64(server.DLSpeed),
-		labelValues(user, server)...,
+	v := float64(server.DLSpeed)
+	done(v, nil)
+	r.ch <- prometheus.MustNewConstMetric(
+		download, prometheus.GaugeValue, v,
+		r.labelValues(server)...,
 	)
+	r.rec.server(r, server, func(s *ServerResult) { s.DownloadBytesPerSecond = &v })
+	collectTCPInfo(r, server, PhaseDownload)
 
 	return true
 }
 
-func (e *Exporter) uploadTest(ctx context.Context, user *speedtest.User, server *speedtest.Server, ch chan<- prometheus.Metric) bool {
-	err := e.runner.UploadTest(ctx, server)
+func (e *Exporter) uploadTest(ctx context.Context, r *linkRun, server *speedtest.Server) bool {
+	ctx, done := r.startPhase(ctx, server, PhaseUpload)
+	err := r.runner.UploadTest(ctx, server)
 	if err != nil {
+		done(0, err)
 		slog.Error("failed to carry out upload test", "error", err)
+		r.rec.phaseError(r, server, PhaseUpload, err)
 		return false
 	}
 
-	ch <- prometheus.MustNewConstMetric(
-		upload, prometheus.GaugeValue, float64(server.ULSpeed),
-		labelValues(user, server)...,
+	v := float64(server.ULSpeed)
+	done(v, nil)
+	r.ch <- prometheus.MustNewConstMetric(
+		upload, prometheus.GaugeValue, v,
+		r.labelValues(server)...,
 	)
+	r.rec.server(r, server, func(s *ServerResult) { s.UploadBytesPerSecond = &v })
+	collectTCPInfo(r, server, PhaseUpload)
 
 	return true
 }
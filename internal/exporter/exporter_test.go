@@ -3,6 +3,8 @@ package exporter
 import (
 	"context"
 	"errors"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
@@ -39,10 +41,11 @@ type mockRunner struct {
 	ulSpeed speedtest.ByteRate
 }
 
-func (m *mockRunner) PingTest(_ context.Context, server *speedtest.Server) error {
+func (m *mockRunner) PingTest(ctx context.Context, server *speedtest.Server) error {
 	if m.pingErr != nil {
 		return m.pingErr
 	}
+	reportSample(ctx, m.latency.Seconds())
 	server.Latency = m.latency
 	return nil
 }
@@ -72,8 +75,11 @@ func newTestUser() *speedtest.User {
 	}
 }
 
+// newTestServer returns a server at 192.0.2.1, so probes of its path need
+// no name resolution.
 func newTestServer(id string) *speedtest.Server {
 	return &speedtest.Server{
+		URL:      "http://192.0.2.1:8080/speedtest/upload.php",
 		ID:       id,
 		Name:     "TestServer",
 		Country:  "US",
@@ -83,6 +89,11 @@ func newTestServer(id string) *speedtest.Server {
 	}
 }
 
+// newTestClient returns a mockClient that lists servers for a test user.
+func newTestClient(servers ...*speedtest.Server) *mockClient {
+	return &mockClient{user: newTestUser(), servers: servers}
+}
+
 func newTestRunner() *mockRunner {
 	return &mockRunner{
 		latency: 10 * time.Millisecond,
@@ -106,6 +117,29 @@ func collectMetrics(e *Exporter) []prometheus.Metric {
 	return metrics
 }
 
+// gatherMetrics collects e through a registry, which rejects inconsistent
+// and duplicate metrics as a scrape of /metrics would.
+func gatherMetrics(t *testing.T, e *Exporter) []*dto.MetricFamily {
+	t.Helper()
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(e)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics: %v", err)
+	}
+	return families
+}
+
+// familySize returns how many metrics the family named name has.
+func familySize(families []*dto.MetricFamily, name string) int {
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return len(mf.GetMetric())
+		}
+	}
+	return 0
+}
+
 // metricToDTO converts a prometheus.Metric to a DTO for inspection.
 func metricToDTO(m prometheus.Metric) *dto.Metric {
 	d := &dto.Metric{}
@@ -141,8 +175,8 @@ func searchString(s, substr string) bool {
 }
 
 func TestDescribe(t *testing.T) {
-	e := NewWithDeps([]int{-1}, false, &mockClient{}, &mockRunner{})
-	ch := make(chan *prometheus.Desc, 10)
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, &mockClient{}, &mockRunner{})
+	ch := make(chan *prometheus.Desc, 30)
 	e.Describe(ch)
 	close(ch)
 
@@ -151,8 +185,8 @@ func TestDescribe(t *testing.T) {
 		descs = append(descs, d)
 	}
 
-	if got := len(descs); got != 5 {
-		t.Fatalf("expected 5 descriptors, got %d", got)
+	if got := len(descs); got != 25 {
+		t.Fatalf("expected 25 descriptors, got %d", got)
 	}
 
 	expected := []string{
@@ -161,6 +195,19 @@ func TestDescribe(t *testing.T) {
 		"speedtest_latency_seconds",
 		"speedtest_upload_speed_bytes_per_second",
 		"speedtest_download_speed_bytes_per_second",
+		"speedtest_server_substituted",
+		"speedtest_concurrent_measurement",
+		"speedtest_budget_remaining_bytes",
+		"speedtest_budget_exhausted",
+		"speedtest_link_up",
+		"speedtest_link_contract_bytes_per_second",
+		"speedtest_link_best",
+		"speedtest_ipv6_available",
+		"speedtest_dns_lookup_duration_seconds",
+		"speedtest_http_phase_seconds",
+		"speedtest_path_hops",
+		"speedtest_path_reached",
+		"speedtest_path_hop_rtt_seconds",
 	}
 	for _, name := range expected {
 		found := false
@@ -182,7 +229,7 @@ func TestCollect_Success(t *testing.T) {
 		servers: speedtest.Servers{newTestServer("100")},
 	}
 	runner := newTestRunner()
-	e := NewWithDeps([]int{-1}, false, client, runner)
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, client, runner)
 
 	metrics := collectMetrics(e)
 
@@ -222,7 +269,7 @@ func TestCollect_FetchUserInfoError(t *testing.T) {
 	client := &mockClient{
 		userErr: errors.New("network error"),
 	}
-	e := NewWithDeps([]int{-1}, false, client, &mockRunner{})
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, client, &mockRunner{})
 
 	metrics := collectMetrics(e)
 
@@ -247,7 +294,7 @@ func TestCollect_FetchServersError(t *testing.T) {
 		user:       newTestUser(),
 		serversErr: errors.New("server list unavailable"),
 	}
-	e := NewWithDeps([]int{-1}, false, client, &mockRunner{})
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, client, &mockRunner{})
 
 	metrics := collectMetrics(e)
 
@@ -271,9 +318,9 @@ func TestSelectServers_ClosestServer(t *testing.T) {
 		newTestServer("1"),
 		newTestServer("2"),
 	}
-	e := NewWithDeps([]int{-1}, false, &mockClient{}, &mockRunner{})
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, &mockClient{}, &mockRunner{})
 
-	result, err := e.selectServers(servers)
+	result, _, err := e.selectServers(servers)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -287,9 +334,9 @@ func TestSelectServers_SpecificServer(t *testing.T) {
 		newTestServer("100"),
 		newTestServer("200"),
 	}
-	e := NewWithDeps([]int{200}, false, &mockClient{}, &mockRunner{})
+	e := NewWithDeps(Config{ServerIDs: []int{200}, FallbackPolicy: FallbackFail}, &mockClient{}, &mockRunner{})
 
-	result, err := e.selectServers(servers)
+	result, _, err := e.selectServers(servers)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -304,9 +351,9 @@ func TestSelectServers_MultipleIDs(t *testing.T) {
 		newTestServer("200"),
 		newTestServer("300"),
 	}
-	e := NewWithDeps([]int{100, 300}, false, &mockClient{}, &mockRunner{})
+	e := NewWithDeps(Config{ServerIDs: []int{100, 300}, FallbackPolicy: FallbackFail}, &mockClient{}, &mockRunner{})
 
-	result, err := e.selectServers(servers)
+	result, _, err := e.selectServers(servers)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -327,9 +374,9 @@ func TestSelectServers_FallbackEnabled(t *testing.T) {
 	servers := speedtest.Servers{
 		newTestServer("100"),
 	}
-	e := NewWithDeps([]int{999}, true, &mockClient{}, &mockRunner{})
+	e := NewWithDeps(Config{ServerIDs: []int{999}, FallbackPolicy: FallbackClosest}, &mockClient{}, &mockRunner{})
 
-	result, err := e.selectServers(servers)
+	result, _, err := e.selectServers(servers)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -341,9 +388,9 @@ func TestSelectServers_FallbackEnabled(t *testing.T) {
 
 func TestSelectServers_EmptyServers(t *testing.T) {
 	servers := speedtest.Servers{}
-	e := NewWithDeps([]int{-1}, false, &mockClient{}, &mockRunner{})
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, &mockClient{}, &mockRunner{})
 
-	_, err := e.selectServers(servers)
+	_, _, err := e.selectServers(servers)
 	if err == nil {
 		t.Fatal("expected error for empty server list")
 	}
@@ -355,9 +402,9 @@ func TestSelectServers_MissingID_FallbackDisabled(t *testing.T) {
 		newTestServer("200"),
 	}
 	// Request IDs 100 and 999; 999 is missing, fallback disabled.
-	e := NewWithDeps([]int{100, 999}, false, &mockClient{}, &mockRunner{})
+	e := NewWithDeps(Config{ServerIDs: []int{100, 999}, FallbackPolicy: FallbackFail}, &mockClient{}, &mockRunner{})
 
-	_, err := e.selectServers(servers)
+	_, _, err := e.selectServers(servers)
 	if err == nil {
 		t.Fatal("expected error when requested server ID missing and fallback disabled")
 	}
@@ -368,7 +415,7 @@ func TestCollect_EmptyServerList(t *testing.T) {
 		user:    newTestUser(),
 		servers: speedtest.Servers{},
 	}
-	e := NewWithDeps([]int{-1}, false, client, newTestRunner())
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, client, newTestRunner())
 
 	metrics := collectMetrics(e)
 
@@ -392,14 +439,159 @@ func TestSelectServers_FallbackDisabled(t *testing.T) {
 	servers := speedtest.Servers{
 		newTestServer("100"),
 	}
-	e := NewWithDeps([]int{999}, false, &mockClient{}, &mockRunner{})
+	e := NewWithDeps(Config{ServerIDs: []int{999}, FallbackPolicy: FallbackFail}, &mockClient{}, &mockRunner{})
 
-	_, err := e.selectServers(servers)
+	_, _, err := e.selectServers(servers)
 	if err == nil {
 		t.Fatal("expected error when server not found and fallback disabled")
 	}
 }
 
+func TestSelectServers_SkipMissing(t *testing.T) {
+	servers := speedtest.Servers{
+		newTestServer("100"),
+		newTestServer("200"),
+	}
+	e := NewWithDeps(Config{ServerIDs: []int{999, 200}, FallbackPolicy: FallbackSkipMissing}, &mockClient{}, &mockRunner{})
+
+	result, subs, err := e.selectServers(servers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result) != 1 || result[0].ID != "200" {
+		t.Errorf("expected only server '200', got %v", result)
+	}
+	if len(subs) != 0 {
+		t.Errorf("expected no substitutions, got %v", subs)
+	}
+}
+
+func TestSelectServers_SkipMissing_NoneFound(t *testing.T) {
+	servers := speedtest.Servers{
+		newTestServer("100"),
+	}
+	e := NewWithDeps(Config{ServerIDs: []int{999}, FallbackPolicy: FallbackSkipMissing}, &mockClient{}, &mockRunner{})
+
+	if _, _, err := e.selectServers(servers); err == nil {
+		t.Fatal("expected error when every requested server is missing")
+	}
+}
+
+func TestSelectServers_Closest_RecordsSubstitution(t *testing.T) {
+	servers := speedtest.Servers{
+		newTestServer("100"),
+		newTestServer("200"),
+	}
+	e := NewWithDeps(Config{ServerIDs: []int{999}, FallbackPolicy: FallbackClosest}, &mockClient{}, &mockRunner{})
+
+	result, subs, err := e.selectServers(servers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result) != 1 || result[0].ID != "100" {
+		t.Errorf("expected closest server '100', got %v", result)
+	}
+	want := substitution{requestedID: "999", actualID: "100"}
+	if len(subs) != 1 || subs[0] != want {
+		t.Errorf("expected substitution %v, got %v", want, subs)
+	}
+}
+
+func TestSelectServers_Closest_NoDuplicateTargets(t *testing.T) {
+	servers := speedtest.Servers{
+		newTestServer("100"),
+		newTestServer("200"),
+	}
+	// 100 is requested and is also the closest substitute for 999.
+	e := NewWithDeps(Config{ServerIDs: []int{100, 999}, FallbackPolicy: FallbackClosest}, &mockClient{}, &mockRunner{})
+
+	result, subs, err := e.selectServers(servers)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result) != 1 {
+		t.Errorf("expected server '100' to be tested once, got %v", result)
+	}
+	if len(subs) != 1 {
+		t.Errorf("expected 1 substitution, got %v", subs)
+	}
+}
+
+func TestSelectServers_ClosestInSameCountry(t *testing.T) {
+	near := newTestServer("100")
+	near.Country = "CA"
+	far := newTestServer("200")
+	far.Country = "US"
+	wanted := newTestServer("300")
+	wanted.Country = "US"
+	e := NewWithDeps(Config{ServerIDs: []int{300}, FallbackPolicy: FallbackClosestInSameCountry}, &mockClient{}, &mockRunner{})
+
+	// First run sees server 300, so its country is remembered.
+	if _, _, err := e.selectServers(speedtest.Servers{near, far, wanted}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	result, subs, err := e.selectServers(speedtest.Servers{near, far})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result) != 1 || result[0].ID != "200" {
+		t.Errorf("expected same-country server '200', got %v", result)
+	}
+	want := substitution{requestedID: "300", actualID: "200"}
+	if len(subs) != 1 || subs[0] != want {
+		t.Errorf("expected substitution %v, got %v", want, subs)
+	}
+}
+
+func TestSelectServers_ClosestInSameCountry_NoneInCountry(t *testing.T) {
+	wanted := newTestServer("300")
+	wanted.Country = "US"
+	other := newTestServer("100")
+	other.Country = "CA"
+	e := NewWithDeps(Config{ServerIDs: []int{300}, FallbackPolicy: FallbackClosestInSameCountry}, &mockClient{}, &mockRunner{})
+
+	if _, _, err := e.selectServers(speedtest.Servers{other, wanted}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, _, err := e.selectServers(speedtest.Servers{other}); err == nil {
+		t.Fatal("expected error when no server in the same country is available")
+	}
+}
+
+func TestCollect_ServerSubstitutedMetric(t *testing.T) {
+	client := &mockClient{
+		user:    newTestUser(),
+		servers: speedtest.Servers{newTestServer("100")},
+	}
+	e := NewWithDeps(Config{ServerIDs: []int{999}, FallbackPolicy: FallbackClosest}, client, newTestRunner())
+
+	metrics := collectMetrics(e)
+
+	m := findMetricByName(metrics, "speedtest_server_substituted")
+	if m == nil {
+		t.Fatal("speedtest_server_substituted metric not found")
+	}
+	labels := make(map[string]string)
+	for _, lp := range metricToDTO(m).GetLabel() {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	if labels["requested_id"] != "999" || labels["actual_id"] != "100" {
+		t.Errorf("unexpected labels %v", labels)
+	}
+}
+
+func TestParseFallbackPolicy(t *testing.T) {
+	for _, valid := range []string{"fail", "skip_missing", "closest", "closest_in_same_country"} {
+		if p, err := ParseFallbackPolicy(valid); err != nil || string(p) != valid {
+			t.Errorf("ParseFallbackPolicy(%q) = %q, %v", valid, p, err)
+		}
+	}
+	if _, err := ParseFallbackPolicy("sometimes"); err == nil {
+		t.Error("expected error for unknown policy")
+	}
+}
+
 func TestCollect_PingFailure(t *testing.T) {
 	client := &mockClient{
 		user:    newTestUser(),
@@ -410,7 +602,7 @@ func TestCollect_PingFailure(t *testing.T) {
 		dlSpeed: 100000000,
 		ulSpeed: 50000000,
 	}
-	e := NewWithDeps([]int{-1}, false, client, runner)
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, client, runner)
 
 	metrics := collectMetrics(e)
 
@@ -439,7 +631,7 @@ func TestCollect_DownloadFailure(t *testing.T) {
 		downloadErr: errors.New("download failed"),
 		ulSpeed:     50000000,
 	}
-	e := NewWithDeps([]int{-1}, false, client, runner)
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, client, runner)
 
 	metrics := collectMetrics(e)
 
@@ -466,7 +658,7 @@ func TestCollect_UploadFailure(t *testing.T) {
 		dlSpeed:   100000000,
 		uploadErr: errors.New("upload failed"),
 	}
-	e := NewWithDeps([]int{-1}, false, client, runner)
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, client, runner)
 
 	metrics := collectMetrics(e)
 
@@ -491,7 +683,7 @@ func TestCollect_MetricLabels(t *testing.T) {
 		servers: speedtest.Servers{server},
 	}
 	runner := newTestRunner()
-	e := NewWithDeps([]int{-1}, false, client, runner)
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, client, runner)
 
 	// Use a registry to gather and inspect metrics with full label detail.
 	reg := prometheus.NewRegistry()
@@ -533,6 +725,9 @@ func TestCollect_MetricLabels(t *testing.T) {
 		"server_name":    "TestServer",
 		"server_country": "US",
 		"distance":       "123",
+		"source":         "",
+		"link":           "",
+		"ip_family":      "",
 	}
 	for k, want := range expectedLabels {
 		if got, exists := labelMap[k]; !exists {
@@ -577,7 +772,7 @@ func TestCollect_ContextCancellation(t *testing.T) {
 	runner := &ctxAwareRunner{
 		mockRunner: *newTestRunner(),
 	}
-	e := NewWithDeps([]int{-1}, false, client, runner)
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail}, client, runner)
 
 	// Create an already-cancelled context.
 	ctx, cancel := context.WithCancel(context.Background())
@@ -623,7 +818,7 @@ func TestCollect_MultipleServers_AllSuccess(t *testing.T) {
 		},
 	}
 	runner := newTestRunner()
-	e := NewWithDeps([]int{100, 200}, false, client, runner)
+	e := NewWithDeps(Config{ServerIDs: []int{100, 200}, FallbackPolicy: FallbackFail}, client, runner)
 
 	metrics := collectMetrics(e)
 
@@ -674,7 +869,7 @@ func TestCollect_MultipleServers_PartialFailure(t *testing.T) {
 			},
 		},
 	}
-	e := NewWithDeps([]int{100, 200}, false, client, runner)
+	e := NewWithDeps(Config{ServerIDs: []int{100, 200}, FallbackPolicy: FallbackFail}, client, runner)
 
 	metrics := collectMetrics(e)
 
@@ -727,3 +922,222 @@ func (p *perServerMockRunner) UploadTest(ctx context.Context, server *speedtest.
 	server.ULSpeed = r.ulSpeed
 	return nil
 }
+
+// concurrencyRunner records how many download phases overlap.
+type concurrencyRunner struct {
+	mockRunner
+	mu      sync.Mutex
+	active  int
+	maxSeen int
+}
+
+func (c *concurrencyRunner) DownloadTest(ctx context.Context, server *speedtest.Server) error {
+	c.mu.Lock()
+	c.active++
+	c.maxSeen = max(c.maxSeen, c.active)
+	c.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	c.mu.Lock()
+	c.active--
+	c.mu.Unlock()
+	return c.mockRunner.DownloadTest(ctx, server)
+}
+
+func TestCollect_Parallel(t *testing.T) {
+	tests := []struct {
+		name           string
+		concurrency    int
+		wantMax        int
+		wantConcurrent float64
+	}{
+		{name: "isolated bandwidth", concurrency: 1, wantMax: 1, wantConcurrent: 0},
+		{name: "limited pool", concurrency: 2, wantMax: 2, wantConcurrent: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &mockClient{
+				user: newTestUser(),
+				servers: speedtest.Servers{
+					newTestServer("100"),
+					newTestServer("200"),
+					newTestServer("300"),
+					newTestServer("400"),
+				},
+			}
+			runner := &concurrencyRunner{mockRunner: *newTestRunner()}
+			cfg := Config{ServerIDs: []int{100, 200, 300, 400}, FallbackPolicy: FallbackFail, Parallel: true, BandwidthConcurrency: tt.concurrency}
+			e := NewWithDeps(cfg, client, runner)
+
+			metrics := collectMetrics(e)
+
+			// 4 servers x 3 metrics + concurrent_measurement + up + scrape_duration = 15
+			if got := len(metrics); got != 15 {
+				t.Fatalf("expected 15 metrics, got %d", got)
+			}
+			if got := metricToDTO(findMetricByName(metrics, "speedtest_up")).GetGauge().GetValue(); got != 1.0 {
+				t.Errorf("expected up=1.0, got %f", got)
+			}
+			concurrent := findMetricByName(metrics, "speedtest_concurrent_measurement")
+			if concurrent == nil {
+				t.Fatal("speedtest_concurrent_measurement metric not found")
+			}
+			if got := metricToDTO(concurrent).GetGauge().GetValue(); got != tt.wantConcurrent {
+				t.Errorf("expected concurrent_measurement=%f, got %f", tt.wantConcurrent, got)
+			}
+			if runner.maxSeen > tt.wantMax {
+				t.Errorf("expected at most %d concurrent downloads, saw %d", tt.wantMax, runner.maxSeen)
+			}
+		})
+	}
+}
+
+func TestCollect_Parallel_PartialFailure(t *testing.T) {
+	client := &mockClient{
+		user: newTestUser(),
+		servers: speedtest.Servers{
+			newTestServer("100"),
+			newTestServer("200"),
+		},
+	}
+	runner := &perServerMockRunner{
+		results: map[string]mockRunner{
+			"100": *newTestRunner(),
+			"200": {uploadErr: errors.New("upload failed")},
+		},
+	}
+	cfg := Config{ServerIDs: []int{100, 200}, FallbackPolicy: FallbackFail, Parallel: true, BandwidthConcurrency: 2}
+	e := NewWithDeps(cfg, client, runner)
+
+	metrics := collectMetrics(e)
+
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_up")).GetGauge().GetValue(); got != 0.0 {
+		t.Errorf("expected up=0.0 for partial failure, got %f", got)
+	}
+}
+
+func TestCollect_PhasesPingOnly(t *testing.T) {
+	client := &mockClient{
+		user:    newTestUser(),
+		servers: speedtest.Servers{newTestServer("100")},
+	}
+	// Bandwidth phases would fail, but they are not requested.
+	runner := &mockRunner{
+		latency:     10 * time.Millisecond,
+		downloadErr: errors.New("download failed"),
+		uploadErr:   errors.New("upload failed"),
+	}
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, FallbackPolicy: FallbackFail, Phases: []Phase{PhasePing}}, client, runner)
+
+	metrics := collectMetrics(e)
+
+	// latency + up + scrape_duration = 3
+	if got := len(metrics); got != 3 {
+		t.Fatalf("expected 3 metrics, got %d", got)
+	}
+	if findMetricByName(metrics, "speedtest_latency_seconds") == nil {
+		t.Fatal("speedtest_latency_seconds metric not found")
+	}
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_up")).GetGauge().GetValue(); got != 1.0 {
+		t.Errorf("expected up=1.0 when only the requested phases succeed, got %f", got)
+	}
+}
+
+func TestCollectPhases_OverridesConfig(t *testing.T) {
+	client := &mockClient{
+		user:    newTestUser(),
+		servers: speedtest.Servers{newTestServer("100"), newTestServer("200")},
+	}
+	cfg := Config{ServerIDs: []int{100, 200}, FallbackPolicy: FallbackFail, Parallel: true, BandwidthConcurrency: 2}
+	e := NewWithDeps(cfg, client, newTestRunner())
+
+	ch := make(chan prometheus.Metric, 100)
+	e.CollectPhases(context.Background(), []Phase{PhaseDownload}, ch)
+	close(ch)
+
+	var metrics []prometheus.Metric
+	for m := range ch {
+		metrics = append(metrics, m)
+	}
+
+	if got := len(findAllMetricsByName(metrics, "speedtest_download_speed_bytes_per_second")); got != 2 {
+		t.Errorf("expected 2 download metrics, got %d", got)
+	}
+	if findMetricByName(metrics, "speedtest_latency_seconds") != nil {
+		t.Error("latency metric emitted although ping was not requested")
+	}
+	if findMetricByName(metrics, "speedtest_upload_speed_bytes_per_second") != nil {
+		t.Error("upload metric emitted although upload was not requested")
+	}
+}
+
+func TestPhases_DefaultsToAll(t *testing.T) {
+	e := NewWithDeps(Config{ServerIDs: []int{-1}}, &mockClient{}, &mockRunner{})
+	if got := e.Phases(); len(got) != len(AllPhases) {
+		t.Errorf("expected all phases, got %v", got)
+	}
+}
+
+func TestParsePhases(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []Phase
+		wantErr bool
+	}{
+		{name: "single", input: "ping", want: []Phase{PhasePing}},
+		{name: "all with spaces", input: "ping, download ,upload", want: AllPhases},
+		{name: "empty", input: "", wantErr: true},
+		{name: "unknown", input: "ping,jitter", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePhases(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCollect_SourceLabel(t *testing.T) {
+	client := &mockClient{
+		user:    newTestUser(),
+		servers: speedtest.Servers{newTestServer("100")},
+	}
+	cfg := Config{ServerIDs: []int{-1}, SourceAddress: "192.0.2.10", Interface: "wan1"}
+	e := NewWithDeps(cfg, client, newTestRunner())
+
+	metrics := collectMetrics(e)
+
+	dl := findMetricByName(metrics, "speedtest_download_speed_bytes_per_second")
+	if dl == nil {
+		t.Fatal("speedtest_download_speed_bytes_per_second metric not found")
+	}
+	for _, lp := range metricToDTO(dl).GetLabel() {
+		if lp.GetName() == "source" && lp.GetValue() != "192.0.2.10%wan1" {
+			t.Errorf("expected source label 192.0.2.10%%wan1, got %q", lp.GetValue())
+		}
+	}
+}
+
+func TestConfig_ValidateLinks(t *testing.T) {
+	if err := (Config{SourceAddress: "2001:db8::1"}).ValidateLinks(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (Config{SourceAddress: "not-an-ip"}).ValidateLinks(); err == nil {
+		t.Error("expected error for invalid source address")
+	}
+}
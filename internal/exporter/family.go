@@ -0,0 +1,74 @@
+package exporter
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// IPFamily restricts test traffic to IPv4 or IPv6.
+type IPFamily string
+
+const (
+	// IPFamilyAny leaves the choice to the resolver and dialer.
+	IPFamilyAny IPFamily = ""
+	// IPv4 only connects over IPv4.
+	IPv4 IPFamily = "4"
+	// IPv6 only connects over IPv6.
+	IPv6 IPFamily = "6"
+	// IPFamilyBoth runs the test once over each family.
+	IPFamilyBoth IPFamily = "both"
+)
+
+// ParseIPFamily validates s and returns the matching IPFamily.
+func ParseIPFamily(s string) (IPFamily, error) {
+	switch f := IPFamily(s); f {
+	case IPFamilyAny, IPv4, IPv6, IPFamilyBoth:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown ip_family %q, use 4, 6 or both", s)
+}
+
+// families returns the families a run tests, in order.
+func (f IPFamily) families() []IPFamily {
+	if f == IPFamilyBoth {
+		return []IPFamily{IPv4, IPv6}
+	}
+	return []IPFamily{f}
+}
+
+// network narrows a dial or lookup network such as "tcp" or "ip" to the family.
+func (f IPFamily) network(network string) string {
+	switch f {
+	case IPv4:
+		return network + "4"
+	case IPv6:
+		return network + "6"
+	}
+	return network
+}
+
+// ValidateIPFamily checks the ip_family setting against the source addresses,
+// which can only send traffic of their own family.
+func (c Config) ValidateIPFamily() error {
+	if _, err := ParseIPFamily(string(c.IPFamily)); err != nil {
+		return err
+	}
+	for _, link := range c.links() {
+		addr, err := netip.ParseAddr(link.SourceAddress)
+		if err != nil {
+			continue
+		}
+		if want := addrFamily(addr); c.IPFamily != IPFamilyAny && c.IPFamily != want {
+			return fmt.Errorf("source_address %s can't be used with ip_family %q", link.SourceAddress, c.IPFamily)
+		}
+	}
+	return nil
+}
+
+// addrFamily returns the IP family of addr.
+func addrFamily(addr netip.Addr) IPFamily {
+	if addr.Unmap().Is4() {
+		return IPv4
+	}
+	return IPv6
+}
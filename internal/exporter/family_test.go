@@ -0,0 +1,146 @@
+package exporter
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+func TestParseIPFamily(t *testing.T) {
+	for _, valid := range []string{"", "4", "6", "both"} {
+		if _, err := ParseIPFamily(valid); err != nil {
+			t.Errorf("%q: unexpected error: %v", valid, err)
+		}
+	}
+	if _, err := ParseIPFamily("ipv4"); err == nil {
+		t.Error("expected an error for ipv4")
+	}
+}
+
+func TestIPFamily_Network(t *testing.T) {
+	tests := []struct {
+		family IPFamily
+		want   string
+	}{
+		{IPFamilyAny, "tcp"},
+		{IPv4, "tcp4"},
+		{IPv6, "tcp6"},
+	}
+	for _, tt := range tests {
+		if got := tt.family.network("tcp"); got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.family, tt.want, got)
+		}
+	}
+}
+
+func TestNewHTTPClient_IPFamily(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+
+	meters := newTrafficMeters(net.DefaultResolver, IPv4)
+	resp, err := newHTTPClient(Config{}, Link{}, IPv4, meters).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error over IPv4: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	// The test server only listens on 127.0.0.1.
+	if _, err := newHTTPClient(Config{}, Link{}, IPv6, newTrafficMeters(net.DefaultResolver, IPv6)).Get(srv.URL); err == nil {
+		t.Error("expected IPv6 to fail against an IPv4 address")
+	}
+}
+
+func TestConfig_ValidateIPFamily(t *testing.T) {
+	valid := []Config{
+		{IPFamily: IPFamilyBoth},
+		{IPFamily: IPv4, SourceAddress: "192.0.2.10"},
+		{IPFamily: IPv6, Links: []Link{{Name: "wan", SourceAddress: "2001:db8::1"}}},
+	}
+	for _, cfg := range valid {
+		if err := cfg.ValidateIPFamily(); err != nil {
+			t.Errorf("%+v: unexpected error: %v", cfg, err)
+		}
+	}
+
+	invalid := []Config{
+		{IPFamily: "ipv6"},
+		{IPFamily: IPv6, SourceAddress: "192.0.2.10"},
+		{IPFamily: IPFamilyBoth, Links: []Link{{Name: "wan", SourceAddress: "2001:db8::1"}}},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.ValidateIPFamily(); err == nil {
+			t.Errorf("%+v: expected an error", cfg)
+		}
+	}
+}
+
+func TestCollect_BothIPFamilies(t *testing.T) {
+	newClient := func() SpeedtestClient {
+		return newTestClient(newTestServer("100"))
+	}
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, IPFamily: IPFamilyBoth}, nil, nil)
+	e.newSession = func(_ Link, family IPFamily) (SpeedtestClient, ServerRunner) {
+		if family == IPv6 {
+			return &mockClient{userErr: errors.New("network is unreachable")}, nil
+		}
+		return newClient(), newTestRunner()
+	}
+
+	metrics := collectMetrics(e)
+
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_up")).GetGauge().GetValue(); got != 1 {
+		t.Errorf("expected speedtest_up 1 when only IPv6 fails, got %v", got)
+	}
+	v6 := findMetricByName(metrics, "speedtest_ipv6_available")
+	if v6 == nil {
+		t.Fatal("speedtest_ipv6_available metric not found")
+	}
+	if got := metricToDTO(v6).GetGauge().GetValue(); got != 0 {
+		t.Errorf("expected speedtest_ipv6_available 0, got %v", got)
+	}
+	for _, m := range findAllMetricsByName(metrics, "speedtest_latency_seconds") {
+		if got := labelValue(m, "ip_family"); got != "4" {
+			t.Errorf("expected ip_family label 4, got %q", got)
+		}
+	}
+}
+
+func TestGather_BothIPFamiliesSubstitutedInParallel(t *testing.T) {
+	cfg := Config{
+		ServerIDs:            []int{999, 101},
+		FallbackPolicy:       FallbackClosest,
+		Parallel:             true,
+		BandwidthConcurrency: 2,
+		IPFamily:             IPFamilyBoth,
+	}
+	e := NewWithDeps(cfg, nil, nil)
+	e.newSession = func(Link, IPFamily) (SpeedtestClient, ServerRunner) {
+		return &mockClient{user: newTestUser(), servers: speedtest.Servers{newTestServer("100"), newTestServer("101")}}, newTestRunner()
+	}
+
+	families := gatherMetrics(t, e)
+
+	for _, name := range []string{"speedtest_server_substituted", "speedtest_concurrent_measurement"} {
+		if n := familySize(families, name); n != 2 {
+			t.Errorf("expected %s once per IP family, got %d", name, n)
+		}
+	}
+}
+
+func TestCollect_IPv6Only(t *testing.T) {
+	client := newTestClient(newTestServer("100"))
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, IPFamily: IPv6}, client, newTestRunner())
+
+	metrics := collectMetrics(e)
+
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_ipv6_available")).GetGauge().GetValue(); got != 1 {
+		t.Errorf("expected speedtest_ipv6_available 1, got %v", got)
+	}
+	if got := labelValue(findMetricByName(metrics, "speedtest_download_speed_bytes_per_second"), "ip_family"); got != "6" {
+		t.Errorf("expected ip_family label 6, got %q", got)
+	}
+}
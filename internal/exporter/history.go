@@ -0,0 +1,73 @@
+package exporter
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultHistorySize is how many run results an exporter keeps by default.
+const DefaultHistorySize = 100
+
+// history is a ring buffer holding the last results of an exporter.
+type history struct {
+	mu      sync.Mutex
+	results []Result
+	// next is where the next result goes; once the buffer is full it also
+	// holds the oldest result.
+	next int
+	full bool
+}
+
+func newHistory(size int) *history {
+	return &history{results: make([]Result, max(size, 1))}
+}
+
+// add keeps r, replacing the oldest result once the buffer is full.
+func (h *history) add(r Result) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.results[h.next] = r
+	h.next = (h.next + 1) % len(h.results)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// latest returns the newest result.
+func (h *history) latest() (Result, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.full && h.next == 0 {
+		return Result{}, false
+	}
+	return h.results[(h.next-1+len(h.results))%len(h.results)], true
+}
+
+// since returns the results of runs that started at or after t, oldest first.
+func (h *history) since(t time.Time) []Result {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	results := []Result{}
+	add := func(rs []Result) {
+		for _, r := range rs {
+			if !r.Start.Before(t) {
+				results = append(results, r)
+			}
+		}
+	}
+	if h.full {
+		add(h.results[h.next:])
+	}
+	add(h.results[:h.next])
+	return results
+}
+
+// SetHistorySize makes the exporter keep the last size run results, keeping
+// the newest of those it already has.
+func (e *Exporter) SetHistorySize(size int) {
+	h := newHistory(size)
+	for _, r := range e.history.since(time.Time{}) {
+		h.add(r)
+	}
+	e.history = h
+}
@@ -0,0 +1,66 @@
+package exporter
+
+import (
+	"testing"
+	"time"
+)
+
+var historyStart = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// addMinutes adds n results started one minute apart from historyStart.
+func addMinutes(h *history, from, n int) {
+	for i := from; i < from+n; i++ {
+		h.add(Result{Start: historyStart.Add(time.Duration(i) * time.Minute)})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	h := newHistory(3)
+	if _, ok := h.latest(); ok {
+		t.Fatal("unexpected result in an empty history")
+	}
+	if got := h.since(time.Time{}); got == nil || len(got) != 0 {
+		t.Errorf("expected an empty non-nil slice, got %#v", got)
+	}
+
+	addMinutes(h, 0, 2)
+	if got := h.since(time.Time{}); len(got) != 2 || !got[0].Start.Equal(historyStart) {
+		t.Errorf("unexpected results %v", got)
+	}
+
+	addMinutes(h, 2, 3)
+	got := h.since(time.Time{})
+	if len(got) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(got))
+	}
+	for i, r := range got {
+		if want := historyStart.Add(time.Duration(i+2) * time.Minute); !r.Start.Equal(want) {
+			t.Errorf("index %d: expected %v, got %v", i, want, r.Start)
+		}
+	}
+	if latest, _ := h.latest(); !latest.Start.Equal(historyStart.Add(4 * time.Minute)) {
+		t.Errorf("unexpected latest result %v", latest.Start)
+	}
+	if got := h.since(historyStart.Add(3 * time.Minute)); len(got) != 2 {
+		t.Errorf("expected 2 results since minute 3, got %d", len(got))
+	}
+}
+
+func TestExporter_SetHistorySize(t *testing.T) {
+	e := NewWithDeps(Config{}, nil, nil)
+	addMinutes(e.history, 0, 5)
+
+	e.SetHistorySize(2)
+
+	got := e.Results(time.Time{})
+	if len(got) != 2 || !got[0].Start.Equal(historyStart.Add(3*time.Minute)) {
+		t.Errorf("expected the 2 newest results to be kept, got %v", got)
+	}
+	addMinutes(e.history, 5, 1)
+	if latest, _ := e.LatestResult(); !latest.Start.Equal(historyStart.Add(5 * time.Minute)) {
+		t.Errorf("unexpected latest result %v", latest.Start)
+	}
+	if got := e.Results(time.Time{}); len(got) != 2 {
+		t.Errorf("expected 2 results, got %d", len(got))
+	}
+}
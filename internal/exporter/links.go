@@ -0,0 +1,158 @@
+package exporter
+
+import (
+	"fmt"
+	"net/netip"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// Link is one uplink of a multi-WAN module. Its test traffic leaves the host
+// from its own source address or interface.
+type Link struct {
+	// Name identifies the link in the link label.
+	Name string `yaml:"name"`
+	// SourceAddress is the local IP address the link's traffic is sent from.
+	SourceAddress string `yaml:"source_address"`
+	// Interface is the network interface the link's traffic is bound to (Linux only).
+	Interface string `yaml:"interface"`
+	// ContractDownload and ContractUpload are the speeds sold for the link in
+	// bytes per second. Zero means unknown.
+	ContractDownload float64 `yaml:"contract_download_bytes_per_second"`
+	ContractUpload   float64 `yaml:"contract_upload_bytes_per_second"`
+}
+
+// Source describes where test traffic leaves the host, for the source label.
+func (l Link) Source() string {
+	switch {
+	case l.SourceAddress != "" && l.Interface != "":
+		return l.SourceAddress + "%" + l.Interface
+	case l.Interface != "":
+		return l.Interface
+	}
+	return l.SourceAddress
+}
+
+// validate checks the source address, interface and contract speeds.
+func (l Link) validate() error {
+	if l.SourceAddress != "" {
+		if _, err := netip.ParseAddr(l.SourceAddress); err != nil {
+			return fmt.Errorf("invalid source_address: %w", err)
+		}
+	}
+	if l.Interface != "" && !bindToDeviceSupported {
+		return fmt.Errorf("binding to an interface is not supported on this platform")
+	}
+	if l.ContractDownload < 0 || l.ContractUpload < 0 {
+		return fmt.Errorf("contract speeds must not be negative")
+	}
+	return nil
+}
+
+// linkRun holds what the tests of one link and IP family share during a run.
+type linkRun struct {
+	link   Link
+	family IPFamily
+	runner ServerRunner
+	user   *speedtest.User
+	ch     chan<- prometheus.Metric
+	rec    *runRecorder
+}
+
+// labelValues returns the common label values for speedtest metrics.
+func (r *linkRun) labelValues(server *speedtest.Server) []string {
+	return []string{
+		r.user.Lat,
+		r.user.Lon,
+		r.user.IP,
+		r.user.Isp,
+		server.Lat,
+		server.Lon,
+		server.ID,
+		server.Name,
+		server.Country,
+		fmt.Sprintf("%.0f", server.Distance),
+		r.link.Source(),
+		r.link.Name,
+		string(r.family),
+	}
+}
+
+// linkScore is the best result a link achieved against any of its servers.
+type linkScore struct {
+	download speedtest.ByteRate
+	latency  float64
+}
+
+// scoreLink returns the highest download speed and lowest latency measured
+// against targets. Phases that were not run leave their field at zero.
+func scoreLink(targets speedtest.Servers) linkScore {
+	var s linkScore
+	for _, server := range targets {
+		s.download = max(s.download, server.DLSpeed)
+		if lat := server.Latency.Seconds(); lat > 0 && (s.latency == 0 || lat < s.latency) {
+			s.latency = lat
+		}
+	}
+	return s
+}
+
+// beats reports whether s is better than o: a higher download speed wins, and
+// latency only decides when neither measured a download.
+func (s linkScore) beats(o linkScore) bool {
+	if s.download > 0 || o.download > 0 {
+		return s.download > o.download
+	}
+	return s.latency > 0 && (o.latency == 0 || s.latency < o.latency)
+}
+
+// bestLink returns the link with the highest download speed or, when no
+// download was measured, the lowest latency. Ties go to the link listed
+// first. It returns "" when no link has a result.
+func bestLink(links []Link, scores map[string]linkScore) string {
+	best := ""
+	var top linkScore
+	for _, link := range links {
+		s, ok := scores[link.Name]
+		if ok && s.beats(top) {
+			best, top = link.Name, s
+		}
+	}
+	return best
+}
+
+// collectLink exports the state and contract speeds of a link.
+func collectLink(link Link, ok bool, ch chan<- prometheus.Metric) {
+	upVal := 0.0
+	if ok {
+		upVal = 1.0
+	}
+	ch <- prometheus.MustNewConstMetric(linkUp, prometheus.GaugeValue, upVal, link.Name)
+
+	if link.ContractDownload > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			linkContractBytesPerSecond, prometheus.GaugeValue, link.ContractDownload, link.Name, "download",
+		)
+	}
+	if link.ContractUpload > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			linkContractBytesPerSecond, prometheus.GaugeValue, link.ContractUpload, link.Name, "upload",
+		)
+	}
+}
+
+// collectBestLink exports which link did best, if any produced a result.
+func collectBestLink(links []Link, scores map[string]linkScore, ch chan<- prometheus.Metric) {
+	best := bestLink(links, scores)
+	if best == "" {
+		return
+	}
+	for _, link := range links {
+		v := 0.0
+		if link.Name == best {
+			v = 1.0
+		}
+		ch <- prometheus.MustNewConstMetric(linkBest, prometheus.GaugeValue, v, link.Name)
+	}
+}
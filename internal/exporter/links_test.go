@@ -0,0 +1,208 @@
+package exporter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// labelValue returns the value of the named label of m.
+func labelValue(m prometheus.Metric, name string) string {
+	for _, lp := range metricToDTO(m).GetLabel() {
+		if lp.GetName() == name {
+			return lp.GetValue()
+		}
+	}
+	return ""
+}
+
+// newLinkExporter returns an exporter whose sessions use the client and
+// runner given for each link name.
+func newLinkExporter(cfg Config, clients map[string]SpeedtestClient, runners map[string]ServerRunner) *Exporter {
+	e := NewWithDeps(cfg, nil, nil)
+	e.newSession = func(link Link, _ IPFamily) (SpeedtestClient, ServerRunner) {
+		return clients[link.Name], runners[link.Name]
+	}
+	return e
+}
+
+func TestCollect_Links(t *testing.T) {
+	newClient := func() SpeedtestClient {
+		return newTestClient(newTestServer("100"))
+	}
+	cfg := Config{
+		ServerIDs: []int{-1},
+		Links: []Link{
+			{Name: "fiber", SourceAddress: "192.0.2.10", ContractDownload: 125e6, ContractUpload: 12.5e6},
+			{Name: "lte", Interface: "wwan0"},
+		},
+	}
+	e := newLinkExporter(cfg,
+		map[string]SpeedtestClient{"fiber": newClient(), "lte": newClient()},
+		map[string]ServerRunner{
+			"fiber": &mockRunner{latency: 5 * time.Millisecond, dlSpeed: 100e6, ulSpeed: 10e6},
+			"lte":   &mockRunner{latency: 40 * time.Millisecond, dlSpeed: 20e6, ulSpeed: 5e6},
+		},
+	)
+
+	metrics := collectMetrics(e)
+
+	downloads := findAllMetricsByName(metrics, "speedtest_download_speed_bytes_per_second")
+	if len(downloads) != 2 {
+		t.Fatalf("expected 2 download metrics, got %d", len(downloads))
+	}
+	sources := map[string]string{"fiber": "192.0.2.10", "lte": "wwan0"}
+	for _, m := range downloads {
+		link := labelValue(m, "link")
+		if got := labelValue(m, "source"); got != sources[link] {
+			t.Errorf("link %q: expected source %q, got %q", link, sources[link], got)
+		}
+	}
+
+	for _, m := range findAllMetricsByName(metrics, "speedtest_link_up") {
+		if got := metricToDTO(m).GetGauge().GetValue(); got != 1 {
+			t.Errorf("link %q: expected link_up 1, got %v", labelValue(m, "link"), got)
+		}
+	}
+
+	contracts := findAllMetricsByName(metrics, "speedtest_link_contract_bytes_per_second")
+	if len(contracts) != 2 {
+		t.Fatalf("expected 2 contract metrics, got %d", len(contracts))
+	}
+	for _, m := range contracts {
+		if labelValue(m, "link") != "fiber" {
+			t.Errorf("unexpected contract metric for link %q", labelValue(m, "link"))
+		}
+	}
+
+	best := findAllMetricsByName(metrics, "speedtest_link_best")
+	if len(best) != 2 {
+		t.Fatalf("expected 2 link_best metrics, got %d", len(best))
+	}
+	for _, m := range best {
+		want := 0.0
+		if labelValue(m, "link") == "fiber" {
+			want = 1.0
+		}
+		if got := metricToDTO(m).GetGauge().GetValue(); got != want {
+			t.Errorf("link %q: expected link_best %v, got %v", labelValue(m, "link"), want, got)
+		}
+	}
+}
+
+func TestCollect_LinkFailure(t *testing.T) {
+	cfg := Config{
+		ServerIDs: []int{-1},
+		Links:     []Link{{Name: "fiber"}, {Name: "lte"}},
+	}
+	e := newLinkExporter(cfg,
+		map[string]SpeedtestClient{
+			"fiber": &mockClient{userErr: errors.New("link down")},
+			"lte":   newTestClient(newTestServer("100")),
+		},
+		map[string]ServerRunner{"lte": newTestRunner()},
+	)
+
+	metrics := collectMetrics(e)
+
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_up")).GetGauge().GetValue(); got != 0 {
+		t.Errorf("expected speedtest_up 0 when a link fails, got %v", got)
+	}
+	for _, m := range findAllMetricsByName(metrics, "speedtest_link_up") {
+		want := 1.0
+		if labelValue(m, "link") == "fiber" {
+			want = 0
+		}
+		if got := metricToDTO(m).GetGauge().GetValue(); got != want {
+			t.Errorf("link %q: expected link_up %v, got %v", labelValue(m, "link"), want, got)
+		}
+	}
+	for _, m := range findAllMetricsByName(metrics, "speedtest_link_best") {
+		if labelValue(m, "link") == "lte" && metricToDTO(m).GetGauge().GetValue() != 1 {
+			t.Error("expected the working link to be best")
+		}
+	}
+}
+
+func TestCollect_NoLinkMetricsWithoutLinks(t *testing.T) {
+	client := newTestClient(newTestServer("100"))
+	e := NewWithDeps(Config{ServerIDs: []int{-1}}, client, newTestRunner())
+
+	metrics := collectMetrics(e)
+
+	for _, name := range []string{"speedtest_link_up", "speedtest_link_contract_bytes_per_second", "speedtest_link_best"} {
+		if findMetricByName(metrics, name) != nil {
+			t.Errorf("unexpected %s without links", name)
+		}
+	}
+}
+
+func TestBestLink(t *testing.T) {
+	links := []Link{{Name: "a"}, {Name: "b"}}
+	tests := []struct {
+		name   string
+		scores map[string]linkScore
+		want   string
+	}{
+		{"highest download", map[string]linkScore{"a": {download: 10, latency: 0.001}, "b": {download: 20, latency: 0.05}}, "b"},
+		{"lowest latency without downloads", map[string]linkScore{"a": {latency: 0.03}, "b": {latency: 0.01}}, "b"},
+		{"tie goes to the first link", map[string]linkScore{"a": {download: 10}, "b": {download: 10}}, "a"},
+		{"only one result", map[string]linkScore{"b": {latency: 0.02}}, "b"},
+		{"no results", map[string]linkScore{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bestLink(links, tt.scores); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidateLinks_Errors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"missing name", Config{Links: []Link{{SourceAddress: "192.0.2.10"}}}},
+		{"duplicate name", Config{Links: []Link{{Name: "wan"}, {Name: "wan"}}}},
+		{"module source with links", Config{SourceAddress: "192.0.2.10", Links: []Link{{Name: "wan"}}}},
+		{"invalid link source", Config{Links: []Link{{Name: "wan", SourceAddress: "nope"}}}},
+		{"negative contract", Config{Links: []Link{{Name: "wan", ContractDownload: -1}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.ValidateLinks(); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestGather_LinksSubstitutedInParallel(t *testing.T) {
+	newClient := func() SpeedtestClient {
+		return &mockClient{user: newTestUser(), servers: speedtest.Servers{newTestServer("100"), newTestServer("101")}}
+	}
+	cfg := Config{
+		ServerIDs:            []int{999, 101},
+		FallbackPolicy:       FallbackClosest,
+		Parallel:             true,
+		BandwidthConcurrency: 2,
+		Links:                []Link{{Name: "fiber"}, {Name: "lte"}},
+	}
+	e := newLinkExporter(cfg,
+		map[string]SpeedtestClient{"fiber": newClient(), "lte": newClient()},
+		map[string]ServerRunner{"fiber": newTestRunner(), "lte": newTestRunner()},
+	)
+
+	families := gatherMetrics(t, e)
+
+	for _, name := range []string{"speedtest_server_substituted", "speedtest_concurrent_measurement"} {
+		if n := familySize(families, name); n != 2 {
+			t.Errorf("expected %s once per link, got %d", name, n)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/probe"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// PathMTUConfig controls the path MTU discovery to each selected server.
+type PathMTUConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ProbeTimeout is how long to wait for the answer to each probe, 0 means 1s.
+	ProbeTimeout time.Duration `yaml:"probe_timeout"`
+}
+
+// Validate checks the settings and that probing works on this platform.
+func (m PathMTUConfig) Validate() error {
+	if !m.Enabled {
+		return nil
+	}
+	if !probe.Supported {
+		return probe.ErrUnsupported
+	}
+	if m.ProbeTimeout < 0 {
+		return fmt.Errorf("path_mtu probe_timeout must not be negative")
+	}
+	return nil
+}
+
+// MaxDuration is the longest the discovery for one server can take.
+func (m PathMTUConfig) MaxDuration() time.Duration {
+	timeout := m.ProbeTimeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	return 2 * probe.MaxMTUProbes * timeout
+}
+
+// discoverMTUs finds the path MTU to every target and exports it. A failed
+// discovery is logged, but does not fail the run.
+func (e *Exporter) discoverMTUs(ctx context.Context, r *linkRun, targets speedtest.Servers) {
+	opts := r.probeOptions()
+	opts.Timeout = e.cfg.PathMTU.ProbeTimeout
+	for _, server := range targets {
+		_, dst, err := e.serverIP(ctx, r, server)
+		if err != nil {
+			slog.Error("failed to discover path MTU to server", "server_id", server.ID, "link", r.link.Name, "error", err)
+			continue
+		}
+		mtu, err := e.pathMTU(ctx, dst, opts)
+		if err != nil {
+			slog.Error("failed to discover path MTU to server", "server_id", server.ID, "link", r.link.Name, "error", err)
+			continue
+		}
+		r.ch <- prometheus.MustNewConstMetric(
+			pathMTUBytes, prometheus.GaugeValue, float64(mtu),
+			r.labelValues(server)...,
+		)
+	}
+}
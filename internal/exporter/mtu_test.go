@@ -0,0 +1,79 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/probe"
+)
+
+func TestCollect_PathMTU(t *testing.T) {
+	var gotDst netip.Addr
+	var gotOpts probe.Options
+	cfg := Config{ServerIDs: []int{-1}, PathMTU: PathMTUConfig{Enabled: true, ProbeTimeout: 200 * time.Millisecond}}
+	e := NewWithDeps(cfg, newTestClient(newTestServer("100")), newTestRunner())
+	e.pathMTU = func(_ context.Context, dst netip.Addr, opts probe.Options) (int, error) {
+		gotDst, gotOpts = dst, opts
+		return 1492, nil
+	}
+
+	metrics := collectMetrics(e)
+
+	if gotDst != netip.MustParseAddr("192.0.2.1") || gotOpts.Timeout != 200*time.Millisecond {
+		t.Errorf("unexpected probe of %v with %+v", gotDst, gotOpts)
+	}
+	m := findMetricByName(metrics, "speedtest_path_mtu_bytes")
+	if m == nil {
+		t.Fatal("expected speedtest_path_mtu_bytes")
+	}
+	if got := metricToDTO(m).GetGauge().GetValue(); got != 1492 {
+		t.Errorf("expected 1492, got %v", got)
+	}
+	if labelValue(m, "server_id") != "100" {
+		t.Errorf("unexpected labels %v", metricToDTO(m).GetLabel())
+	}
+}
+
+func TestCollect_PathMTUFailure(t *testing.T) {
+	cfg := Config{ServerIDs: []int{-1}, PathMTU: PathMTUConfig{Enabled: true, ProbeTimeout: 200 * time.Millisecond}}
+	e := NewWithDeps(cfg, newTestClient(newTestServer("100")), newTestRunner())
+	e.pathMTU = func(context.Context, netip.Addr, probe.Options) (int, error) {
+		return 0, errors.New("no answer to MTU probes of the minimum size")
+	}
+
+	metrics := collectMetrics(e)
+
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_up")).GetGauge().GetValue(); got != 1 {
+		t.Errorf("expected a failed discovery not to fail the run, got up=%v", got)
+	}
+	if findMetricByName(metrics, "speedtest_path_mtu_bytes") != nil {
+		t.Error("unexpected speedtest_path_mtu_bytes after a failed discovery")
+	}
+}
+
+func TestPathMTUConfig_Validate(t *testing.T) {
+	if err := (PathMTUConfig{}).Validate(); err != nil {
+		t.Errorf("unexpected error for a disabled discovery: %v", err)
+	}
+	if !probe.Supported {
+		if err := (PathMTUConfig{Enabled: true}).Validate(); err == nil {
+			t.Error("expected an error on an unsupported platform")
+		}
+		return
+	}
+	if err := (PathMTUConfig{Enabled: true}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (PathMTUConfig{Enabled: true, ProbeTimeout: -time.Second}).Validate(); err == nil {
+		t.Error("expected an error for a negative probe_timeout")
+	}
+}
+
+func TestPathMTUConfig_MaxDuration(t *testing.T) {
+	if got, want := (PathMTUConfig{}).MaxDuration(), 2*probe.MaxMTUProbes*time.Second; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
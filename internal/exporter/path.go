@@ -0,0 +1,191 @@
+package exporter
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/cacack/speedtest_exporter/internal/probe"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// PathProbeConfig controls the traceroute run to each selected server.
+type PathProbeConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxHops is the highest TTL probed, 0 means 30.
+	MaxHops int `yaml:"max_hops"`
+	// HopTimeout is how long to wait for each hop, 0 means 1s.
+	HopTimeout time.Duration `yaml:"hop_timeout"`
+}
+
+// Validate checks the settings and that tracing works on this platform.
+func (p PathProbeConfig) Validate() error {
+	if !p.Enabled {
+		return nil
+	}
+	if !probe.Supported {
+		return probe.ErrUnsupported
+	}
+	if p.MaxHops < 0 || p.MaxHops > 255 {
+		return fmt.Errorf("path_probe max_hops must be between 0 and 255")
+	}
+	if p.HopTimeout < 0 {
+		return fmt.Errorf("path_probe hop_timeout must not be negative")
+	}
+	return nil
+}
+
+// MaxDuration is the longest a trace to one server can take.
+func (p PathProbeConfig) MaxDuration() time.Duration {
+	hops, timeout := p.MaxHops, p.HopTimeout
+	if hops == 0 {
+		hops = 30
+	}
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	return time.Duration(hops) * timeout
+}
+
+// PathTrace is the last traced path to a server.
+type PathTrace struct {
+	ServerID   string      `json:"server_id"`
+	ServerName string      `json:"server_name"`
+	Host       string      `json:"host"`
+	Link       string      `json:"link,omitempty"`
+	IPFamily   IPFamily    `json:"ip_family,omitempty"`
+	Time       time.Time   `json:"time"`
+	Error      string      `json:"error,omitempty"`
+	Path       *probe.Path `json:"path,omitempty"`
+}
+
+// traceKey identifies the traces replaced by each run of a link and family.
+type traceKey struct {
+	link   string
+	family IPFamily
+}
+
+// LastTraces returns the most recent path traces of every link and family.
+func (e *Exporter) LastTraces() []PathTrace {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	traces := []PathTrace{}
+	for _, t := range e.traces {
+		traces = append(traces, t...)
+	}
+	slices.SortStableFunc(traces, func(a, b PathTrace) int {
+		return cmp.Or(cmp.Compare(a.Link, b.Link), cmp.Compare(a.IPFamily, b.IPFamily))
+	})
+	return traces
+}
+
+// tracePaths traces the route to every target and exports the result. A
+// failed trace is logged and recorded, but does not fail the run.
+func (e *Exporter) tracePaths(ctx context.Context, r *linkRun, targets speedtest.Servers) {
+	opts := r.probeOptions()
+	opts.MaxHops = e.cfg.PathProbe.MaxHops
+	opts.Timeout = e.cfg.PathProbe.HopTimeout
+
+	var traces []PathTrace
+	for _, server := range targets {
+		t := PathTrace{
+			ServerID:   server.ID,
+			ServerName: server.Name,
+			Link:       r.link.Name,
+			IPFamily:   r.family,
+			Time:       time.Now(),
+		}
+		path, err := e.tracePath(ctx, r, server, &t, opts)
+		if err != nil {
+			slog.Error("failed to trace path to server", "server_id", server.ID, "link", r.link.Name, "error", err)
+			t.Error = err.Error()
+		} else {
+			t.Path = path
+			collectPath(r, server, path)
+		}
+		traces = append(traces, t)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.traces[traceKey{link: r.link.Name, family: r.family}] = traces
+}
+
+func (e *Exporter) tracePath(ctx context.Context, r *linkRun, server *speedtest.Server, t *PathTrace, opts probe.Options) (*probe.Path, error) {
+	host, dst, err := e.serverIP(ctx, r, server)
+	t.Host = host
+	if err != nil {
+		return nil, err
+	}
+	return e.traceroute(ctx, dst, opts)
+}
+
+// serverIP returns the host of the server's URL and its address, resolved
+// like the test traffic when the host is a name. Only addresses of the family
+// the test traffic can use are considered.
+func (e *Exporter) serverIP(ctx context.Context, r *linkRun, server *speedtest.Server) (string, netip.Addr, error) {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		return "", netip.Addr{}, err
+	}
+	host := u.Hostname()
+	if dst, err := netip.ParseAddr(host); err == nil {
+		return host, dst, nil
+	}
+	addrs, err := newResolver(e.cfg, r.link).LookupNetIP(ctx, r.dialFamily().network("ip"), host)
+	if err != nil {
+		return host, netip.Addr{}, err
+	}
+	if len(addrs) == 0 {
+		return host, netip.Addr{}, fmt.Errorf("no addresses for %s", host)
+	}
+	return host, addrs[0], nil
+}
+
+// dialFamily returns the IP family the test traffic of r connects with: the
+// run's own, or that of the link's source address, which can only reach
+// addresses of its family. It is IPFamilyAny when either may be used.
+func (r *linkRun) dialFamily() IPFamily {
+	if addr, err := netip.ParseAddr(r.link.SourceAddress); err == nil {
+		return addrFamily(addr)
+	}
+	return r.family
+}
+
+// probeOptions returns the probe options that send probes from the link's
+// source.
+func (r *linkRun) probeOptions() probe.Options {
+	opts := probe.Options{Interface: r.link.Interface}
+	if addr, err := netip.ParseAddr(r.link.SourceAddress); err == nil {
+		opts.Source = addr
+	}
+	return opts
+}
+
+// collectPath exports the hop count, whether the server answered and the
+// round-trip time of every hop that did.
+func collectPath(r *linkRun, server *speedtest.Server, path *probe.Path) {
+	labels := r.labelValues(server)
+	reached := 0.0
+	if path.Reached {
+		reached = 1.0
+	}
+	r.ch <- prometheus.MustNewConstMetric(pathHops, prometheus.GaugeValue, float64(len(path.Hops)), labels...)
+	r.ch <- prometheus.MustNewConstMetric(pathReached, prometheus.GaugeValue, reached, labels...)
+	for _, hop := range path.Hops {
+		if !hop.Responded() {
+			continue
+		}
+		r.ch <- prometheus.MustNewConstMetric(
+			pathHopRTTSeconds, prometheus.GaugeValue, hop.RTTSeconds,
+			append(slices.Clone(labels), strconv.Itoa(hop.TTL), hop.Addr.String())...,
+		)
+	}
+}
@@ -0,0 +1,130 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/cacack/speedtest_exporter/internal/probe"
+)
+
+func TestCollect_PathProbe(t *testing.T) {
+	var gotDst netip.Addr
+	cfg := Config{ServerIDs: []int{-1}, PathProbe: PathProbeConfig{Enabled: true}}
+	e := NewWithDeps(cfg, newTestClient(newTestServer("100")), newTestRunner())
+	e.traceroute = func(_ context.Context, dst netip.Addr, opts probe.Options) (*probe.Path, error) {
+		gotDst = dst
+		return &probe.Path{
+			Dst:     dst,
+			Reached: true,
+			Hops: []probe.Hop{
+				{TTL: 1, Addr: netip.MustParseAddr("10.0.0.1"), RTTSeconds: 0.001},
+				{TTL: 2},
+				{TTL: 3, Addr: dst, RTTSeconds: 0.012},
+			},
+		}, nil
+	}
+
+	metrics := collectMetrics(e)
+
+	if gotDst != netip.MustParseAddr("192.0.2.1") {
+		t.Errorf("expected the server address to be traced, got %v", gotDst)
+	}
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_path_hops")).GetGauge().GetValue(); got != 3 {
+		t.Errorf("expected 3 hops, got %v", got)
+	}
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_path_reached")).GetGauge().GetValue(); got != 1 {
+		t.Errorf("expected path_reached 1, got %v", got)
+	}
+	rtts := findAllMetricsByName(metrics, "speedtest_path_hop_rtt_seconds")
+	if len(rtts) != 2 {
+		t.Fatalf("expected RTTs for the 2 hops that answered, got %d", len(rtts))
+	}
+	if labelValue(rtts[0], "hop") != "1" || labelValue(rtts[0], "hop_addr") != "10.0.0.1" || labelValue(rtts[0], "server_id") != "100" {
+		t.Errorf("unexpected labels %v", metricToDTO(rtts[0]).GetLabel())
+	}
+
+	traces := e.LastTraces()
+	if len(traces) != 1 {
+		t.Fatalf("expected 1 trace, got %d", len(traces))
+	}
+	if tr := traces[0]; tr.ServerID != "100" || tr.Host != "192.0.2.1" || tr.Path == nil || len(tr.Path.Hops) != 3 {
+		t.Errorf("unexpected trace %+v", tr)
+	}
+}
+
+func TestCollect_PathProbeFailure(t *testing.T) {
+	cfg := Config{ServerIDs: []int{-1}, PathProbe: PathProbeConfig{Enabled: true}}
+	e := NewWithDeps(cfg, newTestClient(newTestServer("100")), newTestRunner())
+	e.traceroute = func(context.Context, netip.Addr, probe.Options) (*probe.Path, error) {
+		return nil, errors.New("operation not permitted")
+	}
+
+	metrics := collectMetrics(e)
+
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_up")).GetGauge().GetValue(); got != 1 {
+		t.Errorf("expected a failed trace not to fail the run, got up=%v", got)
+	}
+	if findMetricByName(metrics, "speedtest_path_hops") != nil {
+		t.Error("unexpected speedtest_path_hops after a failed trace")
+	}
+	traces := e.LastTraces()
+	if len(traces) != 1 || traces[0].Error != "operation not permitted" {
+		t.Errorf("expected the failed trace to be recorded, got %+v", traces)
+	}
+}
+
+func TestCollect_PathProbeDisabled(t *testing.T) {
+	client := newTestClient(newTestServer("100"))
+	e := NewWithDeps(Config{ServerIDs: []int{-1}}, client, newTestRunner())
+	e.traceroute = func(context.Context, netip.Addr, probe.Options) (*probe.Path, error) {
+		t.Error("unexpected traceroute")
+		return nil, nil
+	}
+
+	collectMetrics(e)
+
+	if traces := e.LastTraces(); len(traces) != 0 {
+		t.Errorf("expected no traces, got %+v", traces)
+	}
+}
+
+func TestLinkRun_DialFamily(t *testing.T) {
+	tests := []struct {
+		link   Link
+		family IPFamily
+		want   IPFamily
+	}{
+		{Link{}, IPFamilyAny, IPFamilyAny},
+		{Link{}, IPv6, IPv6},
+		{Link{SourceAddress: "192.0.2.10"}, IPFamilyAny, IPv4},
+		{Link{SourceAddress: "2001:db8::10"}, IPFamilyAny, IPv6},
+		{Link{SourceAddress: "::ffff:192.0.2.10"}, IPFamilyAny, IPv4},
+		{Link{Interface: "wwan0"}, IPv4, IPv4},
+	}
+	for _, tt := range tests {
+		r := &linkRun{link: tt.link, family: tt.family}
+		if got := r.dialFamily(); got != tt.want {
+			t.Errorf("%+v over %q: expected %q, got %q", tt.link, tt.family, tt.want, got)
+		}
+	}
+}
+
+func TestPathProbeConfig_Validate(t *testing.T) {
+	if err := (PathProbeConfig{}).Validate(); err != nil {
+		t.Errorf("unexpected error for a disabled probe: %v", err)
+	}
+	if !probe.Supported {
+		if err := (PathProbeConfig{Enabled: true}).Validate(); err == nil {
+			t.Error("expected an error on an unsupported platform")
+		}
+		return
+	}
+	if err := (PathProbeConfig{Enabled: true, MaxHops: 20}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (PathProbeConfig{Enabled: true, MaxHops: 300}).Validate(); err == nil {
+		t.Error("expected an error for max_hops above 255")
+	}
+}
@@ -0,0 +1,138 @@
+package exporter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// Progress holds hooks that follow a run, much like httptrace.ClientTrace
+// follows a request. In parallel mode hooks are called concurrently. Nil
+// hooks are skipped.
+type Progress struct {
+	// ServersSelected is called once the servers to test over a link and IP
+	// family are known.
+	ServersSelected func(link string, family IPFamily, servers []ServerInfo)
+	// PhaseStart is called before a phase is run against a server.
+	PhaseStart func(PhaseEvent)
+	// PhaseDone is called after a phase ran against a server.
+	PhaseDone func(PhaseEvent)
+	// Sample is called while a phase runs, with every latency sample of a
+	// ping phase and about every throughputSampleInterval with the rolling
+	// speed of a download or upload phase, both in Value.
+	Sample func(PhaseEvent)
+}
+
+// throughputSampleInterval is how often the rolling speed of a bandwidth
+// phase is reported. speedtest-go updates it every 50ms.
+const throughputSampleInterval = 500 * time.Millisecond
+
+// PhaseEvent describes a phase run against a server.
+type PhaseEvent struct {
+	Link     string
+	IPFamily IPFamily
+	Server   ServerInfo
+	Phase    Phase
+	// Value is the measured latency in seconds or speed in bytes per second.
+	// PhaseDone only sets it when the phase succeeded.
+	Value float64
+	// Err is set by PhaseDone when the phase failed.
+	Err error
+	// Duration is how long the phase took, set by PhaseDone.
+	Duration time.Duration
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context that makes runs started with it call the
+// hooks in p.
+func WithProgress(ctx context.Context, p *Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+// progressFrom returns the hooks of ctx, which are empty if none were set.
+func progressFrom(ctx context.Context) *Progress {
+	if p, ok := ctx.Value(progressKey{}).(*Progress); ok && p != nil {
+		return p
+	}
+	return &Progress{}
+}
+
+// serversSelected reports the servers r is about to test.
+func (r *linkRun) serversSelected(ctx context.Context, targets speedtest.Servers) {
+	p := progressFrom(ctx)
+	if p.ServersSelected == nil {
+		return
+	}
+	servers := make([]ServerInfo, len(targets))
+	for i, s := range targets {
+		servers[i] = newServerInfo(s)
+	}
+	p.ServersSelected(r.link.Name, r.family, servers)
+}
+
+type sampleKey struct{}
+
+// reportSample passes a sample of the phase running with ctx to the Sample
+// hook, if any.
+func reportSample(ctx context.Context, value float64) {
+	if f, ok := ctx.Value(sampleKey{}).(func(float64)); ok {
+		f(value)
+	}
+}
+
+// throughputSampler returns a speedtest-go rate callback that reports the
+// rolling speed of the phase running with ctx every throughputSampleInterval.
+func throughputSampler(ctx context.Context) func(speedtest.ByteRate) {
+	if _, ok := ctx.Value(sampleKey{}).(func(float64)); !ok {
+		return nil
+	}
+	var mu sync.Mutex
+	var last time.Time
+	return func(rate speedtest.ByteRate) {
+		mu.Lock()
+		now := time.Now()
+		due := now.Sub(last) >= throughputSampleInterval
+		if due {
+			last = now
+		}
+		mu.Unlock()
+		if due {
+			reportSample(ctx, float64(rate))
+		}
+	}
+}
+
+// startPhase reports that phase starts against server. It returns the
+// context to run the phase with, which passes samples to the Sample hook,
+// and the function that reports the outcome.
+func (r *linkRun) startPhase(ctx context.Context, server *speedtest.Server, phase Phase) (context.Context, func(value float64, err error)) {
+	p := progressFrom(ctx)
+	ev := PhaseEvent{Link: r.link.Name, IPFamily: r.family, Server: newServerInfo(server), Phase: phase}
+	if p.PhaseStart != nil {
+		p.PhaseStart(ev)
+	}
+	if p.Sample != nil {
+		base := ev
+		ctx = context.WithValue(ctx, sampleKey{}, func(value float64) {
+			sample := base
+			sample.Value = value
+			p.Sample(sample)
+		})
+	}
+	start := time.Now()
+	return ctx, func(value float64, err error) {
+		if p.PhaseDone == nil {
+			return
+		}
+		ev.Duration = time.Since(start)
+		if err != nil {
+			ev.Err = err
+		} else {
+			ev.Value = value
+		}
+		p.PhaseDone(ev)
+	}
+}
@@ -0,0 +1,113 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+func TestRun_Progress(t *testing.T) {
+	client := newTestClient(newTestServer("100"))
+	runner := newTestRunner()
+	runner.uploadErr = errors.New("connection reset")
+	e := NewWithDeps(Config{Name: "home", ServerIDs: []int{-1}}, client, runner)
+
+	var mu sync.Mutex
+	var selected []ServerInfo
+	var started []Phase
+	var done []PhaseEvent
+	ctx := WithProgress(context.Background(), &Progress{
+		ServersSelected: func(_ string, _ IPFamily, servers []ServerInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			selected = append(selected, servers...)
+		},
+		PhaseStart: func(ev PhaseEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			started = append(started, ev.Phase)
+		},
+		PhaseDone: func(ev PhaseEvent) {
+			mu.Lock()
+			defer mu.Unlock()
+			done = append(done, ev)
+		},
+	})
+
+	ch := make(chan prometheus.Metric, 100)
+	res := e.Run(ctx, AllPhases, ch)
+
+	if res.Module != "home" || len(res.Servers) != 1 {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if len(selected) != 1 || selected[0].ID != "100" {
+		t.Errorf("unexpected selected servers %+v", selected)
+	}
+	if len(started) != 3 || started[0] != PhasePing || started[2] != PhaseUpload {
+		t.Errorf("unexpected started phases %v", started)
+	}
+	if len(done) != 3 {
+		t.Fatalf("expected 3 finished phases, got %d", len(done))
+	}
+	if done[0].Value != 0.01 || done[0].Err != nil || done[0].Server.ID != "100" {
+		t.Errorf("unexpected ping event %+v", done[0])
+	}
+	if done[1].Value != 100000000 {
+		t.Errorf("unexpected download event %+v", done[1])
+	}
+	if done[2].Err == nil || done[2].Value != 0 {
+		t.Errorf("expected a failed upload event, got %+v", done[2])
+	}
+}
+
+func TestRun_WithoutProgress(t *testing.T) {
+	client := newTestClient(newTestServer("100"))
+	e := NewWithDeps(Config{ServerIDs: []int{-1}}, client, newTestRunner())
+
+	ch := make(chan prometheus.Metric, 100)
+	if res := e.Run(context.Background(), AllPhases, ch); !res.Success {
+		t.Errorf("expected a successful run, got %+v", res)
+	}
+}
+
+func TestRun_Samples(t *testing.T) {
+	client := newTestClient(newTestServer("100"))
+	e := NewWithDeps(Config{Name: "home", ServerIDs: []int{-1}}, client, newTestRunner())
+
+	var samples []PhaseEvent
+	ctx := WithProgress(context.Background(), &Progress{
+		Sample: func(ev PhaseEvent) { samples = append(samples, ev) },
+	})
+
+	ch := make(chan prometheus.Metric, 100)
+	e.Run(ctx, AllPhases, ch)
+
+	if len(samples) != 1 {
+		t.Fatalf("expected 1 sample, got %d", len(samples))
+	}
+	if s := samples[0]; s.Phase != PhasePing || s.Value != 0.01 || s.Server.ID != "100" || s.Link != "" {
+		t.Errorf("unexpected sample %+v", s)
+	}
+}
+
+func TestThroughputSampler(t *testing.T) {
+	if throughputSampler(context.Background()) != nil {
+		t.Error("expected no sampler without a Sample hook")
+	}
+
+	var values []float64
+	ctx := context.WithValue(context.Background(), sampleKey{}, func(v float64) { values = append(values, v) })
+	sample := throughputSampler(ctx)
+	for _, rate := range []speedtest.ByteRate{1000, 2000, 3000} {
+		sample(rate)
+	}
+
+	// The first rate is reported, the others come within the interval.
+	if len(values) != 1 || values[0] != 1000 {
+		t.Errorf("unexpected samples %v", values)
+	}
+}
@@ -0,0 +1,237 @@
+package exporter
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// Result is the record of one run of a module.
+type Result struct {
+	Module string    `json:"module"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	// Phases are the phases that were run, after the data budget was applied.
+	Phases  []Phase `json:"phases"`
+	Success bool    `json:"success"`
+	// Skipped is set when the data budget did not allow any phase to run.
+	Skipped bool `json:"skipped,omitempty"`
+	// SkippedLinks are the links of a multi-WAN module whose data budget did
+	// not allow any phase to run, while other links were tested.
+	SkippedLinks []string `json:"skipped_links,omitempty"`
+	// Errors are the failures that kept a link from testing any server.
+	Errors  []string       `json:"errors,omitempty"`
+	Servers []ServerResult `json:"servers"`
+}
+
+// ServerResult holds the measurements of one server over one link and IP
+// family. Values of phases that did not run or failed are omitted.
+type ServerResult struct {
+	Link     string     `json:"link,omitempty"`
+	IPFamily IPFamily   `json:"ip_family,omitempty"`
+	Source   string     `json:"source,omitempty"`
+	User     UserInfo   `json:"user"`
+	Server   ServerInfo `json:"server"`
+
+	LatencySeconds         *float64 `json:"latency_seconds,omitempty"`
+	DownloadBytesPerSecond *float64 `json:"download_bytes_per_second,omitempty"`
+	UploadBytesPerSecond   *float64 `json:"upload_bytes_per_second,omitempty"`
+	// Errors are the failed phases, prefixed with the phase name.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// UserInfo is the client as seen by speedtest.net.
+type UserInfo struct {
+	IP  string `json:"ip"`
+	ISP string `json:"isp"`
+	Lat string `json:"lat"`
+	Lon string `json:"lon"`
+}
+
+// ServerInfo describes a speedtest server.
+type ServerInfo struct {
+	ID         string  `json:"id"`
+	Name       string  `json:"name"`
+	Sponsor    string  `json:"sponsor"`
+	Country    string  `json:"country"`
+	Host       string  `json:"host"`
+	Lat        string  `json:"lat"`
+	Lon        string  `json:"lon"`
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// LatestResult returns the result of the last completed run.
+func (e *Exporter) LatestResult() (Result, bool) {
+	return e.history.latest()
+}
+
+// RecentResults returns the results kept in memory, oldest first. Unlike
+// Results it never reads the result store.
+func (e *Exporter) RecentResults() []Result {
+	return e.history.since(time.Time{})
+}
+
+// Results returns the kept results of runs that started at or after since,
+// oldest first. With a result store they come from the store, otherwise from
+// the in-memory history.
+func (e *Exporter) Results(since time.Time) []Result {
+	if e.store != nil {
+		results, err := e.store.Since(e.cfg.Name, since)
+		if err == nil {
+			return results
+		}
+		slog.Error("could not read results from the result store", "module", e.cfg.Name, "error", err)
+	}
+	return e.history.since(since)
+}
+
+// SetResultStore makes the exporter keep every result in s, which may be
+// shared by several exporters. The newest stored results of the module fill
+// the in-memory history.
+func (e *Exporter) SetResultStore(s *ResultStore) {
+	e.store = s
+	results, err := s.Latest(e.cfg.Name, len(e.history.results))
+	if err != nil {
+		slog.Error("could not load results from the result store", "module", e.cfg.Name, "error", err)
+		return
+	}
+	for _, r := range results {
+		e.history.add(r)
+	}
+}
+
+// SetResultLog makes the exporter append every result to l, which may be
+// shared by several exporters.
+func (e *Exporter) SetResultLog(l *ResultLog) {
+	e.resultLog = l
+}
+
+// recordResult keeps the result of a finished run.
+func (e *Exporter) recordResult(r Result) {
+	e.history.add(r)
+	if e.store != nil {
+		if err := e.store.Add(r); err != nil {
+			slog.Error("could not persist run result", "module", e.cfg.Name, "error", err)
+		}
+	}
+	if e.resultLog != nil {
+		if err := e.resultLog.Write(r); err != nil {
+			slog.Error("could not write run result to the result log", "module", e.cfg.Name, "error", err)
+		}
+	}
+}
+
+// runRecorder builds the Result of a run. Servers may be tested in parallel.
+type runRecorder struct {
+	mu      sync.Mutex
+	result  Result
+	servers map[serverResultKey]int
+}
+
+// serverResultKey identifies the entry of a server in Result.Servers.
+type serverResultKey struct {
+	link     string
+	family   IPFamily
+	serverID string
+}
+
+func newRunRecorder(module string, phases []Phase) *runRecorder {
+	return &runRecorder{
+		result: Result{
+			Module:  module,
+			Start:   time.Now(),
+			Phases:  phases,
+			Servers: []ServerResult{},
+		},
+		servers: make(map[serverResultKey]int),
+	}
+}
+
+// fail records an error that kept link from testing any server.
+func (rec *runRecorder) fail(link Link, family IPFamily, err error) {
+	msg := err.Error()
+	if link.Name != "" {
+		msg = fmt.Sprintf("link %s: %s", link.Name, msg)
+	}
+	if family != IPFamilyAny {
+		msg = fmt.Sprintf("IPv%s: %s", family, msg)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.result.Errors = append(rec.result.Errors, msg)
+}
+
+// server applies update to the entry of server in r's link and family,
+// adding the entry on first use.
+func (rec *runRecorder) server(r *linkRun, server *speedtest.Server, update func(*ServerResult)) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	k := serverResultKey{link: r.link.Name, family: r.family, serverID: server.ID}
+	i, ok := rec.servers[k]
+	if !ok {
+		i = len(rec.result.Servers)
+		rec.servers[k] = i
+		rec.result.Servers = append(rec.result.Servers, newServerResult(r, server))
+	}
+	update(&rec.result.Servers[i])
+}
+
+// phaseError records that phase failed on server.
+func (rec *runRecorder) phaseError(r *linkRun, server *speedtest.Server, phase Phase, err error) {
+	rec.server(r, server, func(s *ServerResult) {
+		s.Errors = append(s.Errors, fmt.Sprintf("%s: %s", phase, err))
+	})
+}
+
+// skip records that the data budget left link without phases.
+func (rec *runRecorder) skip(link Link) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.result.SkippedLinks = append(rec.result.SkippedLinks, link.Name)
+}
+
+// finish returns the completed Result.
+func (rec *runRecorder) finish(ok, skipped bool) Result {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.result.End = time.Now()
+	rec.result.Success = ok
+	rec.result.Skipped = skipped
+	return rec.result
+}
+
+func newServerResult(r *linkRun, server *speedtest.Server) ServerResult {
+	return ServerResult{
+		Link:     r.link.Name,
+		IPFamily: r.family,
+		Source:   r.link.Source(),
+		User: UserInfo{
+			IP:  r.user.IP,
+			ISP: r.user.Isp,
+			Lat: r.user.Lat,
+			Lon: r.user.Lon,
+		},
+		Server: newServerInfo(server),
+	}
+}
+
+func newServerInfo(server *speedtest.Server) ServerInfo {
+	host := server.Host
+	if u, err := url.Parse(server.URL); host == "" && err == nil {
+		host = u.Host
+	}
+	return ServerInfo{
+		ID:         server.ID,
+		Name:       server.Name,
+		Sponsor:    server.Sponsor,
+		Country:    server.Country,
+		Host:       host,
+		Lat:        server.Lat,
+		Lon:        server.Lon,
+		DistanceKm: server.Distance,
+	}
+}
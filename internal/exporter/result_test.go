@@ -0,0 +1,130 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+func TestCollect_RecordsResult(t *testing.T) {
+	client := newTestClient(newTestServer("100"))
+	runner := newTestRunner()
+	runner.uploadErr = errors.New("connection reset")
+	e := NewWithDeps(Config{Name: "home", ServerIDs: []int{-1}}, client, runner)
+
+	if _, ok := e.LatestResult(); ok {
+		t.Fatal("unexpected result before the first run")
+	}
+	collectMetrics(e)
+
+	res, ok := e.LatestResult()
+	if !ok {
+		t.Fatal("expected a result")
+	}
+	if res.Module != "home" || res.Success || res.Skipped || res.End.Before(res.Start) {
+		t.Errorf("unexpected result %+v", res)
+	}
+	if len(res.Phases) != 3 {
+		t.Errorf("expected all phases, got %v", res.Phases)
+	}
+	if len(res.Servers) != 1 {
+		t.Fatalf("expected 1 server, got %+v", res.Servers)
+	}
+	s := res.Servers[0]
+	if s.Server.ID != "100" || s.User.IP != newTestUser().IP {
+		t.Errorf("unexpected server and user %+v %+v", s.Server, s.User)
+	}
+	if s.LatencySeconds == nil || *s.LatencySeconds != 0.01 {
+		t.Errorf("expected a latency of 0.01s, got %v", s.LatencySeconds)
+	}
+	if s.DownloadBytesPerSecond == nil || *s.DownloadBytesPerSecond != 1e8 {
+		t.Errorf("expected a download of 1e8 B/s, got %v", s.DownloadBytesPerSecond)
+	}
+	if s.UploadBytesPerSecond != nil || len(s.Errors) != 1 || s.Errors[0] != "upload: connection reset" {
+		t.Errorf("expected the failed upload to be recorded, got %v %v", s.UploadBytesPerSecond, s.Errors)
+	}
+}
+
+func TestCollect_RecordsRunErrors(t *testing.T) {
+	clients := map[string]SpeedtestClient{
+		"fiber": newTestClient(newTestServer("100")),
+		"lte":   &mockClient{userErr: errors.New("timeout")},
+	}
+	runners := map[string]ServerRunner{"fiber": newTestRunner(), "lte": newTestRunner()}
+	cfg := Config{ServerIDs: []int{-1}, Links: []Link{{Name: "fiber"}, {Name: "lte"}}}
+	e := newLinkExporter(cfg, clients, runners)
+
+	collectMetrics(e)
+
+	res, _ := e.LatestResult()
+	if len(res.Errors) != 1 || res.Errors[0] != "link lte: could not fetch user information: timeout" {
+		t.Errorf("unexpected errors %q", res.Errors)
+	}
+	if len(res.Servers) != 1 || res.Servers[0].Link != "fiber" {
+		t.Errorf("expected the servers of the working link, got %+v", res.Servers)
+	}
+}
+
+func TestCollect_RecordsSkippedRun(t *testing.T) {
+	client := newTestClient(newTestServer("100"))
+	cfg := Config{Name: "lte", ServerIDs: []int{-1}, Budget: BudgetConfig{DailyBytes: 10, OnExhausted: BudgetSkip}}
+	e := NewWithDeps(cfg, client, newTestRunner())
+	_ = e.ledger.Add("lte", "", 10)
+
+	collectMetrics(e)
+
+	res, _ := e.LatestResult()
+	if !res.Skipped || !res.Success || len(res.Phases) != 0 || len(res.Servers) != 0 {
+		t.Errorf("unexpected result %+v", res)
+	}
+}
+
+// runningProbe records whether its exporter reported a run in progress
+// while pinging.
+type runningProbe struct {
+	*mockRunner
+	e       *Exporter
+	running bool
+}
+
+func (r *runningProbe) PingTest(ctx context.Context, s *speedtest.Server) error {
+	_, r.running = r.e.Running()
+	return r.mockRunner.PingTest(ctx, s)
+}
+
+func TestExporter_Running(t *testing.T) {
+	client := newTestClient(newTestServer("100"))
+	probe := &runningProbe{mockRunner: newTestRunner()}
+	e := NewWithDeps(Config{ServerIDs: []int{-1}}, client, probe)
+	probe.e = e
+
+	if _, running := e.Running(); running {
+		t.Fatal("unexpected run in progress before the first run")
+	}
+	collectMetrics(e)
+	if !probe.running {
+		t.Error("expected a run in progress during the run")
+	}
+	if _, running := e.Running(); running {
+		t.Error("unexpected run in progress after the run")
+	}
+}
+
+func TestExporter_RecentResults(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "results.db"), 0)
+	storeMinutes(t, s, "home", 0, 3)
+	e := NewWithDeps(Config{Name: "home"}, nil, nil)
+	e.SetHistorySize(2)
+	e.SetResultStore(s)
+
+	if got := e.RecentResults(); len(got) != 2 {
+		t.Errorf("expected the 2 results kept in memory, got %d", len(got))
+	}
+	if got := e.Results(time.Time{}); len(got) != 3 {
+		t.Errorf("expected all 3 stored results, got %d", len(got))
+	}
+}
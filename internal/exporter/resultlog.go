@@ -0,0 +1,333 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResultLogFormat is the file format of a ResultLog.
+type ResultLogFormat string
+
+const (
+	// ResultLogCSV writes comma-separated rows under a header line.
+	ResultLogCSV ResultLogFormat = "csv"
+	// ResultLogJSONL writes one JSON object per line.
+	ResultLogJSONL ResultLogFormat = "jsonl"
+)
+
+// resultColumn is a field that can be written to a result log.
+type resultColumn struct {
+	name  string
+	value func(r *Result, s *ServerResult) any
+}
+
+// resultColumns are the fields a result log can hold. Server fields are empty
+// in the row of a run that tested no server.
+var resultColumns = []resultColumn{
+	{"start", func(r *Result, _ *ServerResult) any { return r.Start.UTC().Format(time.RFC3339) }},
+	{"end", func(r *Result, _ *ServerResult) any { return r.End.UTC().Format(time.RFC3339) }},
+	{"module", func(r *Result, _ *ServerResult) any { return r.Module }},
+	{"success", func(r *Result, _ *ServerResult) any { return r.Success }},
+	{"skipped", func(r *Result, _ *ServerResult) any { return r.Skipped }},
+	{"phases", func(r *Result, _ *ServerResult) any { return joinPhases(r.Phases) }},
+	{"link", func(_ *Result, s *ServerResult) any { return s.Link }},
+	{"ip_family", func(_ *Result, s *ServerResult) any { return string(s.IPFamily) }},
+	{"source", func(_ *Result, s *ServerResult) any { return s.Source }},
+	{"user_ip", func(_ *Result, s *ServerResult) any { return s.User.IP }},
+	{"isp", func(_ *Result, s *ServerResult) any { return s.User.ISP }},
+	{"server_id", func(_ *Result, s *ServerResult) any { return s.Server.ID }},
+	{"server_name", func(_ *Result, s *ServerResult) any { return s.Server.Name }},
+	{"sponsor", func(_ *Result, s *ServerResult) any { return s.Server.Sponsor }},
+	{"country", func(_ *Result, s *ServerResult) any { return s.Server.Country }},
+	{"host", func(_ *Result, s *ServerResult) any { return s.Server.Host }},
+	{"distance_km", func(_ *Result, s *ServerResult) any {
+		if s.Server.ID == "" {
+			return nil
+		}
+		return s.Server.DistanceKm
+	}},
+	{"latency_seconds", func(_ *Result, s *ServerResult) any { return optional(s.LatencySeconds) }},
+	{"download_bytes_per_second", func(_ *Result, s *ServerResult) any { return optional(s.DownloadBytesPerSecond) }},
+	{"upload_bytes_per_second", func(_ *Result, s *ServerResult) any { return optional(s.UploadBytesPerSecond) }},
+	{"errors", func(r *Result, s *ServerResult) any {
+		return strings.Join(append(append([]string{}, r.Errors...), s.Errors...), "; ")
+	}},
+}
+
+// DefaultResultLogColumns are written when no columns are configured.
+var DefaultResultLogColumns = []string{
+	"start", "end", "module", "success", "link", "ip_family", "user_ip", "isp",
+	"server_id", "server_name", "sponsor", "host",
+	"latency_seconds", "download_bytes_per_second", "upload_bytes_per_second", "errors",
+}
+
+func optional(v *float64) any {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func joinPhases(phases []Phase) string {
+	names := make([]string, len(phases))
+	for i, p := range phases {
+		names[i] = string(p)
+	}
+	return strings.Join(names, ",")
+}
+
+// ResultLogConfig configures a ResultLog.
+type ResultLogConfig struct {
+	// Path is the file results are appended to.
+	Path   string
+	Format ResultLogFormat
+	// Columns are the fields written for every row, in order. Empty means
+	// DefaultResultLogColumns.
+	Columns []string
+	// MaxSize and MaxAge start a new file once the current one would grow
+	// past MaxSize bytes or was started more than MaxAge ago. A file found on
+	// startup counts as started then. Zero disables either limit.
+	MaxSize int64
+	MaxAge  time.Duration
+}
+
+// ResultLog appends every run result to a CSV or JSON Lines file, one row
+// per server tested. Rotated files keep their name with the UTC time of the
+// rotation inserted before the extension.
+type ResultLog struct {
+	cfg     ResultLogConfig
+	columns []resultColumn
+	now     func() time.Time
+
+	mu      sync.Mutex
+	started time.Time
+}
+
+// OpenResultLog checks cfg and returns a log that writes to cfg.Path. The file
+// is created on the first write if it does not exist yet.
+func OpenResultLog(cfg ResultLogConfig) (*ResultLog, error) {
+	switch cfg.Format {
+	case ResultLogCSV, ResultLogJSONL:
+	default:
+		return nil, fmt.Errorf("unknown result log format %q: must be %s or %s", cfg.Format, ResultLogCSV, ResultLogJSONL)
+	}
+	if cfg.MaxSize < 0 || cfg.MaxAge < 0 {
+		return nil, errors.New("result log size and age limits must not be negative")
+	}
+	names := cfg.Columns
+	if len(names) == 0 {
+		names = DefaultResultLogColumns
+	}
+	l := &ResultLog{cfg: cfg, now: time.Now}
+	for _, name := range names {
+		col, ok := findResultColumn(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown result log column %q", name)
+		}
+		l.columns = append(l.columns, col)
+	}
+	if cfg.Format == ResultLogCSV {
+		if err := l.checkHeader(); err != nil {
+			return nil, err
+		}
+	}
+	l.started = l.now()
+	return l, nil
+}
+
+// checkHeader rotates a CSV file whose header does not list the configured
+// columns, so rows never end up under the header of other columns.
+func (l *ResultLog) checkHeader() error {
+	f, err := os.Open(l.cfg.Path) // #nosec G304 -- path is an operator-supplied flag.
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	header, err := csv.NewReader(f).Read()
+	_ = f.Close()
+	if errors.Is(err, io.EOF) || err == nil && slices.Equal(header, l.header()) {
+		return nil
+	}
+	slog.Warn("result log has other columns, starting a new file", "path", l.cfg.Path)
+	return l.rotate()
+}
+
+// ParseResultLogColumns splits a comma-separated list of column names.
+func ParseResultLogColumns(s string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := findResultColumn(name); !ok {
+			return nil, fmt.Errorf("unknown result log column %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func findResultColumn(name string) (resultColumn, bool) {
+	for _, col := range resultColumns {
+		if col.name == name {
+			return col, true
+		}
+	}
+	return resultColumn{}, false
+}
+
+// Write appends the rows of r, rotating the file first if it is due.
+func (l *ResultLog) Write(r Result) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	size := int64(0)
+	if fi, err := os.Stat(l.cfg.Path); err == nil {
+		size = fi.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	rows, err := l.encodeRows(r)
+	if err != nil {
+		return err
+	}
+	if size > 0 && l.due(size+int64(len(rows))) {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+		size = 0
+	}
+
+	if size == 0 {
+		l.started = l.now()
+	}
+	var data []byte
+	if size == 0 && l.cfg.Format == ResultLogCSV {
+		if data, err = l.encodeCSV(l.header()); err != nil {
+			return err
+		}
+	}
+	data = append(data, rows...)
+
+	f, err := os.OpenFile(l.cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600) // #nosec G304 -- path is an operator-supplied flag.
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// due reports whether the file must be rotated before it grows to size bytes.
+func (l *ResultLog) due(size int64) bool {
+	if l.cfg.MaxSize > 0 && size > l.cfg.MaxSize {
+		return true
+	}
+	return l.cfg.MaxAge > 0 && l.now().Sub(l.started) >= l.cfg.MaxAge
+}
+
+// rotate moves the current file aside. Callers hold l.mu.
+func (l *ResultLog) rotate() error {
+	now := l.now()
+	ext := filepath.Ext(l.cfg.Path)
+	base := strings.TrimSuffix(l.cfg.Path, ext) + "-" + now.UTC().Format("20060102T150405Z")
+	name := base + ext
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	return os.Rename(l.cfg.Path, name)
+}
+
+func (l *ResultLog) header() []string {
+	names := make([]string, len(l.columns))
+	for i, col := range l.columns {
+		names[i] = col.name
+	}
+	return names
+}
+
+// encodeRows returns the rows of r in the log's format. A run that tested no
+// server still gets a row, so failed and skipped runs are on record.
+func (l *ResultLog) encodeRows(r Result) ([]byte, error) {
+	servers := r.Servers
+	if len(servers) == 0 {
+		servers = []ServerResult{{}}
+	}
+	var buf bytes.Buffer
+	for i := range servers {
+		switch l.cfg.Format {
+		case ResultLogJSONL:
+			// Fields are written one by one to keep the column order.
+			buf.WriteByte('{')
+			for j, col := range l.columns {
+				if j > 0 {
+					buf.WriteByte(',')
+				}
+				data, err := json.Marshal(col.value(&r, &servers[i]))
+				if err != nil {
+					return nil, err
+				}
+				buf.WriteString(strconv.Quote(col.name))
+				buf.WriteByte(':')
+				buf.Write(data)
+			}
+			buf.WriteString("}\n")
+		default:
+			fields := make([]string, len(l.columns))
+			for j, col := range l.columns {
+				fields[j] = csvField(col.value(&r, &servers[i]))
+			}
+			data, err := l.encodeCSV(fields)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(data)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (l *ResultLog) encodeCSV(fields []string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err := w.Write(fields); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func csvField(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,269 @@
+package exporter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLogResult() Result {
+	latency, download := 0.0081, 112500000.0
+	return Result{
+		Module:  "home",
+		Start:   time.Date(2026, 1, 2, 16, 4, 5, 0, time.FixedZone("CET", 3600)),
+		End:     time.Date(2026, 1, 2, 16, 4, 47, 0, time.FixedZone("CET", 3600)),
+		Phases:  []Phase{PhasePing, PhaseDownload, PhaseUpload},
+		Success: false,
+		Servers: []ServerResult{{
+			User:                   UserInfo{IP: "203.0.113.7", ISP: "Example ISP"},
+			Server:                 ServerInfo{ID: "12345", Name: "Berlin", Sponsor: "Example, Inc.", Host: "speedtest.example.net:8080"},
+			LatencySeconds:         &latency,
+			DownloadBytesPerSecond: &download,
+			Errors:                 []string{"upload: connection reset"},
+		}},
+	}
+}
+
+func openTestLog(t *testing.T, cfg ResultLogConfig) *ResultLog {
+	t.Helper()
+	l, err := OpenResultLog(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func readCSV(t *testing.T, path string) [][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestResultLog_CSV(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.csv")
+	l := openTestLog(t, ResultLogConfig{Path: path, Format: ResultLogCSV})
+
+	for range 2 {
+		if err := l.Write(testLogResult()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := readCSV(t, path)
+	if len(records) != 3 {
+		t.Fatalf("expected a header and 2 rows, got %d records", len(records))
+	}
+	if got := strings.Join(records[0], ","); got != strings.Join(DefaultResultLogColumns, ",") {
+		t.Errorf("unexpected header %q", got)
+	}
+	row := make(map[string]string)
+	for i, name := range records[0] {
+		row[name] = records[1][i]
+	}
+	want := map[string]string{
+		"start":                     "2026-01-02T15:04:05Z",
+		"end":                       "2026-01-02T15:04:47Z",
+		"module":                    "home",
+		"success":                   "false",
+		"sponsor":                   "Example, Inc.",
+		"latency_seconds":           "0.0081",
+		"download_bytes_per_second": "112500000",
+		"upload_bytes_per_second":   "",
+		"errors":                    "upload: connection reset",
+	}
+	for name, v := range want {
+		if row[name] != v {
+			t.Errorf("%s: expected %q, got %q", name, v, row[name])
+		}
+	}
+}
+
+func TestResultLog_JSONL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	l := openTestLog(t, ResultLogConfig{
+		Path:    path,
+		Format:  ResultLogJSONL,
+		Columns: []string{"start", "server_id", "upload_bytes_per_second", "download_bytes_per_second"},
+	})
+
+	if err := l.Write(testLogResult()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"start":"2026-01-02T15:04:05Z","server_id":"12345","upload_bytes_per_second":null,"download_bytes_per_second":112500000}` + "\n"
+	if string(data) != want {
+		t.Errorf("expected %s, got %s", want, data)
+	}
+	var row map[string]any
+	if err := json.Unmarshal(data, &row); err != nil {
+		t.Errorf("line is not valid JSON: %v", err)
+	}
+}
+
+func TestResultLog_RunWithoutServers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.csv")
+	l := openTestLog(t, ResultLogConfig{Path: path, Format: ResultLogCSV, Columns: []string{"module", "server_id", "distance_km", "errors"}})
+
+	r := Result{Module: "lte", Errors: []string{"link lte: timeout"}}
+	if err := l.Write(r); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readCSV(t, path)
+	if len(records) != 2 {
+		t.Fatalf("expected a header and 1 row, got %d records", len(records))
+	}
+	if got := strings.Join(records[1], ","); got != "lte,,,link lte: timeout" {
+		t.Errorf("unexpected row %q", got)
+	}
+}
+
+func TestResultLog_RotatesBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "results.csv")
+	l := openTestLog(t, ResultLogConfig{Path: path, Format: ResultLogCSV, MaxSize: 400})
+	l.now = func() time.Time { return time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC) }
+
+	for range 3 {
+		if err := l.Write(testLogResult()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated := filepath.Join(dir, "results-20260102T150405Z.csv")
+	for _, p := range []string{path, rotated, filepath.Join(dir, "results-20260102T150405Z-1.csv")} {
+		if records := readCSV(t, p); len(records) != 2 || records[0][0] != "start" {
+			t.Errorf("%s: expected a header and 1 row, got %d records", filepath.Base(p), len(records))
+		}
+	}
+}
+
+func TestResultLog_RotatesByAge(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "results.jsonl")
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	l := openTestLog(t, ResultLogConfig{Path: path, Format: ResultLogJSONL, MaxAge: 24 * time.Hour})
+	l.now = func() time.Time { return now }
+
+	for _, step := range []time.Duration{0, time.Hour, 24 * time.Hour} {
+		now = now.Add(step)
+		if err := l.Write(testLogResult()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected the current and one rotated file, got %d files", len(entries))
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "results-20260103T160405Z.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 2 {
+		t.Errorf("expected 2 lines in the rotated file, got %d", lines)
+	}
+}
+
+func TestOpenResultLog_RotatesOtherHeader(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "results.csv")
+	if err := os.WriteFile(path, []byte("start,module\n2026-01-02T15:04:05Z,home\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	l := openTestLog(t, ResultLogConfig{Path: path, Format: ResultLogCSV, Columns: []string{"start", "module", "success"}})
+	l.now = func() time.Time { return time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC) }
+	if err := l.Write(testLogResult()); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected the old file to be rotated, got %d files", len(entries))
+	}
+	if records := readCSV(t, path); len(records) != 2 || strings.Join(records[0], ",") != "start,module,success" {
+		t.Errorf("expected the new header and 1 row, got %v", records)
+	}
+
+	// A file with the configured header is appended to.
+	openTestLog(t, ResultLogConfig{Path: path, Format: ResultLogCSV, Columns: []string{"start", "module", "success"}})
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("expected a matching file to be kept, got %d files", len(entries))
+	}
+}
+
+func TestOpenResultLog_Invalid(t *testing.T) {
+	for name, cfg := range map[string]ResultLogConfig{
+		"format":   {Path: "r.log", Format: "xml"},
+		"column":   {Path: "r.log", Format: ResultLogCSV, Columns: []string{"jitter"}},
+		"max size": {Path: "r.log", Format: ResultLogCSV, MaxSize: -1},
+	} {
+		if _, err := OpenResultLog(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseResultLogColumns(t *testing.T) {
+	got, err := ParseResultLogColumns(" start, server_id ,,errors")
+	if err != nil || strings.Join(got, ",") != "start,server_id,errors" {
+		t.Errorf("unexpected columns %v, %v", got, err)
+	}
+	if _, err := ParseResultLogColumns("start,jitter"); err == nil {
+		t.Error("expected an error for an unknown column")
+	}
+}
+
+func TestCollect_WritesResultLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.csv")
+	client := newTestClient(newTestServer("100"))
+	e := NewWithDeps(Config{Name: "home", ServerIDs: []int{-1}}, client, newTestRunner())
+	e.SetResultLog(openTestLog(t, ResultLogConfig{Path: path, Format: ResultLogCSV, Columns: []string{"module", "server_id", "success"}}))
+
+	collectMetrics(e)
+
+	records := readCSV(t, path)
+	if len(records) != 2 || strings.Join(records[1], ",") != "home,100,true" {
+		t.Errorf("unexpected records %v", records)
+	}
+}
+
+func TestCollect_ResultLogErrorIsLogged(t *testing.T) {
+	client := newTestClient(newTestServer("100"))
+	e := NewWithDeps(Config{Name: "home", ServerIDs: []int{-1}}, client, newTestRunner())
+	path := filepath.Join(t.TempDir(), "missing", "results.csv")
+	e.SetResultLog(openTestLog(t, ResultLogConfig{Path: path, Format: ResultLogCSV}))
+
+	collectMetrics(e)
+
+	if _, ok := e.LatestResult(); !ok {
+		t.Error("expected the result to be kept although the log could not be written")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("unexpected file state: %v", err)
+	}
+}
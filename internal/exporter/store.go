@@ -0,0 +1,198 @@
+package exporter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ResultStore keeps run results on disk across restarts. Each module's
+// results live in their own bucket, keyed by start time.
+type ResultStore struct {
+	db        *bolt.DB
+	retention time.Duration
+	now       func() time.Time
+}
+
+// compactRatio is the share of free pages above which the store file is
+// rewritten when it is opened. bbolt reuses free pages but never shrinks
+// the file by itself.
+const compactRatio = 0.5
+
+// OpenResultStore opens the store at path, creating it if needed. Results
+// older than retention are removed when the store is opened and as new
+// results are added; zero keeps them forever.
+func OpenResultStore(path string, retention time.Duration) (*ResultStore, error) {
+	s := &ResultStore{retention: retention, now: time.Now}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening result store %s: %w", path, err)
+	}
+	s.db = db
+	if err := s.pruneAll(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	if err := s.compact(path); err != nil {
+		_ = s.db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the store file.
+func (s *ResultStore) Close() error {
+	return s.db.Close()
+}
+
+// resultKey orders results by start time. Results of one module that
+// started in the same nanosecond are kept apart by the caller.
+func resultKey(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+}
+
+// Add stores r under its module and removes the module's expired results.
+func (s *ResultStore) Add(r Result) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(r.Module))
+		if err != nil {
+			return err
+		}
+		key := resultKey(r.Start)
+		for b.Get(key) != nil {
+			key = binary.BigEndian.AppendUint64(nil, binary.BigEndian.Uint64(key)+1)
+		}
+		if err := b.Put(key, data); err != nil {
+			return err
+		}
+		return s.prune(b)
+	})
+}
+
+// Since returns the stored results of module that started at or after t,
+// oldest first.
+func (s *ResultStore) Since(module string, t time.Time) ([]Result, error) {
+	results := []Result{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(module))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if t.IsZero() {
+			k, v = c.First()
+		} else {
+			k, v = c.Seek(resultKey(t))
+		}
+		for ; k != nil; k, v = c.Next() {
+			var r Result
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("decoding stored result of module %q: %w", module, err)
+			}
+			results = append(results, r)
+		}
+		return nil
+	})
+	return results, err
+}
+
+// Latest returns up to n of the newest stored results of module, oldest
+// first.
+func (s *ResultStore) Latest(module string, n int) ([]Result, error) {
+	var results []Result
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(module))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && len(results) < n; k, v = c.Prev() {
+			var r Result
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("decoding stored result of module %q: %w", module, err)
+			}
+			results = append(results, r)
+		}
+		return nil
+	})
+	for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+		results[i], results[j] = results[j], results[i]
+	}
+	return results, err
+}
+
+// prune deletes the results in b that are older than the retention.
+func (s *ResultStore) prune(b *bolt.Bucket) error {
+	if s.retention <= 0 {
+		return nil
+	}
+	cutoff := resultKey(s.now().Add(-s.retention))
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, cutoff) < 0; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneAll applies the retention to every module.
+func (s *ResultStore) pruneAll() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			return s.prune(b)
+		})
+	})
+}
+
+// compact rewrites the store file without its free pages when they make up
+// more than compactRatio of it, and reopens it.
+func (s *ResultStore) compact(path string) error {
+	var free, total int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		free = s.db.Stats().FreePageN + s.db.Stats().PendingPageN
+		total = int(tx.Size()) / s.db.Info().PageSize
+		return nil
+	})
+	if err != nil || total == 0 || float64(free)/float64(total) <= compactRatio {
+		return err
+	}
+
+	tmp := path + ".compact"
+	dst, err := bolt.Open(tmp, 0o600, nil)
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, s.db, 1<<20); err != nil {
+		_ = dst.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("compacting result store %s: %w", path, err)
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	if err := s.db.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	slog.Info("compacted result store", "path", path, "free_pages", free, "pages", total)
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("reopening result store %s: %w", path, err)
+	}
+	s.db = db
+	return nil
+}
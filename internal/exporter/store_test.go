@@ -0,0 +1,204 @@
+package exporter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, path string, retention time.Duration) *ResultStore {
+	t.Helper()
+	s, err := OpenResultStore(path, retention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+// storeMinutes adds n results of module started one minute apart from
+// historyStart.
+func storeMinutes(t *testing.T, s *ResultStore, module string, from, n int) {
+	t.Helper()
+	for i := from; i < from+n; i++ {
+		if err := s.Add(Result{Module: module, Start: historyStart.Add(time.Duration(i) * time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResultStore_Since(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "results.db"), 0)
+	storeMinutes(t, s, "home", 0, 3)
+	storeMinutes(t, s, "lte", 0, 1)
+
+	got, err := s.Since("home", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(got))
+	}
+	for i, r := range got {
+		if want := historyStart.Add(time.Duration(i) * time.Minute); !r.Start.Equal(want) || r.Module != "home" {
+			t.Errorf("index %d: unexpected result %v %v", i, r.Module, r.Start)
+		}
+	}
+
+	if got, _ := s.Since("home", historyStart.Add(time.Minute)); len(got) != 2 {
+		t.Errorf("expected 2 results since minute 1, got %d", len(got))
+	}
+	if got, err := s.Since("unknown", time.Time{}); err != nil || got == nil || len(got) != 0 {
+		t.Errorf("expected an empty non-nil slice for an unknown module, got %#v, %v", got, err)
+	}
+}
+
+func TestResultStore_SameStart(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "results.db"), 0)
+	for range 2 {
+		if err := s.Add(Result{Module: "home", Start: historyStart}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := s.Since("home", time.Time{}); len(got) != 2 {
+		t.Errorf("expected both results to be kept, got %d", len(got))
+	}
+}
+
+func TestResultStore_Latest(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "results.db"), 0)
+	storeMinutes(t, s, "home", 0, 5)
+
+	got, err := s.Latest("home", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !got[0].Start.Equal(historyStart.Add(3*time.Minute)) || !got[1].Start.Equal(historyStart.Add(4*time.Minute)) {
+		t.Errorf("expected the 2 newest results oldest first, got %v", got)
+	}
+}
+
+func TestResultStore_PersistsAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.db")
+	s, err := OpenResultStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeMinutes(t, s, "home", 0, 2)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, path, 0)
+	if got, _ := s.Since("home", time.Time{}); len(got) != 2 {
+		t.Errorf("expected 2 results after reopening, got %d", len(got))
+	}
+}
+
+func TestResultStore_Retention(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "results.db"), 10*time.Minute)
+	s.now = func() time.Time { return historyStart.Add(15 * time.Minute) }
+
+	storeMinutes(t, s, "home", 0, 10)
+
+	got, _ := s.Since("home", time.Time{})
+	if len(got) != 5 || !got[0].Start.Equal(historyStart.Add(5*time.Minute)) {
+		t.Errorf("expected results from minute 5 on, got %v", got)
+	}
+}
+
+func TestResultStore_RetentionOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.db")
+	s, err := OpenResultStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, module := range []string{"home", "lte"} {
+		for _, age := range []time.Duration{2 * time.Hour, time.Minute} {
+			if err := s.Add(Result{Module: module, Start: now.Add(-age)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openTestStore(t, path, time.Hour)
+	for _, module := range []string{"home", "lte"} {
+		if got, _ := s.Since(module, time.Time{}); len(got) != 1 {
+			t.Errorf("module %s: expected 1 result within the retention, got %d", module, len(got))
+		}
+	}
+}
+
+func TestResultStore_Compacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.db")
+	s, err := OpenResultStore(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := Result{Module: "home", Start: historyStart, Errors: []string{string(make([]byte, 16<<10))}}
+	for i := range 100 {
+		big.Start = historyStart.Add(time.Duration(i) * time.Minute)
+		if err := s.Add(big); err != nil {
+			t.Fatal(err)
+		}
+	}
+	storeMinutes(t, s, "lte", 0, 1)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening with a retention that expires the large results frees most of
+	// the file, which is then compacted.
+	s = openTestStore(t, path, time.Hour)
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() >= before.Size() {
+		t.Errorf("expected the file to shrink from %d bytes, got %d", before.Size(), after.Size())
+	}
+	if got, _ := s.Since("home", time.Time{}); len(got) != 0 {
+		t.Errorf("expected the expired results to be removed, got %d", len(got))
+	}
+	if err := s.Add(Result{Module: "home", Start: time.Now()}); err != nil {
+		t.Errorf("store not usable after compaction: %v", err)
+	}
+}
+
+func TestExporter_SetResultStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.db")
+	s := openTestStore(t, path, 0)
+	storeMinutes(t, s, "home", 0, 3)
+
+	client := newTestClient(newTestServer("100"))
+	e := NewWithDeps(Config{Name: "home", ServerIDs: []int{-1}}, client, newTestRunner())
+	e.SetHistorySize(2)
+	e.SetResultStore(s)
+
+	if latest, ok := e.LatestResult(); !ok || !latest.Start.Equal(historyStart.Add(2*time.Minute)) {
+		t.Errorf("expected the history to be filled from the store, got %v", latest.Start)
+	}
+
+	collectMetrics(e)
+
+	// The store answers with every result, not only those in memory.
+	got := e.Results(time.Time{})
+	if len(got) != 4 {
+		t.Fatalf("expected 4 results, got %d", len(got))
+	}
+	if !got[3].Success || len(got[3].Servers) != 1 {
+		t.Errorf("unexpected stored result %+v", got[3])
+	}
+	if stored, _ := s.Since("home", historyStart.Add(time.Hour)); len(stored) != 1 {
+		t.Errorf("expected the new run to be stored, got %d", len(stored))
+	}
+}
@@ -0,0 +1,279 @@
+package exporter
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// errTCPInfoUnsupported is returned by ValidateTCPInfo outside Linux.
+var errTCPInfoUnsupported = errors.New("tcp_info is only supported on Linux")
+
+// ValidateTCPInfo checks that TCP_INFO can be read on this platform.
+func (c Config) ValidateTCPInfo() error {
+	if c.TCPInfo && !tcpInfoSupported {
+		return errTCPInfoUnsupported
+	}
+	return nil
+}
+
+// tcpSample is the part of a socket's TCP_INFO that is exported.
+type tcpSample struct {
+	rtt          time.Duration
+	rttvar       time.Duration
+	cwnd         uint32
+	deliveryRate uint64
+	retransmits  uint64
+	segsOut      uint64
+}
+
+// tcpStats summarises the connections of one bandwidth phase. Round-trip
+// times and congestion windows are averaged over the connections, delivery
+// rates added up and segment counts cover the phase only.
+type tcpStats struct {
+	conns        int
+	rtt          time.Duration
+	rttvar       time.Duration
+	cwnd         float64
+	deliveryRate float64
+	retransmits  uint64
+	segsOut      uint64
+}
+
+// retransmitRatio is the share of segments sent during the phase that were
+// retransmissions.
+func (s tcpStats) retransmitRatio() float64 {
+	if s.segsOut == 0 {
+		return 0
+	}
+	return float64(s.retransmits) / float64(s.segsOut)
+}
+
+// tcpConns tracks the TCP connections of one session so their TCP_INFO can
+// be read per bandwidth phase.
+type tcpConns struct {
+	read func(net.Conn) (tcpSample, error)
+
+	mu    sync.Mutex
+	seq   uint64
+	conns []*tcpConn
+}
+
+func newTCPConns() *tcpConns {
+	return &tcpConns{read: readTCPInfo}
+}
+
+// track wraps conn, which was dialed to addr, so it is included in the
+// phases to addr.
+func (t *tcpConns) track(conn net.Conn, addr string) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	c := &tcpConn{Conn: conn, owner: t, addr: addr, seq: t.seq}
+	t.conns = append(t.conns, c)
+	return c
+}
+
+// tcpConn is a tracked connection. Its TCP_INFO is kept when it is closed,
+// as transfers cut short at the end of a phase close their connections.
+type tcpConn struct {
+	net.Conn
+	owner *tcpConns
+	addr  string
+	seq   uint64
+
+	mu     sync.Mutex
+	closed bool
+	final  tcpSample
+	ok     bool
+}
+
+func (c *tcpConn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.final, c.ok = c.readLocked()
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// sample returns the connection's current TCP_INFO, or the last one read
+// before it was closed.
+func (c *tcpConn) sample() (tcpSample, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return c.final, c.ok
+	}
+	return c.readLocked()
+}
+
+func (c *tcpConn) readLocked() (tcpSample, bool) {
+	s, err := c.owner.read(c.Conn)
+	return s, err == nil
+}
+
+// tcpPhase is a bandwidth phase in progress. It remembers the counters of
+// the connections already open when it began, which may be reused.
+type tcpPhase struct {
+	addr     string
+	seq      uint64
+	baseline map[*tcpConn]tcpSample
+}
+
+// begin starts a phase of transfers to addr.
+func (t *tcpConns) begin(addr string) *tcpPhase {
+	t.mu.Lock()
+	conns := make([]*tcpConn, 0, len(t.conns))
+	for _, c := range t.conns {
+		if c.addr == addr {
+			conns = append(conns, c)
+		}
+	}
+	p := &tcpPhase{addr: addr, seq: t.seq, baseline: make(map[*tcpConn]tcpSample)}
+	t.mu.Unlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		if !c.closed {
+			if s, ok := c.readLocked(); ok {
+				p.baseline[c] = s
+			}
+		}
+		c.mu.Unlock()
+	}
+	return p
+}
+
+// end summarises the connections to the phase's address that were open
+// during the phase and sent segments. It reports false when there were none.
+func (t *tcpConns) end(p *tcpPhase) (tcpStats, bool) {
+	t.mu.Lock()
+	var conns []*tcpConn
+	for _, c := range t.conns {
+		if c.addr != p.addr {
+			continue
+		}
+		if _, reused := p.baseline[c]; reused || c.seq > p.seq {
+			conns = append(conns, c)
+		}
+	}
+	t.mu.Unlock()
+
+	var stats tcpStats
+	for _, c := range conns {
+		s, ok := c.sample()
+		if !ok {
+			continue
+		}
+		base := p.baseline[c]
+		if s.segsOut <= base.segsOut {
+			continue
+		}
+		stats.conns++
+		stats.rtt += s.rtt
+		stats.rttvar += s.rttvar
+		stats.cwnd += float64(s.cwnd)
+		stats.deliveryRate += float64(s.deliveryRate)
+		stats.retransmits += s.retransmits - min(base.retransmits, s.retransmits)
+		stats.segsOut += s.segsOut - base.segsOut
+	}
+	if stats.conns == 0 {
+		return tcpStats{}, false
+	}
+	stats.rtt /= time.Duration(stats.conns)
+	stats.rttvar /= time.Duration(stats.conns)
+	stats.cwnd /= float64(stats.conns)
+	return stats, true
+}
+
+// serverAddr returns the host and port the transfers to server dial.
+func serverAddr(server *speedtest.Server) (string, error) {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		return "", err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// tcpStatsKey identifies the stats of one bandwidth phase of a server.
+type tcpStatsKey struct {
+	serverID string
+	phase    Phase
+}
+
+// tcpStatsRecorder keeps the last stats of every server and phase.
+type tcpStatsRecorder struct {
+	mu    sync.Mutex
+	stats map[tcpStatsKey]tcpStats
+}
+
+func (r *tcpStatsRecorder) set(server *speedtest.Server, phase Phase, s tcpStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stats == nil {
+		r.stats = make(map[tcpStatsKey]tcpStats)
+	}
+	r.stats[tcpStatsKey{serverID: server.ID, phase: phase}] = s
+}
+
+func (r *tcpStatsRecorder) get(server *speedtest.Server, phase Phase) (tcpStats, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.stats[tcpStatsKey{serverID: server.ID, phase: phase}]
+	return s, ok
+}
+
+// tcpInfoReporter is implemented by runners that read TCP_INFO from the
+// connections of their bandwidth phases.
+type tcpInfoReporter interface {
+	TCPStats(server *speedtest.Server, phase Phase) (tcpStats, bool)
+}
+
+// collectTCPInfo exports the TCP stats of a bandwidth phase, if the runner
+// measured them.
+func collectTCPInfo(r *linkRun, server *speedtest.Server, phase Phase) {
+	reporter, ok := r.runner.(tcpInfoReporter)
+	if !ok {
+		return
+	}
+	stats, ok := reporter.TCPStats(server, phase)
+	if !ok {
+		return
+	}
+	labels := append(r.labelValues(server), string(phase))
+	type metric struct {
+		desc  *prometheus.Desc
+		value float64
+	}
+	metrics := []metric{
+		{tcpRTTSeconds, stats.rtt.Seconds()},
+		{tcpRTTVarianceSeconds, stats.rttvar.Seconds()},
+		{tcpCongestionWindowSegments, stats.cwnd},
+	}
+	// The delivery rate and retransmissions are those of the sending side,
+	// which the exporter only is during uploads.
+	if phase == PhaseUpload {
+		metrics = append(metrics,
+			metric{tcpDeliveryRateBytesPerSecond, stats.deliveryRate},
+			metric{tcpRetransmittedSegments, float64(stats.retransmits)},
+			metric{tcpRetransmitRatio, stats.retransmitRatio()},
+		)
+	}
+	for _, m := range metrics {
+		r.ch <- prometheus.MustNewConstMetric(m.desc, prometheus.GaugeValue, m.value, labels...)
+	}
+}
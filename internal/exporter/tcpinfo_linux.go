@@ -0,0 +1,43 @@
+package exporter
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const tcpInfoSupported = true
+
+// readTCPInfo reads TCP_INFO from the socket behind conn.
+func readTCPInfo(conn net.Conn) (tcpSample, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return tcpSample{}, errors.New("connection has no socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return tcpSample{}, err
+	}
+	var info *unix.TCPInfo
+	var infoErr error
+	err = raw.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	})
+	if err != nil {
+		return tcpSample{}, err
+	}
+	if infoErr != nil {
+		return tcpSample{}, infoErr
+	}
+	return tcpSample{
+		rtt:          time.Duration(info.Rtt) * time.Microsecond,
+		rttvar:       time.Duration(info.Rttvar) * time.Microsecond,
+		cwnd:         info.Snd_cwnd,
+		deliveryRate: info.Delivery_rate,
+		retransmits:  uint64(info.Total_retrans),
+		segsOut:      uint64(info.Segs_out),
+	}, nil
+}
@@ -0,0 +1,78 @@
+package exporter
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadTCPInfo(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = ln.Close() }()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			_, _ = io.Copy(io.Discard, c)
+			_ = c.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte(strings.Repeat("x", 64<<10))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s, err := readTCPInfo(conn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.segsOut == 0 || s.cwnd == 0 {
+		t.Errorf("expected segments sent and a congestion window, got %+v", s)
+	}
+
+	if _, err := readTCPInfo(&net.UnixConn{}); err == nil {
+		t.Error("expected an error for a connection that is not TCP")
+	}
+}
+
+func TestDefaultRunner_MeasureTCP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer srv.Close()
+
+	meters := newTrafficMeters(net.DefaultResolver, IPFamilyAny)
+	meters.conns = newTCPConns()
+	client := newHTTPClient(Config{}, Link{}, IPFamilyAny, meters)
+	runner := &defaultRunner{doer: client, tcp: meters.conns}
+	server := newTestServer("100")
+	server.URL = srv.URL + "/speedtest/upload.php"
+
+	end := runner.measureTCP(server, PhaseUpload)
+	resp, err := client.Post(server.URL, "application/octet-stream", strings.NewReader(strings.Repeat("x", 256<<10)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = resp.Body.Close()
+	end()
+
+	stats, ok := runner.TCPStats(server, PhaseUpload)
+	if !ok {
+		t.Fatal("expected TCP stats for the upload")
+	}
+	if stats.conns != 1 || stats.segsOut == 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if _, ok := runner.TCPStats(server, PhaseDownload); ok {
+		t.Error("unexpected TCP stats for the download")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package exporter
+
+import "net"
+
+const tcpInfoSupported = false
+
+// readTCPInfo is only supported on Linux; ValidateTCPInfo rejects tcp_info
+// elsewhere.
+func readTCPInfo(net.Conn) (tcpSample, error) {
+	return tcpSample{}, errTCPInfoUnsupported
+}
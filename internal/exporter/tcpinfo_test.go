@@ -0,0 +1,181 @@
+package exporter
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// fakeTCPInfo serves TCP_INFO samples per connection for tcpConns tests.
+type fakeTCPInfo map[net.Conn]tcpSample
+
+func (f fakeTCPInfo) read(c net.Conn) (tcpSample, error) {
+	s, ok := f[c]
+	if !ok {
+		return tcpSample{}, errors.New("no sample")
+	}
+	return s, nil
+}
+
+func TestTCPConns_Phase(t *testing.T) {
+	info := fakeTCPInfo{}
+	conns := &tcpConns{read: info.read}
+	const addr = "192.0.2.1:8080"
+
+	reusedRaw, _ := net.Pipe()
+	reused := conns.track(reusedRaw, addr)
+	info[reusedRaw] = tcpSample{retransmits: 5, segsOut: 100}
+
+	otherRaw, _ := net.Pipe()
+	conns.track(otherRaw, "192.0.2.2:8080")
+	info[otherRaw] = tcpSample{rtt: time.Second, segsOut: 1000}
+
+	p := conns.begin(addr)
+
+	info[reusedRaw] = tcpSample{rtt: 10 * time.Millisecond, rttvar: 2 * time.Millisecond, cwnd: 10, deliveryRate: 1000, retransmits: 7, segsOut: 300}
+	newRaw, _ := net.Pipe()
+	fresh := conns.track(newRaw, addr)
+	info[newRaw] = tcpSample{rtt: 30 * time.Millisecond, rttvar: 4 * time.Millisecond, cwnd: 20, deliveryRate: 3000, retransmits: 2, segsOut: 100}
+	if err := fresh.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Changes after the close are not seen.
+	info[newRaw] = tcpSample{rtt: time.Second, segsOut: 1000}
+
+	stats, ok := conns.end(p)
+	if !ok {
+		t.Fatal("expected stats")
+	}
+	want := tcpStats{
+		conns:        2,
+		rtt:          20 * time.Millisecond,
+		rttvar:       3 * time.Millisecond,
+		cwnd:         15,
+		deliveryRate: 4000,
+		retransmits:  4,
+		segsOut:      300,
+	}
+	if stats != want {
+		t.Errorf("expected %+v, got %+v", want, stats)
+	}
+	if got := stats.retransmitRatio(); got != 4.0/300 {
+		t.Errorf("unexpected retransmit ratio %v", got)
+	}
+	_ = reused.Close()
+
+	// Connections closed before a phase and idle ones are left out.
+	if _, ok := conns.end(conns.begin(addr)); ok {
+		t.Error("expected no stats for a phase without traffic")
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://speedtest.example:8080/speedtest/upload.php", "speedtest.example:8080"},
+		{"http://speedtest.example/speedtest/upload.php", "speedtest.example:80"},
+		{"https://speedtest.example/speedtest/upload.php", "speedtest.example:443"},
+		{"http://[2001:db8::1]:8080/speedtest/upload.php", "[2001:db8::1]:8080"},
+	}
+	for _, tt := range tests {
+		got, err := serverAddr(&speedtest.Server{URL: tt.url})
+		if err != nil || got != tt.want {
+			t.Errorf("%s: expected %s, got %q (%v)", tt.url, tt.want, got, err)
+		}
+	}
+}
+
+func TestConfig_ValidateTCPInfo(t *testing.T) {
+	if err := (Config{}).ValidateTCPInfo(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err := (Config{TCPInfo: true}).ValidateTCPInfo()
+	if tcpInfoSupported && err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !tcpInfoSupported && err == nil {
+		t.Error("expected an error on an unsupported platform")
+	}
+}
+
+// tcpInfoMockRunner is a mockRunner that reports fixed TCP stats.
+type tcpInfoMockRunner struct {
+	mockRunner
+	stats map[Phase]tcpStats
+}
+
+func (m *tcpInfoMockRunner) TCPStats(_ *speedtest.Server, phase Phase) (tcpStats, bool) {
+	s, ok := m.stats[phase]
+	return s, ok
+}
+
+func TestCollect_TCPInfo(t *testing.T) {
+	runner := &tcpInfoMockRunner{
+		mockRunner: *newTestRunner(),
+		stats: map[Phase]tcpStats{
+			PhaseUpload: {conns: 2, rtt: 20 * time.Millisecond, cwnd: 15, deliveryRate: 4000, retransmits: 3, segsOut: 300},
+		},
+	}
+	client := newTestClient(newTestServer("100"))
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, TCPInfo: true}, client, runner)
+
+	metrics := collectMetrics(e)
+
+	rtt := findAllMetricsByName(metrics, "speedtest_tcp_rtt_seconds")
+	if len(rtt) != 1 {
+		t.Fatalf("expected TCP stats for the upload only, got %d", len(rtt))
+	}
+	if labelValue(rtt[0], "direction") != "upload" || labelValue(rtt[0], "server_id") != "100" {
+		t.Errorf("unexpected labels %v", metricToDTO(rtt[0]).GetLabel())
+	}
+	if got := metricToDTO(rtt[0]).GetGauge().GetValue(); got != 0.02 {
+		t.Errorf("expected an RTT of 0.02s, got %v", got)
+	}
+	if got := metricToDTO(findMetricByName(metrics, "speedtest_tcp_retransmit_ratio")).GetGauge().GetValue(); got != 0.01 {
+		t.Errorf("expected a retransmit ratio of 0.01, got %v", got)
+	}
+}
+
+func TestCollect_TCPInfoDownload(t *testing.T) {
+	runner := &tcpInfoMockRunner{
+		mockRunner: *newTestRunner(),
+		stats: map[Phase]tcpStats{
+			PhaseDownload: {conns: 2, rtt: 20 * time.Millisecond, cwnd: 10, deliveryRate: 4000, retransmits: 3, segsOut: 300},
+		},
+	}
+	client := newTestClient(newTestServer("100"))
+	e := NewWithDeps(Config{ServerIDs: []int{-1}, TCPInfo: true}, client, runner)
+
+	metrics := collectMetrics(e)
+
+	if len(findAllMetricsByName(metrics, "speedtest_tcp_rtt_seconds")) != 1 {
+		t.Error("expected the RTT of the download")
+	}
+	// The exporter receives during downloads, so its delivery rate and
+	// retransmissions do not describe the transfer.
+	for _, name := range []string{"speedtest_tcp_delivery_rate_bytes_per_second", "speedtest_tcp_retransmitted_segments", "speedtest_tcp_retransmit_ratio"} {
+		if m := findAllMetricsByName(metrics, name); len(m) != 0 {
+			t.Errorf("expected no %s for the download, got %d", name, len(m))
+		}
+	}
+}
+
+func TestDefaultRunner_Proxied(t *testing.T) {
+	cfg := Config{ProxyURL: "http://proxy.example:3128", NoProxy: "direct.example"}
+	runner := &defaultRunner{proxy: proxyFunc(cfg)}
+	for host, want := range map[string]bool{"speedtest.example": true, "direct.example": false} {
+		server := newTestServer("100")
+		server.URL = "http://" + host + ":8080/speedtest/upload.php"
+		if got := runner.proxied(server); got != want {
+			t.Errorf("%s: expected proxied %v, got %v", host, want, got)
+		}
+	}
+	if (&defaultRunner{}).proxied(newTestServer("100")) {
+		t.Error("expected a runner without proxy selection to connect directly")
+	}
+}
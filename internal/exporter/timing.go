@@ -0,0 +1,126 @@
+package exporter
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP phases timed for each request.
+const (
+	phaseConnect = "connect"
+	phaseTLS     = "tls_handshake"
+	phaseTTFB    = "ttfb"
+)
+
+// httpTimingKey identifies the requests whose timings are averaged together.
+type httpTimingKey struct {
+	phase  string
+	target string
+}
+
+// httpTimings collects connection-level timings of one session.
+type httpTimings struct {
+	mu      sync.Mutex
+	samples map[httpTimingKey][]time.Duration
+}
+
+func newHTTPTimings() *httpTimings {
+	return &httpTimings{samples: make(map[httpTimingKey][]time.Duration)}
+}
+
+func (t *httpTimings) record(phase, target string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	k := httpTimingKey{phase: phase, target: target}
+	t.samples[k] = append(t.samples[k], d)
+}
+
+// averages returns the mean duration of every phase and target seen.
+func (t *httpTimings) averages() map[httpTimingKey]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	avg := make(map[httpTimingKey]time.Duration, len(t.samples))
+	for k, samples := range t.samples {
+		var sum time.Duration
+		for _, d := range samples {
+			sum += d
+		}
+		avg[k] = sum / time.Duration(len(samples))
+	}
+	return avg
+}
+
+// timingTarget names the kind of speedtest request req is.
+func timingTarget(req *http.Request) string {
+	p := req.URL.Path
+	switch {
+	case strings.HasSuffix(p, "/speedtest-config.php"):
+		return "user_info"
+	case strings.HasPrefix(p, "/api/js/servers"), strings.HasSuffix(p, "/speedtest-servers-static.php"), strings.HasSuffix(p, "/ios-config.php"):
+		return "server_list"
+	case strings.HasSuffix(p, "/latency.txt"):
+		return "ping"
+	case req.Method == http.MethodPost:
+		return "upload"
+	}
+	return "download"
+}
+
+// timingTransport records the TCP connect, TLS handshake and time to first
+// byte of every request. Connect and handshake are only recorded for
+// requests that opened a new connection. Time to first byte runs from the
+// request being written to the first byte of the response.
+type timingTransport struct {
+	next    http.RoundTripper
+	timings *httpTimings
+}
+
+func (t *timingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := timingTarget(req)
+	var mu sync.Mutex
+	var connectStart, tlsStart, wrote time.Time
+	trace := &httptrace.ClientTrace{
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			connectStart = time.Now()
+		},
+		ConnectDone: func(_, _ string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && !connectStart.IsZero() {
+				t.timings.record(phaseConnect, target, time.Since(connectStart))
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil && !tlsStart.IsZero() {
+				t.timings.record(phaseTLS, target, time.Since(tlsStart))
+			}
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			wrote = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if !wrote.IsZero() {
+				t.timings.record(phaseTTFB, target, time.Since(wrote))
+			}
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	return t.next.RoundTrip(req)
+}
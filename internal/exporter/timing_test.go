@@ -0,0 +1,104 @@
+package exporter
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+func TestTimingTarget(t *testing.T) {
+	tests := []struct {
+		method string
+		url    string
+		want   string
+	}{
+		{http.MethodGet, "https://www.speedtest.net/speedtest-config.php", "user_info"},
+		{http.MethodGet, "https://www.speedtest.net/api/js/servers?engine=js", "server_list"},
+		{http.MethodGet, "https://www.speedtest.net/speedtest-servers-static.php", "server_list"},
+		{http.MethodGet, "http://speedtest.example:8080/speedtest/latency.txt", "ping"},
+		{http.MethodGet, "http://speedtest.example:8080/speedtest/random1000x1000.jpg", "download"},
+		{http.MethodPost, "http://speedtest.example:8080/speedtest/upload.php", "upload"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, nil)
+		if got := timingTarget(req); got != tt.want {
+			t.Errorf("%s %s: expected %q, got %q", tt.method, tt.url, tt.want, got)
+		}
+	}
+}
+
+func TestTimingTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "[]")
+	}))
+	defer srv.Close()
+
+	timings := newHTTPTimings()
+	client := &http.Client{Transport: &timingTransport{next: srv.Client().Transport, timings: timings}}
+
+	for range 2 {
+		resp, err := client.Get(srv.URL + "/api/js/servers")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+	counts := map[string]int{phaseConnect: 1, phaseTLS: 1, phaseTTFB: 2}
+	for phase, want := range counts {
+		if got := len(timings.samples[httpTimingKey{phase: phase, target: "server_list"}]); got != want {
+			t.Errorf("%s: expected %d samples, got %d", phase, want, got)
+		}
+	}
+}
+
+func TestHTTPTimings_Averages(t *testing.T) {
+	timings := newHTTPTimings()
+	timings.record(phaseTTFB, "download", 10*time.Millisecond)
+	timings.record(phaseTTFB, "download", 30*time.Millisecond)
+	timings.record(phaseConnect, "upload", 5*time.Millisecond)
+
+	avg := timings.averages()
+	if got := avg[httpTimingKey{phase: phaseTTFB, target: "download"}]; got != 20*time.Millisecond {
+		t.Errorf("expected 20ms, got %v", got)
+	}
+	if got := avg[httpTimingKey{phase: phaseConnect, target: "upload"}]; got != 5*time.Millisecond {
+		t.Errorf("expected 5ms, got %v", got)
+	}
+}
+
+// httpTimingMockClient is a mockClient that reports fixed HTTP timings.
+type httpTimingMockClient struct {
+	mockClient
+	timings map[httpTimingKey]time.Duration
+}
+
+func (c *httpTimingMockClient) HTTPTimings() map[httpTimingKey]time.Duration { return c.timings }
+
+func TestCollect_HTTPPhaseSeconds(t *testing.T) {
+	client := &httpTimingMockClient{
+		mockClient: mockClient{user: newTestUser(), servers: speedtest.Servers{newTestServer("100")}},
+		timings:    map[httpTimingKey]time.Duration{{phase: phaseTLS, target: "server_list"}: 40 * time.Millisecond},
+	}
+	e := NewWithDeps(Config{ServerIDs: []int{-1}}, client, newTestRunner())
+
+	metrics := collectMetrics(e)
+
+	m := findMetricByName(metrics, "speedtest_http_phase_seconds")
+	if m == nil {
+		t.Fatal("speedtest_http_phase_seconds metric not found")
+	}
+	if labelValue(m, "phase") != "tls_handshake" || labelValue(m, "target") != "server_list" {
+		t.Errorf("unexpected labels %v", metricToDTO(m).GetLabel())
+	}
+	if got := metricToDTO(m).GetGauge().GetValue(); got != 0.04 {
+		t.Errorf("expected 0.04, got %v", got)
+	}
+}
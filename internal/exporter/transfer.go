@@ -0,0 +1,215 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// TransferConfig controls the download and upload phases. Zero values keep
+// speedtest-go's defaults.
+type TransferConfig struct {
+	// Duration caps how long each bandwidth phase runs. speedtest-go may still
+	// stop earlier once the measured rate is stable.
+	Duration time.Duration `yaml:"duration"`
+	// PayloadSize is the approximate number of bytes moved per request.
+	// Downloads use the closest test file the server offers.
+	PayloadSize int64 `yaml:"payload_size"`
+	// Warmup is discarded from the start of each phase, so TCP slow start does
+	// not drag the result down.
+	Warmup time.Duration `yaml:"warmup"`
+}
+
+// Validate checks that the settings are usable together.
+func (t TransferConfig) Validate() error {
+	if t.Duration < 0 || t.PayloadSize < 0 || t.Warmup < 0 {
+		return fmt.Errorf("transfer settings must not be negative")
+	}
+	if t.Duration > 0 && t.Warmup >= t.Duration {
+		return fmt.Errorf("transfer warmup %s must be shorter than the duration %s", t.Warmup, t.Duration)
+	}
+	return nil
+}
+
+// custom reports whether the transfers need more control than speedtest-go's
+// own download and upload tests offer.
+func (t TransferConfig) custom() bool {
+	return t.PayloadSize > 0 || t.Warmup > 0
+}
+
+// downloadFiles are the random*.jpg test files served by speedtest.net
+// servers, by side length and approximate size in bytes.
+var downloadFiles = []struct {
+	side  int
+	bytes int64
+}{
+	{350, 245388},
+	{500, 505544},
+	{750, 1118012},
+	{1000, 1986284},
+	{1500, 4468241},
+	{2000, 7907740},
+	{2500, 12407926},
+	{3000, 17816816},
+	{3500, 24262167},
+	{4000, 31625365},
+}
+
+const (
+	// defaultDownloadSide and defaultUploadSize match what speedtest-go requests.
+	defaultDownloadSide = 1000
+	defaultUploadSize   = 999490
+)
+
+// downloadSide returns the side length of the smallest test file holding at
+// least payload bytes, or the largest file if none does.
+func downloadSide(payload int64) int {
+	if payload <= 0 {
+		return defaultDownloadSide
+	}
+	for _, f := range downloadFiles {
+		if f.bytes >= payload {
+			return f.side
+		}
+	}
+	return downloadFiles[len(downloadFiles)-1].side
+}
+
+// downloadTest measures download speed with the configured payload size and
+// warm-up period. It reuses speedtest-go's data manager to run the requests.
+func (d *defaultRunner) downloadTest(ctx context.Context, server *speedtest.Server) error {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		return err
+	}
+	u.Path = path.Dir(u.Path)
+	side := downloadSide(d.transfer.PayloadSize)
+	target := u.JoinPath(fmt.Sprintf("random%dx%d.jpg", side, side)).String()
+
+	m := server.Context.Manager
+	m.Reset()
+	m.SetCallbackDownload(throughputSampler(ctx))
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var failures atomic.Int64
+	td := m.RegisterDownloadHandler(func() {
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, target, nil)
+		if err != nil {
+			failures.Add(1)
+			return
+		}
+		resp, err := d.doer.Do(req)
+		if err != nil {
+			failures.Add(1)
+			return
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if err := m.NewChunk().DownloadHandler(resp.Body); err != nil {
+			failures.Add(1)
+		}
+	})
+
+	rate, elapsed := d.measure(td, cancel, m.GetTotalDownload, m.GetEWMADownloadRate)
+	if err := transferError(ctx, m.GetTotalDownload(), failures.Load()); err != nil {
+		return err
+	}
+	server.DLSpeed = speedtest.ByteRate(rate)
+	server.TestDuration.Download = &elapsed
+	return nil
+}
+
+// uploadTest measures upload speed with the configured payload size and
+// warm-up period. It reuses speedtest-go's data manager to run the requests.
+func (d *defaultRunner) uploadTest(ctx context.Context, server *speedtest.Server) error {
+	size := d.transfer.PayloadSize
+	if size <= 0 {
+		size = defaultUploadSize
+	}
+
+	m := server.Context.Manager
+	m.Reset()
+	m.SetCallbackUpload(throughputSampler(ctx))
+	reqCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var failures atomic.Int64
+	td := m.RegisterUploadHandler(func() {
+		body := m.NewChunk().UploadHandler(size)
+		req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, server.URL, io.NopCloser(body))
+		if err != nil {
+			failures.Add(1)
+			return
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := d.doer.Do(req)
+		if err != nil {
+			failures.Add(1)
+			return
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	})
+
+	rate, elapsed := d.measure(td, cancel, m.GetTotalUpload, m.GetEWMAUploadRate)
+	if err := transferError(ctx, m.GetTotalUpload(), failures.Load()); err != nil {
+		return err
+	}
+	server.ULSpeed = speedtest.ByteRate(rate)
+	server.TestDuration.Upload = &elapsed
+	return nil
+}
+
+// measure runs td until speedtest-go stops it and returns the throughput in
+// bytes per second. Without a warm-up period speedtest-go's EWMA rate is
+// used; with one, the bytes moved before it elapsed are discarded.
+func (d *defaultRunner) measure(td *speedtest.TestDirection, cancel context.CancelFunc, total func() int64, ewma func() float64) (float64, time.Duration) {
+	start := time.Now()
+	if d.transfer.Warmup <= 0 {
+		td.Start(cancel, 0)
+		return ewma(), time.Since(start)
+	}
+
+	var mu sync.Mutex
+	var warmBytes int64
+	var warmAt time.Time
+	timer := time.AfterFunc(d.transfer.Warmup, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		warmBytes, warmAt = total(), time.Now()
+	})
+	td.Start(cancel, 0)
+	timer.Stop()
+	end := time.Now()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if warmAt.IsZero() || !end.After(warmAt) {
+		slog.Warn("transfer finished before the warm-up period ended, using the full transfer", "warmup", d.transfer.Warmup)
+		return ewma(), end.Sub(start)
+	}
+	return float64(total()-warmBytes) / end.Sub(warmAt).Seconds(), end.Sub(start)
+}
+
+// transferError reports a failed transfer: one that was cancelled, or that
+// moved no data while its requests failed.
+func transferError(ctx context.Context, bytes, failures int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if bytes == 0 && failures > 0 {
+		return errors.New("no data transferred, all requests failed")
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+// fakeSpeedtestServer serves the download and upload endpoints of a
+// speedtest.net server and records what was requested.
+type fakeSpeedtestServer struct {
+	*httptest.Server
+	mu          sync.Mutex
+	paths       map[string]bool
+	uploadSizes map[int64]bool
+}
+
+func newFakeSpeedtestServer(t *testing.T) *fakeSpeedtestServer {
+	t.Helper()
+	f := &fakeSpeedtestServer{paths: make(map[string]bool), uploadSizes: make(map[int64]bool)}
+	chunk := []byte(strings.Repeat("x", 64*1024))
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.paths[r.URL.Path] = true
+		if r.Method == http.MethodPost {
+			f.uploadSizes[r.ContentLength] = true
+		}
+		f.mu.Unlock()
+
+		if r.Method == http.MethodPost {
+			n, _ := io.Copy(io.Discard, r.Body)
+			_, _ = fmt.Fprintf(w, "size=%d", n)
+			return
+		}
+		for range 4 {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSpeedtestServer) requested(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.paths[path]
+}
+
+func (f *fakeSpeedtestServer) server(doer *http.Client) *speedtest.Server {
+	return &speedtest.Server{
+		ID:      "1",
+		URL:     f.URL + "/speedtest/upload.php",
+		Context: speedtest.New(speedtest.WithDoer(doer)),
+	}
+}
+
+func TestDefaultRunner_CustomDownload(t *testing.T) {
+	fake := newFakeSpeedtestServer(t)
+	meters := newTrafficMeters(net.DefaultResolver, IPFamilyAny)
+	doer := newHTTPClient(Config{}, Link{}, IPFamilyAny, meters)
+	runner := &defaultRunner{doer: doer, transfer: TransferConfig{
+		Duration:    time.Second,
+		PayloadSize: 100000,
+		Warmup:      200 * time.Millisecond,
+	}}
+	server := fake.server(doer)
+
+	if err := runner.DownloadTest(context.Background(), server); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if server.DLSpeed <= 0 {
+		t.Errorf("expected a positive download speed, got %f", float64(server.DLSpeed))
+	}
+	if !fake.requested("/speedtest/random350x350.jpg") {
+		t.Error("expected the 350x350 test file to be requested")
+	}
+	if server.TestDuration.Download == nil || *server.TestDuration.Download > 2*time.Second {
+		t.Errorf("expected the download to stop within the duration limit, took %v", server.TestDuration.Download)
+	}
+}
+
+func TestDefaultRunner_CustomUpload(t *testing.T) {
+	fake := newFakeSpeedtestServer(t)
+	meters := newTrafficMeters(net.DefaultResolver, IPFamilyAny)
+	doer := newHTTPClient(Config{}, Link{}, IPFamilyAny, meters)
+	runner := &defaultRunner{doer: doer, transfer: TransferConfig{
+		Duration:    time.Second,
+		PayloadSize: 50000,
+	}}
+	server := fake.server(doer)
+
+	if err := runner.UploadTest(context.Background(), server); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if server.ULSpeed <= 0 {
+		t.Errorf("expected a positive upload speed, got %f", float64(server.ULSpeed))
+	}
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.uploadSizes) != 1 || !fake.uploadSizes[50000] {
+		t.Errorf("expected every upload to carry 50000 bytes, got %v", fake.uploadSizes)
+	}
+}
+
+func TestDefaultRunner_CustomDownload_ServerDown(t *testing.T) {
+	fake := newFakeSpeedtestServer(t)
+	meters := newTrafficMeters(net.DefaultResolver, IPFamilyAny)
+	doer := newHTTPClient(Config{}, Link{}, IPFamilyAny, meters)
+	runner := &defaultRunner{doer: doer, transfer: TransferConfig{Duration: 300 * time.Millisecond, PayloadSize: 1}}
+	server := fake.server(doer)
+	fake.Close()
+
+	if err := runner.DownloadTest(context.Background(), server); err == nil {
+		t.Fatal("expected error when every request fails")
+	}
+}
+
+func TestDownloadSide(t *testing.T) {
+	tests := []struct {
+		payload int64
+		want    int
+	}{
+		{payload: 0, want: 1000},
+		{payload: 1, want: 350},
+		{payload: 245388, want: 350},
+		{payload: 245389, want: 500},
+		{payload: 10_000_000, want: 2500},
+		{payload: 1 << 40, want: 4000},
+	}
+	for _, tt := range tests {
+		if got := downloadSide(tt.payload); got != tt.want {
+			t.Errorf("downloadSide(%d) = %d, want %d", tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestTransferConfig_Validate(t *testing.T) {
+	if err := (TransferConfig{Duration: 10 * time.Second, Warmup: 2 * time.Second}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (TransferConfig{Duration: 2 * time.Second, Warmup: 2 * time.Second}).Validate(); err == nil {
+		t.Error("expected error when warmup is not shorter than duration")
+	}
+	if err := (TransferConfig{PayloadSize: -1}).Validate(); err == nil {
+		t.Error("expected error for negative payload size")
+	}
+}
+
+func TestDefaultRunner_CustomDownload_Samples(t *testing.T) {
+	fake := newFakeSpeedtestServer(t)
+	meters := newTrafficMeters(net.DefaultResolver, IPFamilyAny)
+	doer := newHTTPClient(Config{}, Link{}, IPFamilyAny, meters)
+	runner := &defaultRunner{doer: doer, transfer: TransferConfig{Duration: time.Second, PayloadSize: 100000}}
+
+	var mu sync.Mutex
+	var samples []float64
+	ctx := context.WithValue(context.Background(), sampleKey{}, func(v float64) {
+		mu.Lock()
+		defer mu.Unlock()
+		samples = append(samples, v)
+	})
+	if err := runner.DownloadTest(ctx, fake.server(doer)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(samples) == 0 {
+		t.Error("expected the rolling download speed to be sampled")
+	}
+}
@@ -0,0 +1,195 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/showwin/speedtest-go/speedtest"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// newHTTPClient returns the client used for all speedtest traffic. It mirrors
+// the transport speedtest-go builds for itself, but binds connections to the
+// link's source and IP family and honours the module's proxy settings. Name
+// resolution, bytes sent and received, HTTP timings and TCP_INFO go through
+// meters.
+func newHTTPClient(cfg Config, link Link, family IPFamily, meters *trafficMeters) *http.Client {
+	dialer := newDialer(link)
+	transport := &http.Transport{
+		Proxy: proxyFunc(cfg),
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := meters.lookups.dial(ctx, dialer, family.network(network), addr)
+			if err != nil {
+				return nil, err
+			}
+			if meters.conns != nil {
+				conn = meters.conns.track(conn, addr)
+			}
+			return &countingConn{Conn: conn, n: &meters.bytes}, nil
+		},
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport: &headerTransport{
+			next:      &timingTransport{next: transport, timings: meters.timings},
+			userAgent: cfg.userAgent(),
+			header:    cfg.header(),
+		},
+	}
+}
+
+// trafficMeters measure the traffic of one session.
+type trafficMeters struct {
+	bytes   atomic.Int64
+	lookups *dnsLookups
+	timings *httpTimings
+	// conns is only set when TCP_INFO is read.
+	conns *tcpConns
+}
+
+func newTrafficMeters(resolver hostResolver, family IPFamily) *trafficMeters {
+	return &trafficMeters{
+		lookups: newDNSLookups(resolver, family),
+		timings: newHTTPTimings(),
+	}
+}
+
+// newDialer returns a dialer bound to the link's source address and
+// interface. The source address has been validated with ValidateLinks.
+func newDialer(link Link) *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if link.SourceAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(link.SourceAddress)}
+	}
+	if link.Interface != "" {
+		dialer.Control = bindToDevice(link.Interface)
+	}
+	return dialer
+}
+
+// proxyFunc returns the proxy selection for cfg: ProxyURL for every host not
+// matched by NoProxy, or the proxy environment variables when ProxyURL is not
+// set.
+func proxyFunc(cfg Config) func(*http.Request) (*url.URL, error) {
+	if cfg.ProxyURL == "" {
+		return http.ProxyFromEnvironment
+	}
+	pc := &httpproxy.Config{
+		HTTPProxy:  cfg.ProxyURL,
+		HTTPSProxy: cfg.ProxyURL,
+		NoProxy:    cfg.NoProxy,
+	}
+	proxy := pc.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}
+}
+
+// ValidateProxy checks that ProxyURL names a proxy scheme net/http supports.
+func (c Config) ValidateProxy() error {
+	if c.ProxyURL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.ProxyURL)
+	if err != nil {
+		return fmt.Errorf("invalid proxy_url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported proxy_url scheme %q, use http, https, socks5 or socks5h", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxy_url %q has no host", u.Redacted())
+	}
+	return nil
+}
+
+// userAgent returns the User-Agent sent with test traffic.
+func (c Config) userAgent() string {
+	if c.UserAgent != "" {
+		return c.UserAgent
+	}
+	return speedtest.DefaultUserAgent
+}
+
+// header returns the extra request headers in canonical form.
+func (c Config) header() http.Header {
+	h := make(http.Header, len(c.Headers))
+	for name, value := range c.Headers {
+		h.Set(name, value)
+	}
+	return h
+}
+
+// ValidateHeaders checks the User-Agent and extra headers. Headers that
+// net/http manages itself can't be overridden.
+func (c Config) ValidateHeaders() error {
+	if !httpguts.ValidHeaderFieldValue(c.UserAgent) {
+		return fmt.Errorf("invalid user_agent %q", c.UserAgent)
+	}
+	for name, value := range c.Headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return fmt.Errorf("invalid value for header %s", name)
+		}
+		switch http.CanonicalHeaderKey(name) {
+		case "User-Agent":
+			return fmt.Errorf("set the User-Agent with user_agent, not headers")
+		case "Host", "Content-Length", "Transfer-Encoding", "Connection":
+			return fmt.Errorf("header %s can't be set", name)
+		}
+	}
+	return nil
+}
+
+// headerTransport sets the User-Agent that speedtest-go would otherwise add
+// in its own RoundTripper, which is bypassed when a custom client is used,
+// and the module's extra headers.
+type headerTransport struct {
+	next      http.RoundTripper
+	userAgent string
+	header    http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	for name, values := range t.header {
+		req.Header[name] = values
+	}
+	return t.next.RoundTrip(req)
+}
+
+// countingConn adds the bytes read from and written to a connection to n.
+type countingConn struct {
+	net.Conn
+	n *atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,173 @@
+package exporter
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/showwin/speedtest-go/speedtest"
+)
+
+func TestNewHTTPClient_CountsBytesAndSetsUserAgent(t *testing.T) {
+	payload := strings.Repeat("x", 4096)
+	var gotUA string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUA = r.Header.Get("User-Agent")
+		_, _ = io.WriteString(w, payload)
+	}))
+	defer srv.Close()
+
+	meters := newTrafficMeters(net.DefaultResolver, IPFamilyAny)
+	client := newHTTPClient(Config{}, Link{}, IPFamilyAny, meters)
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if gotUA != speedtest.DefaultUserAgent {
+		t.Errorf("expected User-Agent %q, got %q", speedtest.DefaultUserAgent, gotUA)
+	}
+	// Request and response headers add to the body size.
+	if got := meters.bytes.Load(); got <= int64(len(payload)) {
+		t.Errorf("expected more than %d bytes counted, got %d", len(payload), got)
+	}
+}
+
+func TestNewHTTPClient_CustomHeaders(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer srv.Close()
+
+	cfg := Config{UserAgent: "Mozilla/5.0", Headers: map[string]string{"accept-language": "en-US", "X-Test": "a"}}
+	client := newHTTPClient(cfg, Link{}, IPFamilyAny, newTrafficMeters(net.DefaultResolver, IPFamilyAny))
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("X-Test", "overridden")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if ua := got.Get("User-Agent"); ua != "Mozilla/5.0" {
+		t.Errorf("expected the custom User-Agent, got %q", ua)
+	}
+	if v := got.Get("Accept-Language"); v != "en-US" {
+		t.Errorf("expected Accept-Language en-US, got %q", v)
+	}
+	if v := got.Values("X-Test"); len(v) != 1 || v[0] != "a" {
+		t.Errorf("expected the configured X-Test to replace the request's, got %q", v)
+	}
+}
+
+func TestConfig_ValidateHeaders(t *testing.T) {
+	valid := Config{UserAgent: "Mozilla/5.0 (X11; Linux x86_64)", Headers: map[string]string{"Accept-Language": "en-US", "X-Client": ""}}
+	if err := valid.ValidateHeaders(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, cfg := range []Config{
+		{UserAgent: "bad\nagent"},
+		{Headers: map[string]string{"Bad Name": "x"}},
+		{Headers: map[string]string{"X-Test": "bad\r\nvalue"}},
+		{Headers: map[string]string{"user-agent": "curl"}},
+		{Headers: map[string]string{"Host": "speedtest.example"}},
+	} {
+		if err := cfg.ValidateHeaders(); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestNewHTTPClient_SourceAddress(t *testing.T) {
+	var remote string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+	}))
+	defer srv.Close()
+
+	meters := newTrafficMeters(net.DefaultResolver, IPFamilyAny)
+	client := newHTTPClient(Config{}, Link{SourceAddress: "127.0.0.1"}, IPFamilyAny, meters)
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	host, _, _ := net.SplitHostPort(remote)
+	if host != "127.0.0.1" {
+		t.Errorf("expected connection from 127.0.0.1, got %s", remote)
+	}
+}
+
+func TestNewHTTPClient_Proxy(t *testing.T) {
+	var gotURL, gotAuth string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURL = r.URL.String()
+		gotAuth = r.Header.Get("Proxy-Authorization")
+	}))
+	defer proxy.Close()
+
+	meters := newTrafficMeters(net.DefaultResolver, IPFamilyAny)
+	proxyURL := strings.Replace(proxy.URL, "http://", "http://user:secret@", 1)
+	client := newHTTPClient(Config{ProxyURL: proxyURL}, Link{}, IPFamilyAny, meters)
+
+	resp, err := client.Get("http://speedtest.example/speedtest-config.php")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if gotURL != "http://speedtest.example/speedtest-config.php" {
+		t.Errorf("expected the request to go through the proxy, proxy saw %q", gotURL)
+	}
+	if gotAuth != "Basic dXNlcjpzZWNyZXQ=" {
+		t.Errorf("expected proxy credentials, got %q", gotAuth)
+	}
+	if meters.bytes.Load() == 0 {
+		t.Error("expected proxied traffic to be counted")
+	}
+}
+
+func TestProxyFunc_NoProxy(t *testing.T) {
+	proxy := proxyFunc(Config{ProxyURL: "socks5://proxy.example:1080", NoProxy: "internal.example,.corp.example"})
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://www.speedtest.net/api/js/servers", "socks5://proxy.example:1080"},
+		{"http://internal.example/upload.php", ""},
+		{"http://speedtest.corp.example/upload.php", ""},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest(http.MethodGet, tt.url, nil)
+		got, err := proxy(req)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.url, err)
+		}
+		if (got == nil && tt.want != "") || (got != nil && got.String() != tt.want) {
+			t.Errorf("%s: expected proxy %q, got %v", tt.url, tt.want, got)
+		}
+	}
+}
+
+func TestConfig_ValidateProxy(t *testing.T) {
+	for _, valid := range []string{"", "http://proxy:3128", "https://user:pw@proxy:443", "socks5://proxy:1080", "socks5h://proxy:1080"} {
+		if err := (Config{ProxyURL: valid}).ValidateProxy(); err != nil {
+			t.Errorf("%q: unexpected error: %v", valid, err)
+		}
+	}
+	for _, invalid := range []string{"ftp://proxy:21", "proxy:3128", "http://"} {
+		if err := (Config{ProxyURL: invalid}).ValidateProxy(); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
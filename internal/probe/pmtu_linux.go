@@ -0,0 +1,225 @@
+//go:build linux
+
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// mtuResult is the outcome of a single MTU probe.
+type mtuResult int
+
+const (
+	mtuLost mtuResult = iota
+	mtuFits
+	mtuTooBig
+)
+
+// pathMTU sends UDP probes with the don't-fragment bit set and IP_RECVERR
+// enabled. IP_PMTUDISC_PROBE ignores the kernel's cached path MTU, so each
+// probe leaves at the size asked for.
+func pathMTU(ctx context.Context, dst netip.Addr, opts Options) (int, error) {
+	domain, level, discoverOpt, probeMode, recvErrOpt := unix.AF_INET, unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_PROBE, unix.IP_RECVERR
+	headers, floor := 20+8, 576
+	if dst.Is6() {
+		domain, level, discoverOpt, probeMode, recvErrOpt = unix.AF_INET6, unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_PROBE, unix.IPV6_RECVERR
+		headers, floor = 40+8, 1280
+	}
+
+	fd, err := unix.Socket(domain, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = unix.Close(fd) }()
+
+	for _, o := range [][2]int{{recvErrOpt, 1}, {discoverOpt, probeMode}} {
+		if err := unix.SetsockoptInt(fd, level, o[0], o[1]); err != nil {
+			return 0, err
+		}
+	}
+	if opts.Interface != "" {
+		if err := unix.BindToDevice(fd, opts.Interface); err != nil {
+			return 0, err
+		}
+	}
+	if opts.Source.IsValid() {
+		if err := unix.Bind(fd, sockaddr(opts.Source, 0)); err != nil {
+			return 0, err
+		}
+	}
+
+	hi, err := routeMTU(dst, opts)
+	if err != nil {
+		return 0, err
+	}
+	// The IP total length field limits a packet to 65535 bytes.
+	hi = min(hi, 65535)
+	lo := 0 // largest size known to arrive
+	p := &mtuProber{fd: fd, dst: dst, port: opts.Port, timeout: opts.Timeout, headers: headers}
+
+	size := hi
+	for range MaxMTUProbes {
+		if lo >= hi {
+			return lo, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		res, mtu, err := p.probe(ctx, size)
+		if err != nil {
+			return 0, err
+		}
+		switch res {
+		case mtuFits:
+			lo = size
+		case mtuTooBig:
+			if mtu >= floor && mtu < size {
+				hi = mtu
+			} else {
+				hi = size - 1
+			}
+		case mtuLost:
+			// Without an answer the probe may have been dropped for its size
+			// by a PMTU blackhole, or the destination ignores probes.
+			if size <= floor {
+				return 0, errors.New("no answer to MTU probes of the minimum size")
+			}
+			hi = size - 1
+		}
+		switch {
+		case lo == 0 && res != mtuTooBig && hi >= floor:
+			// Make sure the destination answers at all before bisecting.
+			size = floor
+		case res == mtuTooBig:
+			size = hi
+		default:
+			size = lo + (hi-lo+1)/2
+		}
+	}
+	return 0, fmt.Errorf("no path MTU found after %d probes", MaxMTUProbes)
+}
+
+// routeMTU returns the MTU of the route to dst, the upper bound of the search.
+func routeMTU(dst netip.Addr, opts Options) (int, error) {
+	domain, level, mtuOpt := unix.AF_INET, unix.IPPROTO_IP, unix.IP_MTU
+	if dst.Is6() {
+		domain, level, mtuOpt = unix.AF_INET6, unix.IPPROTO_IPV6, unix.IPV6_MTU
+	}
+	fd, err := unix.Socket(domain, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = unix.Close(fd) }()
+	if opts.Interface != "" {
+		if err := unix.BindToDevice(fd, opts.Interface); err != nil {
+			return 0, err
+		}
+	}
+	if opts.Source.IsValid() {
+		if err := unix.Bind(fd, sockaddr(opts.Source, 0)); err != nil {
+			return 0, err
+		}
+	}
+	if err := unix.Connect(fd, sockaddr(dst, opts.Port)); err != nil {
+		return 0, err
+	}
+	return unix.GetsockoptInt(fd, level, mtuOpt)
+}
+
+// mtuProber sends MTU probes of a given packet size.
+type mtuProber struct {
+	fd      int
+	dst     netip.Addr
+	port    int
+	timeout time.Duration
+	headers int
+	seq     uint32
+}
+
+// probe sends a packet of size bytes, counting the IP and UDP headers, and
+// retries once when nothing answers. For mtuTooBig, mtu is the next-hop MTU
+// reported by the router, or 0.
+func (p *mtuProber) probe(ctx context.Context, size int) (mtuResult, int, error) {
+	for range 2 {
+		p.seq++
+		payload := make([]byte, size-p.headers)
+		binary.BigEndian.PutUint32(payload, p.seq)
+		err := unix.Sendto(p.fd, payload, 0, sockaddr(p.dst, p.port))
+		if errors.Is(err, unix.EMSGSIZE) {
+			return mtuTooBig, 0, nil
+		}
+		if err != nil {
+			return mtuLost, 0, err
+		}
+		res, mtu, err := p.wait(ctx, payload[:4])
+		if err != nil || res != mtuLost {
+			return res, mtu, err
+		}
+	}
+	return mtuLost, 0, nil
+}
+
+// wait waits for the answer to the probe starting with id.
+func (p *mtuProber) wait(ctx context.Context, id []byte) (mtuResult, int, error) {
+	deadline := time.Now().Add(p.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	buf := make([]byte, 512)
+	oob := make([]byte, 512)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return mtuLost, 0, nil
+		}
+		fds := []unix.PollFd{{Fd: int32(p.fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(remaining.Milliseconds())+1)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return mtuLost, 0, err
+		}
+		if n == 0 {
+			continue
+		}
+
+		// A reply from a UDP service listening on the destination port.
+		if fds[0].Revents&unix.POLLIN != 0 {
+			n, _, err := unix.Recvfrom(p.fd, buf, unix.MSG_DONTWAIT)
+			if err == nil && n >= len(id) && string(buf[:len(id)]) == string(id) {
+				return mtuFits, 0, nil
+			}
+		}
+		if fds[0].Revents&unix.POLLERR == 0 {
+			continue
+		}
+
+		n, oobn, _, _, err := unix.Recvmsg(p.fd, buf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		if err != nil || n < len(id) || string(buf[:len(id)]) != string(id) {
+			continue
+		}
+		e, ok := parseRecvErr(oob[:oobn])
+		if !ok {
+			continue
+		}
+		switch {
+		case p.dst.Is4() && e.icmpType == icmpDestUnreachable && e.icmpCode == icmpFragNeeded,
+			p.dst.Is6() && e.icmpType == icmp6PacketTooBig:
+			return mtuTooBig, int(e.info), nil
+		case e.from == p.dst:
+			// Any other error from the destination means the probe arrived.
+			return mtuFits, 0, nil
+		default:
+			return mtuLost, 0, fmt.Errorf("%s reported %s unreachable", e.from, p.dst)
+		}
+	}
+}
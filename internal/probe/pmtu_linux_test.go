@@ -0,0 +1,73 @@
+//go:build linux
+
+package probe
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// blackhole answers UDP datagrams on addr that fit in a packet of mtu bytes
+// and silently drops larger ones, like a path with a PMTU blackhole.
+func blackhole(t *testing.T, addr string, mtu int) int {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(addr, "0"))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", addr, err)
+	}
+	t.Cleanup(func() { _ = pc.Close() })
+	headers := 20 + 8
+	if netip.MustParseAddr(addr).Is6() {
+		headers = 40 + 8
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n+headers <= mtu {
+				_, _ = pc.WriteTo(buf[:n], from)
+			}
+		}
+	}()
+	return pc.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestPathMTU_Blackhole(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		t.Run(addr, func(t *testing.T) {
+			port := blackhole(t, addr, 1400)
+			mtu, err := PathMTU(context.Background(), netip.MustParseAddr(addr), Options{Port: port, Timeout: 50 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if mtu != 1400 {
+				t.Errorf("expected a path MTU of 1400, got %d", mtu)
+			}
+		})
+	}
+}
+
+func TestPathMTU_Loopback(t *testing.T) {
+	dst := netip.MustParseAddr("127.0.0.1")
+	mtu, err := PathMTU(context.Background(), dst, Options{Port: closedPort(t, "127.0.0.1"), Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Loopback's MTU is larger than any IPv4 packet, so the first probe fits.
+	if mtu != 65535 {
+		t.Errorf("expected the largest IPv4 packet to fit, got %d", mtu)
+	}
+}
+
+func TestPathMTU_NoAnswer(t *testing.T) {
+	port := blackhole(t, "127.0.0.1", 0)
+	if _, err := PathMTU(context.Background(), netip.MustParseAddr("127.0.0.1"), Options{Port: port, Timeout: 20 * time.Millisecond}); err == nil {
+		t.Error("expected an error when the destination never answers")
+	}
+}
@@ -0,0 +1,86 @@
+// Package probe discovers the network path to a host.
+package probe
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// ErrUnsupported is returned by Traceroute and PathMTU on platforms without
+// an unprivileged way to receive ICMP errors.
+var ErrUnsupported = errors.New("path probing is not supported on this platform")
+
+// MaxMTUProbes bounds the probe rounds of PathMTU. A round that nobody
+// answers takes up to two timeouts.
+const MaxMTUProbes = 24
+
+// Hop is one router on the path, or a probe nobody answered.
+type Hop struct {
+	// TTL is the hop limit the probe was sent with.
+	TTL int `json:"ttl"`
+	// Addr answered the probe; it is the zero Addr when nothing did.
+	Addr netip.Addr `json:"addr"`
+	// RTTSeconds is the round-trip time of the answer.
+	RTTSeconds float64 `json:"rtt_seconds"`
+}
+
+// Responded reports whether the hop answered.
+func (h Hop) Responded() bool {
+	return h.Addr.IsValid()
+}
+
+// Path is the result of a traceroute.
+type Path struct {
+	Dst netip.Addr `json:"dst"`
+	// Reached is set when the destination itself answered.
+	Reached bool  `json:"reached"`
+	Hops    []Hop `json:"hops"`
+}
+
+// Options control a traceroute or path MTU discovery. Zero values use the
+// defaults.
+type Options struct {
+	// MaxHops is the highest TTL probed, 30 by default.
+	MaxHops int
+	// Timeout is how long to wait for each hop to answer, 1s by default.
+	Timeout time.Duration
+	// Port is the base UDP destination port; traceroute probe n goes to
+	// Port+n, MTU probes go to Port. Defaults to 33434 like traceroute(8).
+	Port int
+	// Source is the local address probes are sent from.
+	Source netip.Addr
+	// Interface binds the probes to a network interface.
+	Interface string
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxHops <= 0 {
+		o.MaxHops = 30
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second
+	}
+	if o.Port <= 0 {
+		o.Port = 33434
+	}
+	return o
+}
+
+// Traceroute sends UDP probes with increasing TTLs to dst and records the
+// routers that report them expired. It stops when dst answers, a router
+// reports dst unreachable, or MaxHops is reached. No privileges are needed.
+func Traceroute(ctx context.Context, dst netip.Addr, opts Options) (*Path, error) {
+	return traceroute(ctx, dst.Unmap(), opts.withDefaults())
+}
+
+// PathMTU finds the largest packet that reaches dst unfragmented. It sends
+// UDP probes with the don't-fragment bit set, starting at the MTU of the
+// route to dst, and narrows the size down from the "fragmentation needed" or
+// "packet too big" errors of routers and from probes that go unanswered,
+// as they do in front of a PMTU blackhole. The destination must answer the
+// probes, usually with a port unreachable error. No privileges are needed.
+func PathMTU(ctx context.Context, dst netip.Addr, opts Options) (int, error) {
+	return pathMTU(ctx, dst.Unmap(), opts.withDefaults())
+}
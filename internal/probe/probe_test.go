@@ -0,0 +1,42 @@
+package probe
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestOptions_WithDefaults(t *testing.T) {
+	o := Options{}.withDefaults()
+	if o.MaxHops != 30 || o.Timeout != time.Second || o.Port != 33434 {
+		t.Errorf("unexpected defaults %+v", o)
+	}
+
+	o = Options{MaxHops: 5, Timeout: time.Millisecond, Port: 4000}.withDefaults()
+	if o.MaxHops != 5 || o.Timeout != time.Millisecond || o.Port != 4000 {
+		t.Errorf("explicit options were overridden: %+v", o)
+	}
+}
+
+func TestPath_JSON(t *testing.T) {
+	path := Path{
+		Dst:     netip.MustParseAddr("192.0.2.1"),
+		Reached: true,
+		Hops: []Hop{
+			{TTL: 1, Addr: netip.MustParseAddr("10.0.0.1"), RTTSeconds: 0.001},
+			{TTL: 2},
+		},
+	}
+	data, err := json.Marshal(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `{"dst":"192.0.2.1","reached":true,"hops":[{"ttl":1,"addr":"10.0.0.1","rtt_seconds":0.001},{"ttl":2,"addr":"","rtt_seconds":0}]}`
+	if string(data) != want {
+		t.Errorf("expected %s, got %s", want, data)
+	}
+	if path.Hops[1].Responded() {
+		t.Error("expected a hop without address not to have responded")
+	}
+}
@@ -0,0 +1,201 @@
+//go:build linux
+
+package probe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Supported reports whether Traceroute and PathMTU work on this platform.
+const Supported = true
+
+// ICMP types reported through the socket error queue.
+const (
+	icmpDestUnreachable  = 3
+	icmpTimeExceeded     = 11
+	icmp6DestUnreachable = 1
+	icmp6TimeExceeded    = 3
+
+	icmpFragNeeded    = 4 // code of icmpDestUnreachable
+	icmp6PacketTooBig = 2
+)
+
+// sockExtendedErrLen is the size of struct sock_extended_err, which is
+// followed by the address of the router that sent the ICMP error.
+const sockExtendedErrLen = 16
+
+// traceroute uses unprivileged UDP sockets with IP_RECVERR: ICMP errors
+// caused by a probe are queued on the socket instead of being dropped.
+func traceroute(ctx context.Context, dst netip.Addr, opts Options) (*Path, error) {
+	domain, level, ttlOpt, recvErrOpt := unix.AF_INET, unix.IPPROTO_IP, unix.IP_TTL, unix.IP_RECVERR
+	if dst.Is6() {
+		domain, level, ttlOpt, recvErrOpt = unix.AF_INET6, unix.IPPROTO_IPV6, unix.IPV6_UNICAST_HOPS, unix.IPV6_RECVERR
+	}
+
+	fd, err := unix.Socket(domain, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = unix.Close(fd) }()
+
+	if err := unix.SetsockoptInt(fd, level, recvErrOpt, 1); err != nil {
+		return nil, err
+	}
+	if opts.Interface != "" {
+		if err := unix.BindToDevice(fd, opts.Interface); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Source.IsValid() {
+		if err := unix.Bind(fd, sockaddr(opts.Source, 0)); err != nil {
+			return nil, err
+		}
+	}
+
+	path := &Path{Dst: dst}
+	for ttl := 1; ttl <= opts.MaxHops; ttl++ {
+		if err := ctx.Err(); err != nil {
+			return path, err
+		}
+		if err := unix.SetsockoptInt(fd, level, ttlOpt, ttl); err != nil {
+			return path, err
+		}
+
+		payload := binary.BigEndian.AppendUint16(nil, uint16(ttl))
+		start := time.Now()
+		if err := unix.Sendto(fd, payload, 0, sockaddr(dst, opts.Port+ttl)); err != nil {
+			return path, err
+		}
+
+		hop, done, err := waitHop(ctx, fd, dst, payload, start, opts.Timeout)
+		if err != nil {
+			return path, err
+		}
+		hop.TTL = ttl
+		path.Hops = append(path.Hops, hop)
+		if done {
+			path.Reached = hop.Addr == dst
+			break
+		}
+	}
+	return path, nil
+}
+
+// waitHop waits for the answer to the probe carrying payload. done is set
+// once the path ends, because dst answered or was reported unreachable.
+func waitHop(ctx context.Context, fd int, dst netip.Addr, payload []byte, start time.Time, timeout time.Duration) (hop Hop, done bool, err error) {
+	deadline := start.Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	buf := make([]byte, 512)
+	oob := make([]byte, 512)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return Hop{}, false, nil
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds, int(remaining.Milliseconds())+1)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return Hop{}, false, err
+		}
+		if n == 0 {
+			continue
+		}
+
+		// A reply from a UDP service listening on the destination port.
+		if fds[0].Revents&unix.POLLIN != 0 {
+			if _, _, err := unix.Recvfrom(fd, buf, unix.MSG_DONTWAIT); err == nil {
+				return Hop{Addr: dst, RTTSeconds: time.Since(start).Seconds()}, true, nil
+			}
+		}
+		if fds[0].Revents&unix.POLLERR == 0 {
+			continue
+		}
+
+		n, oobn, _, _, err := unix.Recvmsg(fd, buf, oob, unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		if err != nil {
+			continue
+		}
+		rtt := time.Since(start).Seconds()
+		// The error queue returns the probe that caused the error; answers to
+		// earlier probes that arrive late are skipped.
+		if n < len(payload) || string(buf[:len(payload)]) != string(payload) {
+			continue
+		}
+		e, ok := parseRecvErr(oob[:oobn])
+		if !ok {
+			continue
+		}
+		hop := Hop{Addr: e.from, RTTSeconds: rtt}
+		switch {
+		case dst.Is4() && e.icmpType == icmpTimeExceeded, dst.Is6() && e.icmpType == icmp6TimeExceeded:
+			return hop, false, nil
+		case dst.Is4() && e.icmpType == icmpDestUnreachable, dst.Is6() && e.icmpType == icmp6DestUnreachable:
+			return hop, true, nil
+		}
+	}
+}
+
+// recvErr is an ICMP error read from the socket error queue.
+type recvErr struct {
+	from     netip.Addr
+	icmpType uint8
+	icmpCode uint8
+	// info is the next-hop MTU of fragmentation needed and packet too big
+	// errors.
+	info uint32
+}
+
+// parseRecvErr extracts the ICMP error of an IP_RECVERR or IPV6_RECVERR
+// control message.
+func parseRecvErr(oob []byte) (recvErr, bool) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return recvErr{}, false
+	}
+	for _, m := range msgs {
+		isV4 := m.Header.Level == unix.IPPROTO_IP && m.Header.Type == unix.IP_RECVERR
+		isV6 := m.Header.Level == unix.IPPROTO_IPV6 && m.Header.Type == unix.IPV6_RECVERR
+		if (!isV4 && !isV6) || len(m.Data) < sockExtendedErrLen+2 {
+			continue
+		}
+		origin := m.Data[4]
+		if origin != unix.SO_EE_ORIGIN_ICMP && origin != unix.SO_EE_ORIGIN_ICMP6 {
+			continue
+		}
+		e := recvErr{icmpType: m.Data[5], icmpCode: m.Data[6], info: binary.NativeEndian.Uint32(m.Data[8:12])}
+		offender := m.Data[sockExtendedErrLen:]
+		switch binary.NativeEndian.Uint16(offender) {
+		case unix.AF_INET:
+			if len(offender) >= 8 {
+				e.from = netip.AddrFrom4([4]byte(offender[4:8]))
+				return e, true
+			}
+		case unix.AF_INET6:
+			if len(offender) >= 24 {
+				e.from = netip.AddrFrom16([16]byte(offender[8:24])).Unmap()
+				return e, true
+			}
+		}
+	}
+	return recvErr{}, false
+}
+
+func sockaddr(addr netip.Addr, port int) unix.Sockaddr {
+	if addr.Is4() {
+		return &unix.SockaddrInet4{Port: port, Addr: addr.As4()}
+	}
+	return &unix.SockaddrInet6{Port: port, Addr: addr.As16()}
+}
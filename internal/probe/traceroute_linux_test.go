@@ -0,0 +1,79 @@
+//go:build linux
+
+package probe
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// closedPort returns a UDP port on addr that nothing listens on.
+func closedPort(t *testing.T, addr string) int {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(addr, "0"))
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", addr, err)
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	_ = pc.Close()
+	return port
+}
+
+func TestTraceroute_Loopback(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", "::1"} {
+		t.Run(addr, func(t *testing.T) {
+			dst := netip.MustParseAddr(addr)
+			// Probe n goes to Port+n, so the first probe hits the closed port.
+			opts := Options{MaxHops: 3, Timeout: 2 * time.Second, Port: closedPort(t, addr) - 1}
+
+			path, err := Traceroute(context.Background(), dst, opts)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !path.Reached {
+				t.Fatalf("expected the destination to be reached, got %+v", path)
+			}
+			if len(path.Hops) != 1 {
+				t.Fatalf("expected 1 hop on loopback, got %+v", path.Hops)
+			}
+			if hop := path.Hops[0]; hop.TTL != 1 || hop.Addr != dst || hop.RTTSeconds <= 0 {
+				t.Errorf("unexpected hop %+v", hop)
+			}
+		})
+	}
+}
+
+func TestTraceroute_ListeningService(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer func() { _ = pc.Close() }()
+	go func() {
+		buf := make([]byte, 64)
+		n, addr, err := pc.ReadFrom(buf)
+		if err == nil {
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	path, err := Traceroute(context.Background(), netip.MustParseAddr("127.0.0.1"), Options{MaxHops: 3, Port: port - 1})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !path.Reached || len(path.Hops) != 1 {
+		t.Errorf("expected the listening destination to end the trace, got %+v", path)
+	}
+}
+
+func TestTraceroute_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Traceroute(ctx, netip.MustParseAddr("127.0.0.1"), Options{}); err == nil {
+		t.Error("expected an error for a cancelled context")
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package probe
+
+import (
+	"context"
+	"net/netip"
+)
+
+// Supported reports whether Traceroute and PathMTU work on this platform.
+const Supported = false
+
+func traceroute(context.Context, netip.Addr, Options) (*Path, error) {
+	return nil, ErrUnsupported
+}
+
+func pathMTU(context.Context, netip.Addr, Options) (int, error) {
+	return 0, ErrUnsupported
+}